@@ -43,10 +43,14 @@ const (
 
 func completer(d prompt.Document) []prompt.Suggest {
 	s := []prompt.Suggest{
-		{Text: "CREATE", Description: "CREATE timeseries-name [retention]"},
-		{Text: "DELETE", Description: "DELETE timeseries-name"},
+		{Text: "CREATE", Description: "CREATE timeseries-name [retention] [DUPLICATE BLOCK|FIRST|LAST|SUM|MIN|MAX]"},
+		{Text: "DELETE", Description: "DELETE timeseries-name [RANGE start end]"},
 		{Text: "ADD", Description: "ADD timeseries-name [*|timestamp] value"},
-		{Text: "QUERY", Description: "QUERY timeseries-name [*|timestamp] [MIN|MAX|FIRST|LAST] [>|<|RANGE] timestamp-[lower|upper] [AVG [interval]]"},
+		{Text: "MADD", Description: "MADD timeseries-name [*|timestamp] value [timeseries-name [*|timestamp] value ...]"},
+		{Text: "QUERY", Description: "QUERY timeseries-name [*|timestamp] [MIN|MAX|FIRST|LAST] [>|<|RANGE] timestamp-[lower|upper] [AVG|SUM|COUNT|MIN|MAX|FIRST|LAST|STDDEV|VARIANCE|Pnn|RATE|IRATE|INCREASE|DERIVATIVE [interval] [FILL NONE|NULL|PREVIOUS|LINEAR|value]]"},
+		{Text: "LIST", Description: "LIST [pattern] list the timeseries matching a glob pattern"},
+		{Text: "INFO", Description: "INFO timeseries-name"},
+		{Text: "SNAPSHOT", Description: "SNAPSHOT save a copy of the database to disk"},
 		{Text: "QUIT", Description: "Close the prompt"},
 	}
 	return prompt.FilterHasPrefix(s, d.GetWordBeforeCursor(), true)
@@ -1,6 +1,12 @@
 package main
 
-import "github.com/codepr/timepipe/network"
+import (
+	"flag"
+	"github.com/codepr/timepipe/network"
+	"github.com/codepr/timepipe/wal"
+	"log"
+	"time"
+)
 
 const (
 	TYPE = "tcp"
@@ -9,6 +15,38 @@ const (
 )
 
 func main() {
+	walDir := flag.String("wal-dir", "", "Directory of the write-ahead log, disabled if empty")
+	walFsync := flag.String("wal-fsync", "interval", "WAL fsync policy: always, interval or never")
+	walFsyncInterval := flag.Int("wal-fsync-interval", 1000, "Milliseconds between WAL fsyncs with the interval policy")
+	snapshotFile := flag.String("snapshot-file", "", "File used to save and restore snapshots, disabled if empty")
+	oooWindow := flag.Int("ooo-window", 0, "Milliseconds a record can lag behind the most recent one of its timeseries, 0 accepts any late record")
+	readTimeout := flag.Int("read-timeout", 0, "Milliseconds a request can take to be received once started, 0 waits forever")
+	writeTimeout := flag.Int("write-timeout", 10000, "Milliseconds a response can take to be sent, 0 waits forever")
+	idleTimeout := flag.Int("idle-timeout", 0, "Milliseconds a connection can wait for its next request, 0 waits forever")
+	queryTimeout := flag.Int("query-timeout", 0, "Milliseconds a query can run before being aborted, 0 waits forever")
+	flag.Parse()
+
 	server := network.NewServer(TYPE, HOST, PORT)
+	server.SetOutOfOrderWindow(time.Duration(*oooWindow) * time.Millisecond)
+	server.SetTimeouts(network.Timeouts{
+		Read:  time.Duration(*readTimeout) * time.Millisecond,
+		Write: time.Duration(*writeTimeout) * time.Millisecond,
+		Idle:  time.Duration(*idleTimeout) * time.Millisecond,
+		Query: time.Duration(*queryTimeout) * time.Millisecond,
+	})
+	if *walDir != "" {
+		policy, err := wal.ParseSyncPolicy(*walFsync)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.EnableWAL(wal.Options{
+			Dir:          *walDir,
+			SyncPolicy:   policy,
+			SyncInterval: time.Duration(*walFsyncInterval) * time.Millisecond,
+		})
+	}
+	if *snapshotFile != "" {
+		server.EnableSnapshot(*snapshotFile)
+	}
 	server.Run()
 }
@@ -0,0 +1,204 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/codepr/timepipe/network/protocol"
+	series "github.com/codepr/timepipe/timeseries"
+	"time"
+)
+
+// Errors returned by the typed methods of the Client, derived from the status
+// of the response
+var (
+	ErrSeriesNotFound = errors.New("timeseries not found")
+	ErrSeriesExists   = errors.New("timeseries already exists")
+	ErrTooLate        = errors.New("record older than the out-of-order window")
+	ErrDuplicate      = errors.New("duplicate timestamp")
+	ErrUnknownCommand = errors.New("unknown command")
+)
+
+// QueryOptions describes a query, Name is either a series key or a selector
+// matching many series. Start and End bound the records selected, a 0 bound
+// leaves that side open. Select picks a single record, one of protocol.MIN,
+// MAX, FIRST or LAST, otherwise records can be reduced in windows of Interval
+// by an Aggregation or a Counter function, one of protocol.RATE,
+// IRATE, INCREASE or DERIVATIVE. Quantile is set only with the AggQuantile
+// aggregation and FillValue only with the FillValue policy.
+type QueryOptions struct {
+	Name        string
+	Start       int64
+	End         int64
+	Select      byte
+	Aggregation series.Aggregation
+	Counter     byte
+	Interval    time.Duration
+	Quantile    float64
+	Fill        series.FillPolicy
+	FillValue   float64
+}
+
+// statusErr returns the error reported by the status of a response, nil if
+// it reports a success
+func statusErr(status uint16) error {
+	switch status {
+	case protocol.TSNOTFOUND:
+		return ErrSeriesNotFound
+	case protocol.TSEXISTS:
+		return ErrSeriesExists
+	case protocol.TOOLATE:
+		return ErrTooLate
+	case protocol.DUPLICATE:
+		return ErrDuplicate
+	case protocol.UNKNOWNCMD:
+		return ErrUnknownCommand
+	}
+	return nil
+}
+
+// do sends a command and waits for its response until ctx is done, failures
+// reported by its status are returned as errors
+func (c *Client) do(ctx context.Context, command Command) (*TpResponse, error) {
+	r, err := c.exec(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	return r, statusErr(r.Header.Status())
+}
+
+// Create creates a timeseries, name is a series key optionally carrying
+// labels, e.g. cpu{host="a"}, a 0 retention keeps records forever
+func (c *Client) Create(name string, retention time.Duration) error {
+	return c.CreateContext(context.Background(), name, retention)
+}
+
+// CreateContext is Create giving up when ctx is done
+func (c *Client) CreateContext(ctx context.Context, name string, retention time.Duration) error {
+	_, err := c.do(ctx, Command{Type: CREATE, TimeSeries: timeseries{name, int64(retention)}})
+	return err
+}
+
+// Delete deletes a timeseries with all its records
+func (c *Client) Delete(name string) error {
+	return c.DeleteContext(context.Background(), name)
+}
+
+// DeleteContext is Delete giving up when ctx is done
+func (c *Client) DeleteContext(ctx context.Context, name string) error {
+	_, err := c.do(ctx, Command{Type: DELETE, TimeSeries: timeseries{Name: name}})
+	return err
+}
+
+// AddPoint adds a record to a timeseries, a 0 timestamp is replaced by the
+// server with the time of arrival. A record merged with one having the same
+// timestamp is not an error.
+func (c *Client) AddPoint(name string, timestamp int64, value float64) error {
+	return c.AddPointContext(context.Background(), name, timestamp, value)
+}
+
+// AddPointContext is AddPoint giving up when ctx is done
+func (c *Client) AddPointContext(ctx context.Context, name string, timestamp int64, value float64) error {
+	_, err := c.do(ctx, Command{
+		Type:       ADD,
+		TimeSeries: timeseries{Name: name},
+		Timestamp:  timestamp,
+		Value:      value,
+	})
+	return err
+}
+
+// AddPoints adds records to one or more timeseries in a single request, the
+// records of each series are either all stored or, if any of them is
+// rejected, none is. The outcome of each series is returned by name, the
+// error is set only if the whole request failed.
+func (c *Client) AddPoints(points []Point) (map[string]error, error) {
+	return c.AddPointsContext(context.Background(), points)
+}
+
+// AddPointsContext is AddPoints giving up when ctx is done
+func (c *Client) AddPointsContext(ctx context.Context, points []Point) (map[string]error, error) {
+	command := Command{Type: MADD, Points: points}
+	r, err := c.do(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	names := command.seriesNames()
+	errs := make(map[string]error, len(names))
+	for i, status := range r.MultiAdd.Statuses {
+		if i < len(names) {
+			errs[names[i]] = statusErr(uint16(status))
+		}
+	}
+	return errs, nil
+}
+
+// Query runs a query and returns the records of every series matched, a
+// single one when querying by key
+func (c *Client) Query(opts QueryOptions) ([]protocol.SeriesPoints, error) {
+	return c.QueryContext(context.Background(), opts)
+}
+
+// QueryContext is Query giving up when ctx is done
+func (c *Client) QueryContext(ctx context.Context, opts QueryOptions) ([]protocol.SeriesPoints, error) {
+	command := Command{
+		Type:        QUERY,
+		TimeSeries:  timeseries{Name: opts.Name},
+		Range:       timerange{opts.Start, opts.End},
+		Flag:        opts.Select<<1 | opts.Counter<<4,
+		Avg:         -1,
+		Aggregation: opts.Aggregation,
+		Interval:    int64(opts.Interval),
+		Quantile:    opts.Quantile,
+		Fill:        opts.Fill,
+		FillValue:   opts.FillValue,
+	}
+	if opts.Aggregation == series.AggAvg {
+		command.Avg = int64(opts.Interval)
+	}
+	r, err := c.do(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	if r.Header.Opcode() == protocol.MULTIQUERYRESPONSE {
+		return r.Multi.Series, nil
+	}
+	return []protocol.SeriesPoints{{Name: opts.Name, Records: r.Payload.Records}}, nil
+}
+
+// Ping checks that the server still answers on the connection, sending a
+// cheap request, the INFO of a series that can't exist
+func (c *Client) Ping() error {
+	return c.PingContext(context.Background())
+}
+
+// PingContext is Ping giving up when ctx is done
+func (c *Client) PingContext(ctx context.Context) error {
+	_, err := c.exec(ctx, Command{Type: INFO})
+	return err
+}
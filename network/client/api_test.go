@@ -0,0 +1,106 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package client
+
+import (
+	"github.com/codepr/timepipe/network/protocol"
+	series "github.com/codepr/timepipe/timeseries"
+	"testing"
+	"time"
+)
+
+func TestClientCreate(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	if err := c.Create(`cpu{host="a"}`, 0); err != nil {
+		t.Errorf("Failed to create timeseries: %v", err)
+	}
+	if err := c.Create(`cpu{host="a"}`, 0); err != ErrSeriesExists {
+		t.Errorf("Expected ErrSeriesExists got %v", err)
+	}
+	if err := c.Delete(`cpu{host="a"}`); err != nil {
+		t.Errorf("Failed to delete timeseries: %v", err)
+	}
+	if err := c.AddPoint(`cpu{host="a"}`, 0, 1); err != ErrSeriesNotFound {
+		t.Errorf("Expected ErrSeriesNotFound got %v", err)
+	}
+}
+
+func TestClientAddPoints(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	c.Create("ts-a", 0)
+	if err := c.AddPoint("ts-a", 1e9, 1); err != nil {
+		t.Errorf("Failed to add point: %v", err)
+	}
+	errs, err := c.AddPoints([]Point{{"ts-a", 2e9, 2}, {"ts-b", 2e9, 2}, {"ts-a", 3e9, 3}})
+	if err != nil {
+		t.Fatalf("Failed to add points: %v", err)
+	}
+	if len(errs) != 2 || errs["ts-a"] != nil || errs["ts-b"] != ErrSeriesNotFound {
+		t.Errorf("Expected ts-b not to be found, got %v", errs)
+	}
+	result, err := c.Query(QueryOptions{Name: "ts-a"})
+	if err != nil || len(result) != 1 || len(result[0].Records) != 3 {
+		t.Errorf("Expected 3 records got %v (%v)", result, err)
+	}
+}
+
+func TestClientQuery(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	for _, host := range []string{"a", "b"} {
+		name := `cpu{host="` + host + `"}`
+		c.Create(name, 0)
+		for i := int64(1); i <= 4; i++ {
+			c.AddPoint(name, i*1e9, float64(i))
+		}
+	}
+	result, err := c.Query(QueryOptions{
+		Name:        `cpu{host="a"}`,
+		Start:       2e9,
+		Aggregation: series.AggSum,
+		Interval:    2 * time.Second,
+	})
+	if err != nil || len(result) != 1 || len(result[0].Records) != 2 ||
+		result[0].Records[0].Value != 5 || result[0].Records[1].Value != 4 {
+		t.Errorf("Unexpected aggregation result %v (%v)", result, err)
+	}
+	result, err = c.Query(QueryOptions{Name: `{host=~"a|b"}`, Select: protocol.LAST})
+	if err != nil || len(result) != 2 || result[0].Records[0].Value != 4 {
+		t.Errorf("Unexpected selector result %v (%v)", result, err)
+	}
+	if _, err := c.Query(QueryOptions{Name: "missing"}); err != ErrSeriesNotFound {
+		t.Errorf("Expected ErrSeriesNotFound got %v", err)
+	}
+}
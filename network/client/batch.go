@@ -0,0 +1,306 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBatchSize         = 1000
+	DefaultFlushInterval     = time.Second
+	DefaultMaxBufferedPoints = 100000
+)
+
+var (
+	BatchWriterClosedErr = errors.New("batch writer closed")
+	BufferFullErr        = errors.New("batch writer buffer full")
+)
+
+// OverflowPolicy decides what a BatchWriter does with a point written while
+// its buffer is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for a flush to make room for the point
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop discards the point, counting it as dropped
+	OverflowDrop
+)
+
+// PointsWriter adds batches of records to a timepipe server, implemented by
+// both Client and Pool
+type PointsWriter interface {
+	AddPoints(points []Point) (map[string]error, error)
+}
+
+// BatchWriterOptions configures a BatchWriter, buffered points are flushed
+// once they're BatchSize or every FlushInterval, whichever comes first. At
+// most MaxBufferedPoints are held at once, counting the ones being flushed,
+// Overflow decides what happens to the points written past that bound.
+// OnError is called with every error of a flush that wasn't requested
+// explicitly, if unset the first one is kept and returned by Err and by the
+// next Flush or Close. Zero values fall back to their default.
+type BatchWriterOptions struct {
+	BatchSize         int
+	FlushInterval     time.Duration
+	MaxBufferedPoints int
+	Overflow          OverflowPolicy
+	OnError           func(error)
+}
+
+// WriteError reports the points of a timeseries a flush failed to add, Err
+// is either the error of the whole request or the one of the series
+type WriteError struct {
+	Name   string
+	Points []Point
+	Err    error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("failed to write %d points to %s: %v", len(e.Points), e.Name, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// BatchWriter buffers points per timeseries and adds them asynchronously,
+// in bulk requests carrying up to BatchSize points each, safe for concurrent
+// use. Points of the same series are sent in the order they're written.
+type BatchWriter struct {
+	w    PointsWriter
+	opts BatchWriterOptions
+	mu   sync.Mutex
+	// Signaled every time a flush makes room in the buffer
+	room    *sync.Cond
+	buffer  map[string][]Point
+	names   []string
+	pending int
+	// Points buffered or being flushed
+	size    int
+	dropped int64
+	closed  bool
+	// First error of the background flushes not reported yet
+	err error
+	// Serializes flushes, so that batches are sent in order
+	flushMu sync.Mutex
+	flushc  chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewBatchWriter creates a BatchWriter adding points through w, flushing in
+// background until closed
+func NewBatchWriter(w PointsWriter, opts BatchWriterOptions) *BatchWriter {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.MaxBufferedPoints <= 0 {
+		opts.MaxBufferedPoints = DefaultMaxBufferedPoints
+	}
+	if opts.MaxBufferedPoints < opts.BatchSize {
+		opts.MaxBufferedPoints = opts.BatchSize
+	}
+	b := &BatchWriter{
+		w:      w,
+		opts:   opts,
+		buffer: map[string][]Point{},
+		flushc: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	b.room = sync.NewCond(&b.mu)
+	b.wg.Add(1)
+	go b.run()
+	return b
+}
+
+// Write buffers a record of a timeseries, a 0 timestamp is replaced by the
+// server with the time of arrival. If the buffer is full it either waits for
+// room or returns BufferFullErr, according to the overflow policy.
+func (b *BatchWriter) Write(name string, timestamp int64, value float64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for !b.closed && b.size >= b.opts.MaxBufferedPoints {
+		if b.opts.Overflow == OverflowDrop {
+			b.dropped++
+			return BufferFullErr
+		}
+		b.room.Wait()
+	}
+	if b.closed {
+		return BatchWriterClosedErr
+	}
+	if _, ok := b.buffer[name]; !ok {
+		b.names = append(b.names, name)
+	}
+	b.buffer[name] = append(b.buffer[name], Point{name, timestamp, value})
+	b.pending++
+	b.size++
+	if b.pending >= b.opts.BatchSize {
+		select {
+		case b.flushc <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Dropped returns the number of points discarded because the buffer was full
+func (b *BatchWriter) Dropped() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
+
+// Err returns the first error of the background flushes not reported yet by
+// Flush or Close, always nil when OnError is set
+func (b *BatchWriter) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// Flush adds every buffered point, returning the first error met, errors of
+// the background flushes not reported yet come first
+func (b *BatchWriter) Flush() error {
+	errs := b.flush()
+	b.mu.Lock()
+	err := b.err
+	b.err = nil
+	b.mu.Unlock()
+	if err == nil && len(errs) > 0 {
+		err = errs[0]
+	}
+	return err
+}
+
+// Close flushes every buffered point and stops the writer, the points
+// written afterwards are refused with BatchWriterClosedErr
+func (b *BatchWriter) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return BatchWriterClosedErr
+	}
+	b.closed = true
+	// Blocked writers give up
+	b.room.Broadcast()
+	b.mu.Unlock()
+	close(b.done)
+	b.wg.Wait()
+	return b.Flush()
+}
+
+// run flushes the buffer every FlushInterval or as soon as it holds a batch
+func (b *BatchWriter) run() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.flushc:
+		case <-b.done:
+			return
+		}
+		errs := b.flush()
+		if b.opts.OnError != nil {
+			for _, err := range errs {
+				b.opts.OnError(err)
+			}
+		} else if len(errs) > 0 {
+			b.mu.Lock()
+			if b.err == nil {
+				b.err = errs[0]
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+// flush takes the buffered points and sends them in batches of at most
+// BatchSize points, grouped by timeseries. The points are released as soon
+// as their batch is done, whatever its outcome, failures are returned as
+// WriteErrors.
+func (b *BatchWriter) flush() []error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	b.mu.Lock()
+	buffer, names := b.buffer, b.names
+	b.buffer, b.names, b.pending = map[string][]Point{}, nil, 0
+	b.mu.Unlock()
+	errs := []error{}
+	batch := make([]Point, 0, b.opts.BatchSize)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		errs = append(errs, b.send(batch)...)
+		b.mu.Lock()
+		b.size -= len(batch)
+		b.room.Broadcast()
+		b.mu.Unlock()
+		batch = make([]Point, 0, b.opts.BatchSize)
+	}
+	for _, name := range names {
+		for _, p := range buffer[name] {
+			batch = append(batch, p)
+			if len(batch) == b.opts.BatchSize {
+				send()
+			}
+		}
+	}
+	send()
+	return errs
+}
+
+// send adds a batch of points grouped by timeseries, returning a WriteError
+// for each series that failed
+func (b *BatchWriter) send(batch []Point) []error {
+	results, err := b.w.AddPoints(batch)
+	errs := []error{}
+	for i, j := 0, 0; i < len(batch); i = j {
+		for j < len(batch) && batch[j].Name == batch[i].Name {
+			j++
+		}
+		serr := err
+		if serr == nil {
+			serr = results[batch[i].Name]
+		}
+		if serr != nil {
+			errs = append(errs, &WriteError{batch[i].Name, batch[i:j], serr})
+		}
+	}
+	return errs
+}
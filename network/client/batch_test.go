@@ -0,0 +1,268 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package client
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPointsWriter records the batches it's given, waiting for gate to be
+// closed when set
+type testPointsWriter struct {
+	mu      sync.Mutex
+	batches [][]Point
+	sent    chan int
+	gate    chan struct{}
+}
+
+func newTestPointsWriter() *testPointsWriter {
+	return &testPointsWriter{sent: make(chan int, 64)}
+}
+
+func (w *testPointsWriter) AddPoints(points []Point) (map[string]error, error) {
+	if w.gate != nil {
+		<-w.gate
+	}
+	w.mu.Lock()
+	w.batches = append(w.batches, points)
+	w.mu.Unlock()
+	w.sent <- len(points)
+	return map[string]error{}, nil
+}
+
+func expectBatch(t *testing.T, w *testPointsWriter, size int) {
+	select {
+	case n := <-w.sent:
+		if n != size {
+			t.Errorf("Expected a batch of %v points got %v", size, n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a batch of %v points got none", size)
+	}
+}
+
+func TestBatchWriter(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	for _, name := range []string{"s1", "s2"} {
+		if err := c.Create(name, 0); err != nil {
+			t.Fatalf("Failed to create timeseries: %v", err)
+		}
+	}
+	b := NewBatchWriter(c, BatchWriterOptions{BatchSize: 100, FlushInterval: time.Hour})
+	const n = 1050
+	for i := 0; i < n; i++ {
+		if err := b.Write("s1", int64(i+1), float64(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Write("s2", int64(i+1), float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	for _, name := range []string{"s1", "s2"} {
+		result, err := c.Query(QueryOptions{Name: name})
+		if err != nil || len(result[0].Records) != n {
+			t.Fatalf("Expected %v records got %v (%v)", n, len(result[0].Records), err)
+		}
+		for i, r := range result[0].Records {
+			if r.Timestamp != int64(i+1) || r.Value != float64(i) {
+				t.Errorf("Expected record %v got %v", i, r)
+				break
+			}
+		}
+	}
+	if err := b.Write("s1", 0, 1); err != BatchWriterClosedErr {
+		t.Errorf("Expected BatchWriterClosedErr got %v", err)
+	}
+}
+
+func TestBatchWriterFlushBySize(t *testing.T) {
+	w := newTestPointsWriter()
+	b := NewBatchWriter(w, BatchWriterOptions{BatchSize: 10, FlushInterval: time.Hour})
+	for i := 0; i < 25; i++ {
+		b.Write("s1", int64(i+1), 1)
+	}
+	expectBatch(t, w, 10)
+	expectBatch(t, w, 10)
+	b.Close()
+	expectBatch(t, w, 5)
+	// Points of a series are grouped in each batch, in order of writing
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ts := int64(1)
+	for _, batch := range w.batches {
+		for _, p := range batch {
+			if p.Timestamp != ts {
+				t.Fatalf("Expected timestamp %v got %v", ts, p.Timestamp)
+			}
+			ts++
+		}
+	}
+}
+
+func TestBatchWriterFlushByInterval(t *testing.T) {
+	w := newTestPointsWriter()
+	b := NewBatchWriter(w, BatchWriterOptions{FlushInterval: 10 * time.Millisecond})
+	defer b.Close()
+	b.Write("s1", 1, 1)
+	b.Write("s2", 1, 1)
+	b.Write("s1", 2, 1)
+	expectBatch(t, w, 3)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	names := []string{}
+	for _, p := range w.batches[0] {
+		names = append(names, p.Name)
+	}
+	if names[0] != "s1" || names[1] != "s1" || names[2] != "s2" {
+		t.Errorf("Expected points grouped by series got %v", names)
+	}
+}
+
+func TestBatchWriterOverflow(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowDrop, OverflowBlock} {
+		w := newTestPointsWriter()
+		w.gate = make(chan struct{})
+		b := NewBatchWriter(w, BatchWriterOptions{
+			BatchSize:         2,
+			FlushInterval:     time.Hour,
+			MaxBufferedPoints: 2,
+			Overflow:          policy,
+		})
+		b.Write("s1", 1, 1)
+		b.Write("s1", 2, 1)
+		// The flush is stuck, the buffer is full
+		written := make(chan error, 1)
+		go func() { written <- b.Write("s1", 3, 1) }()
+		if policy == OverflowDrop {
+			if err := <-written; err != BufferFullErr {
+				t.Errorf("Expected BufferFullErr got %v", err)
+			}
+			if b.Dropped() != 1 {
+				t.Errorf("Expected 1 dropped point got %v", b.Dropped())
+			}
+			close(w.gate)
+			expectBatch(t, w, 2)
+		} else {
+			select {
+			case err := <-written:
+				t.Fatalf("Expected Write to block got %v", err)
+			case <-time.After(20 * time.Millisecond):
+			}
+			close(w.gate)
+			expectBatch(t, w, 2)
+			if err := <-written; err != nil {
+				t.Errorf("Expected Write to succeed got %v", err)
+			}
+			if b.Dropped() != 0 {
+				t.Errorf("Expected no dropped points got %v", b.Dropped())
+			}
+		}
+		b.Close()
+	}
+}
+
+func TestBatchWriterErrors(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	if err := c.Create("s1", 0); err != nil {
+		t.Fatalf("Failed to create timeseries: %v", err)
+	}
+	errs := make(chan error, 1)
+	b := NewBatchWriter(c, BatchWriterOptions{
+		BatchSize:     3,
+		FlushInterval: time.Hour,
+		OnError:       func(err error) { errs <- err },
+	})
+	b.Write("s1", 1, 1)
+	b.Write("missing", 1, 1)
+	b.Write("missing", 2, 1)
+	select {
+	case err := <-errs:
+		var we *WriteError
+		if !errors.As(err, &we) || !errors.Is(err, ErrSeriesNotFound) {
+			t.Fatalf("Expected a WriteError for a missing series got %v", err)
+		}
+		if we.Name != "missing" || len(we.Points) != 2 {
+			t.Errorf("Expected 2 failed points of missing got %v", we)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a flush error")
+	}
+	// Explicit flushes return their errors
+	b.Write("missing", 3, 1)
+	if err := b.Flush(); !errors.Is(err, ErrSeriesNotFound) {
+		t.Errorf("Expected ErrSeriesNotFound got %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("Expected nothing left to flush got %v", err)
+	}
+	result, err := c.Query(QueryOptions{Name: "s1"})
+	if err != nil || len(result[0].Records) != 1 {
+		t.Errorf("Expected 1 record got %v (%v)", result, err)
+	}
+}
+
+func TestBatchWriterBackgroundErrors(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	b := NewBatchWriter(c, BatchWriterOptions{BatchSize: 2, FlushInterval: time.Hour})
+	// Without OnError the errors of the background flushes are kept for
+	// the next Flush
+	b.Write("missing", 1, 1)
+	b.Write("missing", 2, 1)
+	for deadline := time.Now().Add(time.Second); b.Err() == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a background flush error")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := b.Err(); !errors.Is(err, ErrSeriesNotFound) {
+		t.Errorf("Expected ErrSeriesNotFound got %v", err)
+	}
+	if err := b.Flush(); !errors.Is(err, ErrSeriesNotFound) {
+		t.Errorf("Expected Flush to return the background error got %v", err)
+	}
+	if err := b.Err(); err != nil {
+		t.Errorf("Expected the error to be reported once got %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("Expected nothing left to flush got %v", err)
+	}
+}
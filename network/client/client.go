@@ -28,59 +28,702 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"encoding"
+	"errors"
 	"fmt"
 	"github.com/codepr/timepipe/network/protocol"
 	"io"
+	"log"
+	"math/rand"
 	"net"
+	"sync"
+	"time"
 )
 
+var (
+	ClientClosedErr = errors.New("client closed")
+	// Requests failing with an error wrapping ConnectionLostErr may or may
+	// not have been applied by the server
+	ConnectionLostErr = errors.New("connection lost")
+	UnbufferedDoneErr = errors.New("done channel is unbuffered")
+)
+
+const (
+	DefaultReconnectAttempts = 5
+	DefaultInitialBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff        = 5 * time.Second
+	DefaultRetryAttempts     = 3
+)
+
+// ConnState is the state of the connection of a Client
+type ConnState int
+
+const (
+	StateConnected ConnState = iota
+	StateDisconnected
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// RetryPolicy tells which commands are sent again when their connection is
+// lost before their response is received, only idempotent commands should
+// be retried. MaxAttempts counts the first one too, 1 disables retries.
+// A lost attempt may have been applied anyway, so a CREATE answered with
+// TSEXISTS once retried is reported as successful, even if the series was
+// actually created by someone else meanwhile.
+type RetryPolicy struct {
+	MaxAttempts int
+	Commands    []int
+}
+
+// ClientOptions configures how a Client recovers from a lost connection, it's
+// reestablished by the first request following the failure, making up to
+// ReconnectAttempts attempts, a negative value disables reconnects. Attempts,
+// and retries of commands, are spaced by an exponential backoff with jitter,
+// starting from InitialBackoff up to MaxBackoff. OnStateChange, if set, is
+// called on every change of state of the connection, it must not block. Zero
+// values fall back to their default, the default RetryPolicy retries QUERY
+// and CREATE. Timeout bounds each dial and each request whose context has no
+// deadline, retries included, 0 waits forever.
+type ClientOptions struct {
+	ReconnectAttempts int
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	Retry             RetryPolicy
+	OnStateChange     func(state ConnState, err error)
+	Timeout           time.Duration
+}
+
+// Client is a connection to a timepipe server, it's safe for concurrent use.
+// With servers speaking V2 or later requests are pipelined, each one carries
+// an ID echoed by the server in the response, V1 servers are served one
+// request at a time instead
 type Client struct {
-	host, port string
-	conn       net.Conn
-	rw         *bufio.ReadWriter
+	network, host, port string
+	opts                ClientOptions
+	conn                net.Conn
+	rw                  *bufio.ReadWriter
+	version             byte
+	// wmu serializes the writes on the connection, with V1 servers it
+	// guards the whole round trip
+	wmu     sync.Mutex
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]*Call
+	closing bool
+	err     error
+	// Held while reconnecting, so that a single request redials
+	dialMu sync.Mutex
 }
 
 type TpResponse struct {
-	Header  protocol.Header
-	Command Command
-	Payload protocol.QueryResponsePacket
+	Header   protocol.Header
+	Command  Command
+	Payload  protocol.QueryResponsePacket
+	MultiAdd protocol.MultiAddPointResponsePacket
+	Multi    protocol.MultiQueryResponsePacket
+	List     protocol.ListResponsePacket
+	Info     protocol.InfoResponsePacket
+	Deleted  protocol.DeleteRangeResponsePacket
+}
+
+// Call represents a request in flight, once completed, with either a
+// Response or an Error, it's sent on Done
+type Call struct {
+	Command  Command
+	Response *TpResponse
+	Error    error
+	Done     chan *Call
+	// ID of the request, set once it's pending on a V2 connection
+	id uint32
 }
 
+func (call *Call) done() {
+	select {
+	case call.Done <- call:
+	default:
+		// Done must be buffered, a full channel is a caller's fault and
+		// the completion is lost
+		log.Print("timepipe: discarding Call reply due to insufficient Done chan capacity")
+	}
+}
+
+// NewTimepipeClient connects to a timepipe server with the default options
 func NewTimepipeClient(network, host, port string) (*Client, error) {
-	conn, err := net.Dial(network, host+":"+port)
-	if err != nil {
+	return NewTimepipeClientWithOptions(network, host, port, ClientOptions{})
+}
+
+// NewTimepipeClientWithOptions connects to a timepipe server, failing if the
+// first attempt fails
+func NewTimepipeClientWithOptions(network, host, port string, opts ClientOptions) (*Client, error) {
+	if opts.ReconnectAttempts == 0 {
+		opts.ReconnectAttempts = DefaultReconnectAttempts
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = DefaultInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.Retry.MaxAttempts <= 0 {
+		opts.Retry.MaxAttempts = DefaultRetryAttempts
+	}
+	if opts.Retry.Commands == nil {
+		opts.Retry.Commands = []int{QUERY, CREATE}
+	}
+	c := &Client{
+		network: network,
+		host:    host,
+		port:    port,
+		opts:    opts,
+		pending: make(map[uint32]*Call),
+	}
+	ctx, cancel := c.withTimeout(context.Background())
+	defer cancel()
+	if err := c.dial(ctx); err != nil {
 		return nil, err
 	}
+	return c, nil
+}
+
+// withTimeout bounds a context with the Timeout of the client, unless it's
+// already got a deadline
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || c.opts.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.opts.Timeout)
+}
+
+// dial opens a new connection and negotiates its protocol version, with V2
+// servers or later a new reader serves the responses coming on it
+func (c *Client) dial(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.host+":"+c.port)
+	if err != nil {
+		return err
+	}
 	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	return &Client{host, port, conn, rw}, nil
+	stop := watchDeadline(ctx, conn.SetDeadline)
+	version, err := hello(conn, rw)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ierr := interrupted(ctx, err); ierr != nil {
+			return ierr
+		}
+		return err
+	}
+	c.wmu.Lock()
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		c.wmu.Unlock()
+		conn.Close()
+		return ClientClosedErr
+	}
+	c.conn, c.rw, c.version, c.err = conn, rw, version, nil
+	c.mu.Unlock()
+	c.wmu.Unlock()
+	if version >= protocol.V2 {
+		go c.readResponses(conn, rw, version)
+	}
+	return nil
+}
+
+// hello negotiates the protocol version with the server, older servers
+// answer with an UNKNOWNCMD ACK, in that case the client sticks to V1
+func hello(conn net.Conn, r io.Reader) (byte, error) {
+	data, err := protocol.NewResponse(protocol.HELLO, protocol.OK,
+		&protocol.HelloPacket{Version: protocol.VERSION}).MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(data); err != nil {
+		return 0, err
+	}
+	header, payload, err := readResponse(r, protocol.V1)
+	if err != nil {
+		return 0, err
+	}
+	if header.Opcode() != protocol.HELLO {
+		return protocol.V1, nil
+	}
+	hello := protocol.HelloPacket{}
+	if err := hello.UnmarshalBinary(payload); err != nil {
+		return 0, err
+	}
+	return hello.Version, nil
+}
+
+// watchDeadline bounds the I/O on a connection by the deadline of ctx, set
+// by set, interrupting it as soon as ctx is done. The returned function lifts
+// the bound, it must be called once the I/O is over.
+func watchDeadline(ctx context.Context, set func(time.Time) error) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		set(deadline)
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			// A deadline in the past fails the I/O in progress
+			set(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		set(time.Time{})
+	}
 }
 
+// interrupted returns the error of ctx if it caused the I/O error err, nil
+// otherwise, I/O may time out slightly before ctx expires
+func interrupted(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if _, ok := ctx.Deadline(); ok {
+			return context.DeadlineExceeded
+		}
+	}
+	return nil
+}
+
+// sleep waits for d, returning early with its error if ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reconnect reestablishes the connection if it was lost, making up to
+// ReconnectAttempts attempts spaced by the backoff
+func (c *Client) reconnect(ctx context.Context) error {
+	c.dialMu.Lock()
+	defer c.dialMu.Unlock()
+	c.mu.Lock()
+	closing, err := c.closing, c.err
+	c.mu.Unlock()
+	if closing {
+		return ClientClosedErr
+	}
+	// Another request may have reconnected meanwhile
+	if err == nil || c.opts.ReconnectAttempts < 0 {
+		return err
+	}
+	for attempt := 0; attempt < c.opts.ReconnectAttempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.backoff(attempt-1)); err != nil {
+				return err
+			}
+		}
+		c.mu.Lock()
+		closing := c.closing
+		c.mu.Unlock()
+		if closing {
+			return ClientClosedErr
+		}
+		var dialErr error
+		if dialErr = c.dial(ctx); dialErr == nil {
+			c.notify(StateConnected, nil)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = fmt.Errorf("%w: %v", ConnectionLostErr, dialErr)
+	}
+	return err
+}
+
+// backoff returns the time to wait before the next attempt, doubling at
+// each attempt up to MaxBackoff, randomly shortened by up to a half so that
+// clients don't retry in lockstep
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.opts.MaxBackoff
+	if attempt < 32 && c.opts.InitialBackoff<<uint(attempt) < d {
+		d = c.opts.InitialBackoff << uint(attempt)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// notify calls the OnStateChange hook, if set
+func (c *Client) notify(state ConnState, err error) {
+	if c.opts.OnStateChange != nil {
+		c.opts.OnStateChange(state, err)
+	}
+}
+
+// readResponse reads a whole response, header and payload, framed with the
+// given protocol version
+func readResponse(r io.Reader, version byte) (*protocol.Header, []byte, error) {
+	buf := make([]byte, protocol.HeaderLen(version))
+	if _, err := io.ReadAtLeast(r, buf, len(buf)); err != nil {
+		return nil, nil, err
+	}
+	header := &protocol.Header{Version: version}
+	if err := header.UnmarshalBinary(buf); err != nil {
+		return nil, nil, err
+	}
+	payload := make([]byte, header.Len())
+	if _, err := io.ReadAtLeast(r, payload, len(payload)); err != nil {
+		return nil, nil, err
+	}
+	return header, payload, nil
+}
+
+// readResponses reads the responses coming on a connection and completes the
+// matching calls, when the connection fails all the pending calls fail with
+// it
+func (c *Client) readResponses(conn net.Conn, r io.Reader, version byte) {
+	var err error
+	for err == nil {
+		var header *protocol.Header
+		var payload []byte
+		header, payload, err = readResponse(r, version)
+		if err != nil {
+			break
+		}
+		c.mu.Lock()
+		call := c.pending[header.ID]
+		delete(c.pending, header.ID)
+		c.mu.Unlock()
+		if call == nil {
+			continue
+		}
+		call.Response, call.Error = decodeResponse(call.Command, header, payload)
+		call.done()
+	}
+	conn.Close()
+	c.mu.Lock()
+	closing := c.closing
+	if closing {
+		err = ClientClosedErr
+	} else {
+		err = fmt.Errorf("%w: %v", ConnectionLostErr, err)
+	}
+	c.err = err
+	for id, call := range c.pending {
+		delete(c.pending, id)
+		call.Error = err
+		call.done()
+	}
+	c.mu.Unlock()
+	if !closing {
+		c.notify(StateDisconnected, err)
+	}
+}
+
+// SendCommand sends a command and waits for its response
 func (c *Client) SendCommand(cmdString string) (*TpResponse, error) {
+	return c.SendCommandContext(context.Background(), cmdString)
+}
+
+// SendCommandContext sends a command and waits for its response, giving up
+// when ctx is done. The connection can't be trusted after a request is
+// interrupted while being written or, with V1 servers, while its response is
+// being read, so it's closed and the next request reconnects.
+func (c *Client) SendCommandContext(ctx context.Context, cmdString string) (*TpResponse, error) {
 	parser := NewParser(cmdString)
 	command, err := parser.Parse()
 	if err != nil {
 		return nil, err
 	}
-	header := protocol.Header{}
-	header.SetOpcode(uint8(command.Type))
+	return c.exec(ctx, command)
+}
+
+// Go sends a command without waiting for its response, the returned Call is
+// sent on done once completed. If done is nil a new channel is allocated,
+// otherwise it must be buffered and many calls can share it. With an
+// unbuffered one the command isn't sent and the Call, failed with
+// UnbufferedDoneErr, is completed on a channel of its own. Commands retried,
+// or bounded by the Timeout of the client, are sent in background, so they
+// may be written out of the order of the calls.
+func (c *Client) Go(cmdString string, done chan *Call) *Call {
+	if done != nil && cap(done) == 0 {
+		call := &Call{Done: make(chan *Call, 1), Error: UnbufferedDoneErr}
+		call.done()
+		return call
+	}
+	if done == nil {
+		done = make(chan *Call, 1)
+	}
+	call := &Call{Done: done}
+	parser := NewParser(cmdString)
+	command, err := parser.Parse()
+	if err != nil {
+		call.Error = err
+		call.done()
+		return call
+	}
+	call.Command = command
+	if c.retriable(command) || c.opts.Timeout > 0 {
+		go func() {
+			call.Response, call.Error = c.exec(context.Background(), command)
+			call.done()
+		}()
+	} else {
+		c.send(context.Background(), call)
+	}
+	return call
+}
+
+// retriable tells if the retry policy applies to a command
+func (c *Client) retriable(command Command) bool {
+	if c.opts.Retry.MaxAttempts <= 1 {
+		return false
+	}
+	for _, t := range c.opts.Retry.Commands {
+		if t == command.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// exec sends a command and waits for its response until ctx is done, the
+// command is sent again on a new connection as long as the retry policy
+// allows it
+func (c *Client) exec(ctx context.Context, command Command) (*TpResponse, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	attempts := 1
+	if c.retriable(command) {
+		attempts = c.opts.Retry.MaxAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		call := &Call{Command: command, Done: make(chan *Call, 1)}
+		c.send(ctx, call)
+		select {
+		case <-call.Done:
+		case <-ctx.Done():
+			if !c.abandon(call) {
+				// Completed meanwhile
+				<-call.Done
+				break
+			}
+			return nil, ctx.Err()
+		}
+		if call.Error == nil && attempt > 1 && command.Type == CREATE &&
+			call.Response.Header.Status() == protocol.TSEXISTS {
+			// The series may have been created by a lost attempt
+			call.Response.Header.SetStatus(protocol.OK)
+		}
+		if call.Error == nil || !errors.Is(call.Error, ConnectionLostErr) ||
+			attempt >= attempts {
+			return call.Response, call.Error
+		}
+		if err := sleep(ctx, c.backoff(attempt-1)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// abandon stops waiting for the response of a pending call, returning false
+// if it's already been completed
+func (c *Client) abandon(call *Call) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[call.id] != call {
+		return false
+	}
+	delete(c.pending, call.id)
+	return true
+}
+
+// send writes the request of a call, which is completed once its response is
+// read. I/O is bounded by ctx, but with V2 servers the response is waited for
+// by the caller.
+func (c *Client) send(ctx context.Context, call *Call) {
+	if err := c.reconnect(ctx); err != nil {
+		call.Error = err
+		call.done()
+		return
+	}
+	payload, err := newPayload(call.Command)
+	if err != nil {
+		call.Error = err
+		call.done()
+		return
+	}
+	request := protocol.NewResponse(uint8(call.Command.Type), protocol.OK, payload)
+	c.mu.Lock()
+	if c.closing || c.err != nil {
+		call.Error = c.err
+		if c.closing {
+			call.Error = ClientClosedErr
+		}
+		c.mu.Unlock()
+		call.done()
+		return
+	}
+	// The request is written on the connection it's registered for, even
+	// if a new one replaces it meanwhile
+	conn, version := c.conn, c.version
+	request.Header.Version = version
+	if version < protocol.V2 {
+		c.mu.Unlock()
+		c.wmu.Lock()
+		call.Response, call.Error = c.roundTrip(ctx, conn, call.Command, request)
+		c.wmu.Unlock()
+		call.done()
+		return
+	}
+	c.nextID++
+	id := c.nextID
+	request.Header.ID = id
+	data, err := request.MarshalBinary()
+	if err != nil {
+		c.mu.Unlock()
+		call.Error = err
+		call.done()
+		return
+	}
+	call.id = id
+	c.pending[id] = call
+	c.mu.Unlock()
+	c.wmu.Lock()
+	stop := watchDeadline(ctx, conn.SetWriteDeadline)
+	_, err = conn.Write(data)
+	stop()
+	c.wmu.Unlock()
+	if err != nil {
+		// Closing the connection makes the reader fail the pending
+		// calls, it may have already failed this one
+		conn.Close()
+		c.mu.Lock()
+		call = c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if call != nil {
+			if call.Error = interrupted(ctx, err); call.Error == nil {
+				call.Error = fmt.Errorf("%w: %v", ConnectionLostErr, err)
+			}
+			call.done()
+		}
+	}
+}
+
+// roundTrip sends a request and reads its response, used with V1 servers,
+// must be called holding wmu
+func (c *Client) roundTrip(ctx context.Context, conn net.Conn, command Command, request *protocol.Response) (*TpResponse, error) {
+	data, err := request.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if conn != c.conn {
+		return nil, ConnectionLostErr
+	}
+	stop := watchDeadline(ctx, conn.SetDeadline)
+	defer stop()
+	if _, err := conn.Write(data); err != nil {
+		return nil, c.fail(ctx, conn, err)
+	}
+	header, payload, err := readResponse(c.rw, protocol.V1)
+	if err != nil {
+		return nil, c.fail(ctx, conn, err)
+	}
+	return decodeResponse(command, header, payload)
+}
+
+// fail closes a broken connection, used with V1 servers where no reader
+// notices it, the next request reconnects. Requests interrupted by ctx fail
+// with its error.
+func (c *Client) fail(ctx context.Context, conn net.Conn, err error) error {
+	conn.Close()
+	ierr := interrupted(ctx, err)
+	c.mu.Lock()
+	closing := c.closing
+	if closing {
+		err = ClientClosedErr
+	} else {
+		err = fmt.Errorf("%w: %v", ConnectionLostErr, err)
+		if c.err == nil {
+			c.err = err
+		}
+	}
+	c.mu.Unlock()
+	if closing {
+		return err
+	}
+	c.notify(StateDisconnected, err)
+	if ierr != nil {
+		return ierr
+	}
+	return err
+}
+
+// Healthy reports whether the connection is still usable, a client whose
+// connection failed or got closed must be replaced by a new one. Nothing is
+// sent to the server, V1 connections only fail once a request does, Ping
+// probes the connection.
+func (c *Client) Healthy() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.closing && c.err == nil
+}
+
+// newPayload builds the packet carrying a command, nil if the command has
+// no payload
+func newPayload(command Command) (encoding.BinaryMarshaler, error) {
 	var payload encoding.BinaryMarshaler
 	switch command.Type {
 	case CREATE:
-		packet := protocol.CreatePacket{}
-		packet.Name = command.TimeSeries.Name
-		packet.Retention = command.TimeSeries.Retention
-		payload = &packet
+		packet, err := protocol.NewCreatePacket(command.TimeSeries.Name,
+			command.TimeSeries.Retention)
+		if err != nil {
+			return nil, err
+		}
+		packet.Duplicates = command.Duplicates
+		payload = packet
 	case DELETE:
 		packet := protocol.DeletePacket{}
 		packet.Name = command.TimeSeries.Name
 		payload = &packet
+	case DELETERANGE:
+		packet := protocol.DeleteRangePacket{}
+		packet.Name = command.TimeSeries.Name
+		packet.Start = command.Range.start
+		packet.End = command.Range.end
+		payload = &packet
 	case ADD:
 		packet := protocol.AddPointPacket{}
 		packet.Name = command.TimeSeries.Name
 		packet.HaveTimestamp = command.Timestamp != 0
+		packet.Timestamp = command.Timestamp
 		packet.Value = command.Value
 		payload = &packet
+	case MADD:
+		packet := protocol.MultiAddPointPacket{}
+		for _, p := range command.Points {
+			packet.Add(p.Name, p.Timestamp, p.Value)
+		}
+		payload = &packet
 	case QUERY:
 		packet := protocol.QueryPacket{}
 		packet.Name = command.TimeSeries.Name
@@ -88,49 +731,61 @@ func (c *Client) SendCommand(cmdString string) (*TpResponse, error) {
 		packet.Range[0] = command.Range.start
 		packet.Range[1] = command.Range.end
 		packet.Avg = command.Avg
+		packet.Aggregation = command.Aggregation
+		packet.Interval = command.Interval
+		packet.Quantile = command.Quantile
+		packet.Fill = command.Fill
+		packet.FillValue = command.FillValue
 		payload = &packet
-		// TODO
-	}
-	payloadBytes, err := payload.MarshalBinary()
-	if err != nil {
-		return nil, err
-	}
-	header.Size = uint64(len(payloadBytes))
-	headerBytes, err := header.MarshalBinary()
-	if err != nil {
-		return nil, err
-	}
-	packetBytes := append(headerBytes, payloadBytes...)
-	_, err = c.conn.Write(packetBytes)
-	if err != nil {
-		return nil, err
-	}
-	buf := make([]byte, 9)
-	if _, err := io.ReadAtLeast(c.rw, buf, 9); err != nil {
-		return nil, err
-	}
-	responseHeader := protocol.Header{}
-	if err := responseHeader.UnmarshalBinary(buf); err != nil {
-		return nil, err
+	case LIST:
+		payload = &protocol.ListPacket{Pattern: command.Pattern}
+	case INFO:
+		payload = &protocol.InfoPacket{Name: command.TimeSeries.Name}
 	}
+	return payload, nil
+}
+
+func decodeResponse(command Command, header *protocol.Header, payload []byte) (*TpResponse, error) {
 	r := &TpResponse{}
 	r.Command = command
-	r.Header = responseHeader
-	if responseHeader.Opcode() == protocol.ACK {
+	r.Header = *header
+	if header.Opcode() == protocol.ACK || header.Len() == 0 {
 		return r, nil
 	}
-	payloadBuf := make([]byte, responseHeader.Len())
-	if _, err := io.ReadAtLeast(c.rw, payloadBuf, len(payloadBuf)); err != nil {
-		return nil, err
+	var err error
+	switch header.Opcode() {
+	case protocol.ERRORRESPONSE:
+		e := &protocol.ErrorPacket{}
+		if err := e.UnmarshalBinary(payload); err != nil {
+			return nil, err
+		}
+		return nil, e
+	case protocol.MADDPOINTRESPONSE:
+		err = r.MultiAdd.UnmarshalBinary(payload)
+	case protocol.MULTIQUERYRESPONSE:
+		err = r.Multi.UnmarshalBinary(payload)
+	case protocol.LIST:
+		err = r.List.UnmarshalBinary(payload)
+	case protocol.INFO:
+		err = r.Info.UnmarshalBinary(payload)
+	case protocol.DELETERANGE:
+		err = r.Deleted.UnmarshalBinary(payload)
+	default:
+		err = r.Payload.UnmarshalBinary(payload)
 	}
-	if err := r.Payload.UnmarshalBinary(payloadBuf); err != nil {
+	if err != nil {
 		return nil, err
 	}
 	return r, nil
 }
 
 func (c *Client) Close() {
-	c.conn.Close()
+	c.mu.Lock()
+	c.closing = true
+	conn := c.conn
+	c.mu.Unlock()
+	conn.Close()
+	c.notify(StateClosed, nil)
 }
 
 func (r TpResponse) String() string {
@@ -142,12 +797,32 @@ func (r TpResponse) String() string {
 			fallthrough
 		case protocol.TSNOTFOUND:
 			response += fmt.Sprintf(": %s", r.Command.TimeSeries.Name)
+		case protocol.OK:
+			if r.Command.Type == CREATE {
+				response += fmt.Sprintf(" - name: %s, retention: %v",
+					r.Command.TimeSeries.Name, time.Duration(r.Command.TimeSeries.Retention))
+			}
+		}
+	} else if r.Header.Opcode() == protocol.MADDPOINTRESPONSE {
+		names := r.Command.seriesNames()
+		for i, status := range r.MultiAdd.Statuses {
+			if i > 0 {
+				response += "\n"
+			}
+			response += fmt.Sprintf("%s %s", names[i], protocol.StatusString(uint16(status)))
 		}
+	} else if r.Header.Opcode() == protocol.MULTIQUERYRESPONSE {
+		response = "\n" + r.Multi.String()
+	} else if r.Header.Opcode() == protocol.LIST {
+		response = r.List.String()
+	} else if r.Header.Opcode() == protocol.INFO {
+		response = r.Info.String()
+	} else if r.Header.Opcode() == protocol.DELETERANGE {
+		response = r.Deleted.String()
 	} else {
 		if len(r.Payload.Records) > 0 {
 			response = "\n"
-			response += fmt.Sprintf("name: %s\nretention: %d\n",
-				r.Command.TimeSeries.Name, r.Command.TimeSeries.Retention)
+			response += fmt.Sprintf("name: %s\n", r.Command.TimeSeries.Name)
 			response += "timestamp\t\tvalue\n"
 			response += "---------\t\t-----\n"
 		}
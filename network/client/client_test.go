@@ -0,0 +1,576 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/codepr/timepipe/network"
+	"github.com/codepr/timepipe/network/protocol"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func startTestServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := network.NewServer("tcp", "127.0.0.1", "0")
+	go s.Serve(l)
+	return l
+}
+
+func dialTestServer(t *testing.T, l net.Listener) *Client {
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	c, err := NewTimepipeClient("tcp", host, port)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	return c
+}
+
+func TestClientPipelining(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	if c.version != protocol.VERSION {
+		t.Fatalf("Expected version %v got %v", protocol.VERSION, c.version)
+	}
+	const n = 300
+	done := make(chan *Call, 2*n)
+	for i := 0; i < n; i++ {
+		c.Go(fmt.Sprintf("CREATE s%d", i), done)
+		c.Go(fmt.Sprintf("ADD s%d * %d", i, i), done)
+	}
+	for i := 0; i < 2*n; i++ {
+		call := <-done
+		if call.Error != nil {
+			t.Fatalf("Failed to send %v: %v", call.Command.Type, call.Error)
+		}
+	}
+	// Only the first n series already exist, statuses must match the
+	// commands they answer
+	for i := 0; i < 2*n; i++ {
+		c.Go(fmt.Sprintf("CREATE s%d", i), done)
+	}
+	for i := 0; i < 2*n; i++ {
+		call := <-done
+		var expected uint16 = protocol.OK
+		var j int
+		if fmt.Sscanf(call.Command.TimeSeries.Name, "s%d", &j); j < n {
+			expected = protocol.TSEXISTS
+		}
+		if status := call.Response.Header.Status(); status != expected {
+			t.Errorf("Expected status %v for %s got %v",
+				expected, call.Command.TimeSeries.Name, status)
+		}
+	}
+}
+
+func TestClientPipeliningQueries(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	const n = 200
+	for i := 0; i < n; i++ {
+		c.SendCommand(fmt.Sprintf("CREATE s%d", i))
+		c.SendCommand(fmt.Sprintf("ADD s%d * %d", i, i))
+	}
+	// Writes are applied asynchronously, wait for the last one
+	for i := 0; i < 100; i++ {
+		r, err := c.SendCommand(fmt.Sprintf("QUERY s%d *", n-1))
+		if err == nil && len(r.Payload.Records) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	calls := make([]*Call, n)
+	for i := 0; i < n; i++ {
+		calls[i] = c.Go(fmt.Sprintf("QUERY s%d *", i), nil)
+	}
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			t.Fatalf("Failed to query s%d: %v", i, call.Error)
+		}
+		records := call.Response.Payload.Records
+		if len(records) != 1 || records[0].Value != float64(i) {
+			t.Errorf("Expected a single record %d for s%d got %v", i, i, records)
+		}
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	c.Close()
+	if _, err := c.SendCommand("CREATE s1"); err == nil {
+		t.Errorf("Expected an error sending on a closed client")
+	}
+}
+
+// TestClientV1Server checks that the client falls back to V1 with servers
+// not knowing HELLO
+func TestClientV1Server(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			buf := make([]byte, protocol.HEADERV1LEN)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return
+			}
+			header := protocol.Header{}
+			header.UnmarshalBinary(buf)
+			io.CopyN(ioutil.Discard, conn, int64(header.Len()))
+			status := protocol.OK
+			if header.Opcode() == protocol.HELLO {
+				status = protocol.UNKNOWNCMD
+			}
+			data, _ := protocol.NewAckResponse(uint16(status)).MarshalBinary()
+			conn.Write(data)
+		}
+	}()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	if c.version != protocol.V1 {
+		t.Errorf("Expected version %v got %v", protocol.V1, c.version)
+	}
+	r, err := c.SendCommand("CREATE s1")
+	if err != nil || r.Header.Status() != protocol.OK {
+		t.Errorf("Failed to send a command to a V1 server: %v", err)
+	}
+}
+
+func TestClientLabelSelectors(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	commands := []string{
+		`CREATE cpu{host="a",region="eu-west"}`,
+		`CREATE cpu{region="eu-south",host="b"}`,
+		`CREATE cpu{host="c",region="us-east"}`,
+		`ADD cpu{region="eu-west",host="a"} 1000 1`,
+		`ADD cpu{host="b",region="eu-south"} 1000 2`,
+		`ADD cpu{host="c",region="us-east"} 1000 3`,
+	}
+	for _, cmd := range commands {
+		if r, err := c.SendCommand(cmd); err != nil || r.Header.Status() > protocol.ACCEPTED {
+			t.Fatalf("Failed to send %s: %v %v", cmd, err, r)
+		}
+	}
+	r, err := c.SendCommand(`CREATE cpu{region="eu-west", host="a"}`)
+	if err != nil || r.Header.Status() != protocol.TSEXISTS {
+		t.Errorf("Expected labels in any order to identify the same series")
+	}
+	var multi protocol.MultiQueryResponsePacket
+	for i := 0; i < 100; i++ {
+		r, err := c.SendCommand(`QUERY cpu{region=~"eu-.*"} *`)
+		if err != nil || r.Header.Opcode() != protocol.MULTIQUERYRESPONSE {
+			t.Fatalf("Failed to query selector: %v %v", err, r)
+		}
+		multi = r.Multi
+		if len(multi.Series[0].Records) > 0 && len(multi.Series[1].Records) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(multi.Series) != 2 ||
+		multi.Series[0].Name != `cpu{host="a",region="eu-west"}` ||
+		multi.Series[1].Name != `cpu{host="b",region="eu-south"}` ||
+		multi.Series[1].Records[0].Value != 2 {
+		t.Errorf("Failed to select series, got %v", multi)
+	}
+	// A full series key still selects a single series
+	r, err = c.SendCommand(`QUERY cpu{region="us-east",host="c"} *`)
+	if err != nil || r.Header.Opcode() != protocol.QUERYRESPONSE {
+		t.Errorf("Failed to query series by key: %v %v", err, r)
+	}
+	r, err = c.SendCommand(`QUERY cpu{host="z"} *`)
+	if err != nil || r.Header.Status() != protocol.TSNOTFOUND {
+		t.Errorf("Expected TSNOTFOUND on empty selection: %v %v", err, r)
+	}
+	if _, err := c.SendCommand(`CREATE cpu{host=~"a"}`); err == nil {
+		t.Errorf("Expected an error creating a series from a selector")
+	}
+	if r, err := c.SendCommand(`DELETE cpu{region="eu-west",host="a"}`); err != nil || r.Header.Status() != protocol.OK {
+		t.Errorf("Failed to delete series by key: %v", err)
+	}
+	r, err = c.SendCommand(`QUERY cpu *`)
+	if err != nil || len(r.Multi.Series) != 2 {
+		t.Errorf("Expected deleted series to be removed from the index, got %v", r)
+	}
+}
+
+// startFlakyServer starts a V1 server answering OK to every request, except
+// for the nth requests matched by drop, which close the connection without an
+// answer, and for the CREATE requests following the first one, dropped or
+// not, answered with TSEXISTS
+func startFlakyServer(t *testing.T, drop func(int) bool) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	var requests, created int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					buf := make([]byte, protocol.HEADERV1LEN)
+					if _, err := io.ReadFull(conn, buf); err != nil {
+						return
+					}
+					header := protocol.Header{}
+					header.UnmarshalBinary(buf)
+					io.CopyN(ioutil.Discard, conn, int64(header.Len()))
+					status := protocol.OK
+					if header.Opcode() == protocol.HELLO {
+						status = protocol.UNKNOWNCMD
+					} else if header.Opcode() == protocol.CREATE &&
+						atomic.SwapInt32(&created, 1) == 1 {
+						status = protocol.TSEXISTS
+					}
+					if header.Opcode() != protocol.HELLO && drop(int(atomic.AddInt32(&requests, 1)-1)) {
+						return
+					}
+					data, _ := protocol.NewAckResponse(uint16(status)).MarshalBinary()
+					conn.Write(data)
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestClientRetry(t *testing.T) {
+	// Every other request is dropped
+	l := startFlakyServer(t, func(n int) bool { return n%2 == 0 })
+	defer l.Close()
+	var mu sync.Mutex
+	states := []ConnState{}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	c, err := NewTimepipeClientWithOptions("tcp", host, port, ClientOptions{
+		InitialBackoff: time.Millisecond,
+		OnStateChange: func(state ConnState, err error) {
+			mu.Lock()
+			states = append(states, state)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	// Queries are retried on a new connection
+	if r, err := c.SendCommand("QUERY s1 *"); err != nil || r.Header.Status() != protocol.OK {
+		t.Errorf("Expected QUERY to be retried, got %v", err)
+	}
+	// Writes aren't, the next request reconnects
+	if _, err := c.SendCommand("ADD s1 * 1"); !errors.Is(err, ConnectionLostErr) {
+		t.Errorf("Expected ConnectionLostErr got %v", err)
+	}
+	if r, err := c.SendCommand("ADD s1 * 1"); err != nil || r.Header.Status() != protocol.OK {
+		t.Errorf("Failed to send after reconnecting: %v", err)
+	}
+	c.Close()
+	expected := []ConnState{StateDisconnected, StateConnected, StateDisconnected,
+		StateConnected, StateClosed}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(states, expected) {
+		t.Errorf("Expected states %v got %v", expected, states)
+	}
+}
+
+func TestClientRetryCreate(t *testing.T) {
+	// The first CREATE is applied but its answer is lost
+	l := startFlakyServer(t, func(n int) bool { return n == 0 })
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	c, err := NewTimepipeClientWithOptions("tcp", host, port, ClientOptions{
+		InitialBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+	if r, err := c.SendCommand("CREATE s1"); err != nil || r.Header.Status() != protocol.OK {
+		t.Errorf("Expected the retried CREATE to succeed, got %v (%v)", r, err)
+	}
+	if r, err := c.SendCommand("CREATE s1"); err != nil || r.Header.Status() != protocol.TSEXISTS {
+		t.Errorf("Expected TSEXISTS got %v (%v)", r, err)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	if _, err := c.SendCommand("CREATE s1"); err != nil {
+		t.Fatalf("Failed to create timeseries: %v", err)
+	}
+	// The connection drops, the reader notices it
+	c.mu.Lock()
+	c.conn.Close()
+	c.mu.Unlock()
+	for c.Healthy() {
+		time.Sleep(time.Millisecond)
+	}
+	r, err := c.SendCommand("ADD s1 * 1")
+	if err != nil || r.Header.Status() != protocol.ACCEPTED {
+		t.Errorf("Failed to send after reconnecting: %v", err)
+	}
+}
+
+func TestClientReconnectFailure(t *testing.T) {
+	l := startFlakyServer(t, func(int) bool { return true })
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	c, err := NewTimepipeClientWithOptions("tcp", host, port, ClientOptions{
+		ReconnectAttempts: 2,
+		InitialBackoff:    time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+	// The server goes away for good
+	l.Close()
+	if _, err := c.SendCommand("ADD s1 * 1"); !errors.Is(err, ConnectionLostErr) {
+		t.Errorf("Expected ConnectionLostErr got %v", err)
+	}
+	if _, err := c.SendCommand("QUERY s1 *"); !errors.Is(err, ConnectionLostErr) {
+		t.Errorf("Expected ConnectionLostErr got %v", err)
+	}
+}
+
+func TestClientBackoff(t *testing.T) {
+	c := &Client{opts: ClientOptions{InitialBackoff: 100, MaxBackoff: 1000}}
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if d := c.backoff(attempt); d < max/2 || d > max {
+			t.Errorf("Expected backoff of attempt %v in [%v, %v] got %v", attempt, max/2, max, d)
+		}
+	}
+	if d := c.backoff(100); d < 500 || d > 1000 {
+		t.Errorf("Expected backoff capped to 1000 got %v", d)
+	}
+}
+
+// startStalledServer starts a server negotiating the given protocol version
+// and then never answering, with version 0 it doesn't even answer the HELLO
+func startStalledServer(t *testing.T, version byte) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, protocol.HEADERV1LEN)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				header := protocol.Header{}
+				header.UnmarshalBinary(buf)
+				io.CopyN(ioutil.Discard, conn, int64(header.Len()))
+				var response *protocol.Response
+				switch version {
+				case protocol.V1:
+					response = protocol.NewAckResponse(protocol.UNKNOWNCMD)
+				case protocol.V2:
+					response = protocol.NewResponse(protocol.HELLO, protocol.OK,
+						&protocol.HelloPacket{Version: protocol.V2})
+				}
+				if response != nil {
+					data, _ := response.MarshalBinary()
+					conn.Write(data)
+				}
+				io.Copy(ioutil.Discard, conn)
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestClientContext(t *testing.T) {
+	for _, version := range []byte{protocol.V1, protocol.V2} {
+		l := startStalledServer(t, version)
+		c := dialTestServer(t, l)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		if _, err := c.QueryContext(ctx, QueryOptions{Name: "s1"}); err != context.DeadlineExceeded {
+			t.Errorf("V%v: expected DeadlineExceeded got %v", version, err)
+		}
+		cancel()
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("V%v: expected the query to give up after 50ms, took %v", version, elapsed)
+		}
+		ctx, cancel = context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		if _, err := c.SendCommandContext(ctx, "ADD s1 * 1"); err != context.Canceled {
+			t.Errorf("V%v: expected Canceled got %v", version, err)
+		}
+		c.mu.Lock()
+		if len(c.pending) > 0 {
+			t.Errorf("V%v: expected no pending calls got %v", version, len(c.pending))
+		}
+		c.mu.Unlock()
+		c.Close()
+		l.Close()
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	// The handshake stalls
+	l := startStalledServer(t, 0)
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	opts := ClientOptions{Timeout: 50 * time.Millisecond}
+	if _, err := NewTimepipeClientWithOptions("tcp", host, port, opts); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded got %v", err)
+	}
+	// The requests stall
+	l = startStalledServer(t, protocol.V2)
+	defer l.Close()
+	host, port, _ = net.SplitHostPort(l.Addr().String())
+	c, err := NewTimepipeClientWithOptions("tcp", host, port, opts)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+	if err := c.Create("s1", 0); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded got %v", err)
+	}
+	call := <-c.Go("ADD s1 * 1", nil).Done
+	if call.Error != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded got %v", call.Error)
+	}
+	// Requests with a deadline of their own aren't bounded by the client
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	c.SendCommandContext(ctx, "ADD s1 * 1")
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected the request to wait for its own deadline, took %v", elapsed)
+	}
+}
+
+func TestClientGoUnbufferedDone(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	call := c.Go("CREATE s1", make(chan *Call))
+	if call.Error != UnbufferedDoneErr {
+		t.Errorf("Expected UnbufferedDoneErr got %v", call.Error)
+	}
+	if completed := <-call.Done; completed != call {
+		t.Errorf("Expected the failed call to be completed")
+	}
+	// The command is never sent
+	if r, err := c.SendCommand("CREATE s1"); err != nil || r.Header.Status() != protocol.OK {
+		t.Errorf("Expected CREATE to succeed, got %v", err)
+	}
+}
+
+func TestClientDeleteRange(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	c.SendCommand("CREATE s1")
+	for _, timestamp := range []string{"1000", "2000", "3000"} {
+		if _, err := c.SendCommand("ADD s1 " + timestamp + " 1"); err != nil {
+			t.Fatalf("Failed to add record: %v", err)
+		}
+	}
+	r, err := c.SendCommand("DELETE s1 RANGE 1000 2000")
+	if err != nil {
+		t.Fatalf("Failed to delete range: %v", err)
+	}
+	if r.Deleted.Deleted != 2 || r.String() != "(ok) - 2 records deleted" {
+		t.Errorf("Expected 2 records deleted got %q", r)
+	}
+}
+
+func TestClientResponseRetention(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	c := dialTestServer(t, l)
+	defer c.Close()
+	r, err := c.SendCommand("CREATE s1 1h")
+	if err != nil || r.String() != "(ok) - name: s1, retention: 1h0m0s" {
+		t.Fatalf("Expected CREATE to print the retention got %q (%v)", r, err)
+	}
+	if _, err := c.SendCommand("ADD s1 1000 1"); err != nil {
+		t.Fatalf("Failed to add record: %v", err)
+	}
+	// Queries don't carry the retention of the series
+	r, err = c.SendCommand("QUERY s1 *")
+	if err != nil || strings.Contains(r.String(), "retention") {
+		t.Errorf("Expected QUERY not to print a retention got %q (%v)", r, err)
+	}
+	r, err = c.SendCommand("INFO s1")
+	if err != nil || !strings.Contains(r.String(), "retention: 1h0m0s") {
+		t.Errorf("Expected INFO to print the retention got %q (%v)", r, err)
+	}
+}
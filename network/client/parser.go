@@ -28,9 +28,14 @@ package client
 
 import (
 	"errors"
+	"fmt"
 	"github.com/codepr/timepipe/network/protocol"
+	series "github.com/codepr/timepipe/timeseries"
+	"math"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 const (
@@ -39,6 +44,12 @@ const (
 	ADD
 	MADD
 	QUERY
+	// Command types are used as opcodes, commands added after QUERY must
+	// take the value of the corresponding opcode
+	SNAPSHOT    = protocol.SNAPSHOT
+	DELETERANGE = protocol.DELETERANGE
+	LIST        = protocol.LIST
+	INFO        = protocol.INFO
 )
 
 var (
@@ -48,6 +59,8 @@ var (
 	MissingTimeSeriesNameErr = errors.New("missing timeseries name")
 	MissingValueErr          = errors.New("missing value")
 	MissingTimeStampErr      = errors.New("missing timestamp or aggregation rule, which can be:\n - RANGE upper lower\n - > timestamp-value \n - < timestamp-value\n - * for selecting all records")
+	InvalidTimestampErr      = errors.New("invalid timestamp, expected an integer, an RFC3339 date or now[+|-duration]")
+	InvalidDurationErr       = errors.New("invalid duration, expected milliseconds or a sequence of integers with a unit among ns, us, ms, s, m, h, d and w, e.g. 1h30m")
 )
 
 type timerange struct {
@@ -59,27 +72,100 @@ type timeseries struct {
 	Retention int64
 }
 
+// Point is a record of a timeseries, a 0 timestamp is replaced by the server
+// with the time of arrival
+type Point struct {
+	Name      string
+	Timestamp int64
+	Value     float64
+}
+
 type Command struct {
-	Type       int
-	TimeSeries timeseries
-	Timestamp  int64
-	Value      float64
-	Range      timerange
-	Flag       byte
-	Avg        int64
+	Type        int
+	TimeSeries  timeseries
+	Duplicates  series.DuplicatePolicy
+	Timestamp   int64
+	Value       float64
+	Range       timerange
+	Flag        byte
+	Avg         int64
+	Aggregation series.Aggregation
+	Interval    int64
+	Quantile    float64
+	Fill        series.FillPolicy
+	FillValue   float64
+	Points      []Point
+	Pattern     string
+}
+
+// seriesNames returns the names of the timeseries targeted by the points of
+// the command, in order of appearance
+func (c *Command) seriesNames() []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, p := range c.Points {
+		if !seen[p.Name] {
+			seen[p.Name] = true
+			names = append(names, p.Name)
+		}
+	}
+	return names
 }
 
 type parser struct {
 	tokens []string
 	index  int
+	// Time relative timestamps refer to, the same for the whole command
+	now time.Time
 }
 
 func NewParser(cmd string) parser {
-	p := parser{}
-	p.tokens = strings.Fields(cmd)
+	p := parser{now: time.Now()}
+	p.tokens = tokenize(cmd)
 	return p
 }
 
+// tokenize splits a command on white spaces, except for the ones inside the
+// braces of a selector, e.g. cpu{host="a", region=~"eu-.*"}, and inside
+// quoted label values
+func tokenize(cmd string) []string {
+	tokens := []string{}
+	var (
+		start   = -1
+		braces  = 0
+		quoted  = false
+		escaped = false
+	)
+	for i, c := range cmd {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"' && braces > 0:
+			quoted = !quoted
+		case quoted:
+		case c == '{':
+			braces++
+		case c == '}' && braces > 0:
+			braces--
+		case unicode.IsSpace(c) && braces == 0:
+			if start >= 0 {
+				tokens = append(tokens, cmd[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, cmd[start:])
+	}
+	return tokens
+}
+
 func (p *parser) peek() (string, error) {
 	if p.index >= len(p.tokens) {
 		return "", CommandEndReachedErr
@@ -114,14 +200,16 @@ func (p *parser) Parse() (Command, error) {
 		if err != nil {
 			return command, MissingTimeSeriesNameErr
 		}
-		token, err = p.pop()
-		if err != nil {
-			ts.Retention = 0
-		} else {
-			if ts.Retention, err = strconv.ParseInt(token, 10, 64); err != nil {
+		token, err = p.peek()
+		if err == nil && strings.ToUpper(token) != "DUPLICATE" {
+			p.pop()
+			if ts.Retention, err = parseInterval(token); err != nil {
 				return command, err
 			}
 		}
+		if err := parseMaybeDuplicates(p, &command); err != nil {
+			return command, err
+		}
 		command.TimeSeries = ts
 	case "DELETE":
 		command.Type = DELETE
@@ -129,6 +217,17 @@ func (p *parser) Parse() (Command, error) {
 		if err != nil {
 			return command, MissingTimeSeriesNameErr
 		}
+		// DELETE timeseries-name RANGE start end removes only the
+		// records in range
+		if token, err = p.pop(); err == nil {
+			if strings.ToUpper(token) != "RANGE" {
+				return command, UnknownCommandErr
+			}
+			command.Type = DELETERANGE
+			if command.Range, err = parseRange(p); err != nil {
+				return command, err
+			}
+		}
 		command.TimeSeries = ts
 	case "ADD":
 		command.Type = ADD
@@ -136,28 +235,29 @@ func (p *parser) Parse() (Command, error) {
 		if err != nil {
 			return command, MissingTimeSeriesNameErr
 		}
-		token, err := p.pop()
-		if err != nil {
-			return command, MissingTimeStampErr
-		}
-		if token == "*" {
-			command.Timestamp = 0
-		} else {
-			command.Timestamp, err = strconv.ParseInt(token, 10, 64)
-			if err != nil {
-				return command, err
-			}
-		}
-		token, err = p.pop()
-		if err != nil {
-			return command, MissingValueErr
-		}
-		if command.Value, err = strconv.ParseFloat(token, 64); err != nil {
+		if command.Timestamp, command.Value, err = parsePoint(p); err != nil {
 			return command, err
 		}
 		command.TimeSeries = ts
 	case "MADD":
 		command.Type = MADD
+		// A sequence of timeseries-name timestamp value triples
+		for {
+			point := Point{}
+			if point.Name, err = p.pop(); err != nil {
+				if len(command.Points) == 0 {
+					return command, MissingTimeSeriesNameErr
+				}
+				break
+			}
+			if point.Timestamp, point.Value, err = parsePoint(p); err != nil {
+				return command, err
+			}
+			command.Points = append(command.Points, point)
+		}
+		if len(command.seriesNames()) > protocol.MaxSeries {
+			return command, protocol.TooManySeriesErr
+		}
 	case "QUERY":
 		command.Type = QUERY
 		ts.Name, err = p.pop()
@@ -183,40 +283,48 @@ func (p *parser) Parse() (Command, error) {
 				if err != nil {
 					return command, MissingTimeStampErr
 				}
-				if command.Range.end, err = parseTimestamp(endTs); err != nil {
+				if command.Range.end, err = parseTimestamp(p, endTs); err != nil {
+					return command, err
+				}
+				if err := parseMaybeAggregation(p, &command); err != nil {
 					return command, err
 				}
-				parseMaybeAvg(p, &command)
 			case ">":
 				startTs, err := p.pop()
 				if err != nil {
 					return command, MissingTimeStampErr
 				}
-				if command.Range.start, err = parseTimestamp(startTs); err != nil {
+				if command.Range.start, err = parseTimestamp(p, startTs); err != nil {
 					return command, err
 				}
-				parseMaybeAvg(p, &command)
-			case "RANGE":
-				startTs, err := p.pop()
-				if err != nil {
-					return command, MissingTimeStampErr
-				}
-				endTs, err := p.pop()
-				if err != nil {
-					return command, MissingTimeStampErr
+				if err := parseMaybeAggregation(p, &command); err != nil {
+					return command, err
 				}
-				if command.Range.start, err = parseTimestamp(startTs); err != nil {
+			case "RANGE":
+				if command.Range, err = parseRange(p); err != nil {
 					return command, err
 				}
-				if command.Range.end, err = parseTimestamp(endTs); err != nil {
+				if err := parseMaybeAggregation(p, &command); err != nil {
 					return command, err
 				}
-				parseMaybeAvg(p, &command)
 			default:
 				return command, UnknownCommandErr
 			}
-		} else {
-			parseMaybeAvg(p, &command)
+		} else if err := parseMaybeAggregation(p, &command); err != nil {
+			return command, err
+		}
+		command.TimeSeries = ts
+	case "SNAPSHOT":
+		command.Type = SNAPSHOT
+	case "LIST":
+		// The glob pattern is optional, all series are listed without
+		command.Type = LIST
+		command.Pattern, _ = p.pop()
+	case "INFO":
+		command.Type = INFO
+		ts.Name, err = p.pop()
+		if err != nil {
+			return command, MissingTimeSeriesNameErr
 		}
 		command.TimeSeries = ts
 	default:
@@ -225,7 +333,93 @@ func (p *parser) Parse() (Command, error) {
 	return command, nil
 }
 
-func parseTimestamp(str string) (int64, error) {
+// parseRange parses the start and end timestamps of a range
+func parseRange(p *parser) (timerange, error) {
+	r := timerange{}
+	startTs, err := p.pop()
+	if err != nil {
+		return r, MissingTimeStampErr
+	}
+	endTs, err := p.pop()
+	if err != nil {
+		return r, MissingTimeStampErr
+	}
+	if r.start, err = parseTimestamp(p, startTs); err != nil {
+		return r, err
+	}
+	if r.end, err = parseTimestamp(p, endTs); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// parseMaybeDuplicates parses an optional duplicate policy closing a CREATE
+// command, e.g. DUPLICATE LAST
+func parseMaybeDuplicates(p *parser, c *Command) error {
+	token, err := p.pop()
+	if err != nil {
+		return nil
+	}
+	if strings.ToUpper(token) != "DUPLICATE" {
+		return UnknownCommandErr
+	}
+	if token, err = p.pop(); err != nil {
+		return series.UnknownDuplicatePolicyErr
+	}
+	c.Duplicates, err = series.ParseDuplicatePolicy(token)
+	return err
+}
+
+// parsePoint parses a timestamp, or * for the current time, followed by a
+// value
+func parsePoint(p *parser) (int64, float64, error) {
+	var timestamp int64 = 0
+	token, err := p.pop()
+	if err != nil {
+		return 0, 0, MissingTimeStampErr
+	}
+	if token != "*" {
+		if timestamp, err = strconv.ParseInt(token, 10, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	token, err = p.pop()
+	if err != nil {
+		return 0, 0, MissingValueErr
+	}
+	value, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return timestamp, value, nil
+}
+
+// parseTimestamp parses a timestamp into nanoseconds, it's either an RFC3339
+// date, now optionally followed by an offset, e.g. now-1h, or an integer,
+// taken as seconds with 10 digits, milliseconds with 13 and nanoseconds
+// otherwise
+func parseTimestamp(p *parser, str string) (int64, error) {
+	if strings.HasPrefix(strings.ToLower(str), "now") {
+		now := p.now.UnixNano()
+		offset := str[len("now"):]
+		if offset == "" {
+			return now, nil
+		}
+		d, err := parseDuration(offset[1:])
+		if err != nil {
+			return -1, err
+		}
+		switch offset[0] {
+		case '-':
+			return now - int64(d), nil
+		case '+':
+			return now + int64(d), nil
+		}
+		return -1, fmt.Errorf("%w: %q", InvalidTimestampErr, str)
+	}
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t.UnixNano(), nil
+	}
 	var mul int64 = 1
 	if len(str) == 10 {
 		mul = 1e9
@@ -234,23 +428,113 @@ func parseTimestamp(str string) (int64, error) {
 	}
 	val, err := strconv.ParseInt(str, 10, 64)
 	if err != nil {
-		return -1, err
+		return -1, fmt.Errorf("%w: %q", InvalidTimestampErr, str)
 	}
 	return val * mul, nil
 }
 
-func parseMaybeAvg(p *parser, c *Command) error {
-	avg, err := p.pop()
-	if err != nil || strings.ToUpper(avg) != "AVG" {
-		return err
+// durationUnits maps the units of a duration literal to their length
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// parseDuration parses a duration literal, a sequence of integers each one
+// followed by its unit, e.g. 5m, 1h30m or 1d
+func parseDuration(str string) (time.Duration, error) {
+	var d time.Duration
+	invalid := fmt.Errorf("%w: %q", InvalidDurationErr, str)
+	if str == "" {
+		return 0, invalid
+	}
+	for rest := str; rest != ""; {
+		i := strings.IndexFunc(rest, func(r rune) bool { return !unicode.IsDigit(r) })
+		if i <= 0 {
+			return 0, invalid
+		}
+		j := strings.IndexFunc(rest[i:], unicode.IsDigit)
+		if j < 0 {
+			j = len(rest) - i
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		unit, ok := durationUnits[rest[i:i+j]]
+		if err != nil || !ok {
+			return 0, invalid
+		}
+		if n > int64(math.MaxInt64-d)/int64(unit) {
+			return 0, invalid
+		}
+		d += time.Duration(n) * unit
+		rest = rest[i+j:]
 	}
-	c.Avg = 0
-	intervalStr, err := p.pop()
+	return d, nil
+}
+
+// parseInterval parses the length of a window or a retention, either a
+// duration literal or an integer of milliseconds, into nanoseconds
+func parseInterval(str string) (int64, error) {
+	if ms, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return ms * int64(time.Millisecond), nil
+	}
+	d, err := parseDuration(str)
+	return int64(d), err
+}
+
+// counterFunctions maps the names of the counter functions to their flags
+var counterFunctions = map[string]byte{
+	"RATE":       protocol.RATE,
+	"IRATE":      protocol.IRATE,
+	"INCREASE":   protocol.INCREASE,
+	"DERIVATIVE": protocol.DERIVATIVE,
+}
+
+// parseMaybeAggregation parses an optional aggregation or counter function
+// following the records selection of a query, e.g. SUM 1m, P99 60000 or
+// RATE 5m, with an optional interval, either a duration or milliseconds. AVG
+// is sent as the legacy average too, to be understood by older servers.
+func parseMaybeAggregation(p *parser, c *Command) error {
+	name, err := p.pop()
 	if err != nil {
-		return err
+		return nil
 	}
-	if c.Avg, err = strconv.ParseInt(intervalStr, 10, 64); err != nil {
+	if f, ok := counterFunctions[strings.ToUpper(name)]; ok {
+		c.Flag |= f << 4
+	} else if q, err := series.ParseQuantile(name); err == nil {
+		c.Aggregation, c.Quantile = series.AggQuantile, q
+	} else if c.Aggregation, err = series.ParseAggregation(name); err != nil {
 		return err
 	}
-	return nil
+	if token, err := p.peek(); err == nil && strings.ToUpper(token) != "FILL" {
+		p.pop()
+		if c.Interval, err = parseInterval(token); err != nil {
+			return err
+		}
+	}
+	if c.Aggregation == series.AggAvg {
+		c.Avg = c.Interval
+	}
+	return parseMaybeFill(p, c)
+}
+
+// parseMaybeFill parses an optional FILL policy of a windowed query, e.g.
+// FILL LINEAR or FILL 0
+func parseMaybeFill(p *parser, c *Command) error {
+	token, err := p.pop()
+	if err != nil {
+		return nil
+	}
+	if strings.ToUpper(token) != "FILL" {
+		return UnknownCommandErr
+	}
+	if token, err = p.pop(); err != nil {
+		return series.UnknownFillErr
+	}
+	c.Fill, c.FillValue, err = series.ParseFill(token)
+	return err
 }
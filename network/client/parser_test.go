@@ -27,7 +27,12 @@
 package client
 
 import (
+	"errors"
+	"github.com/codepr/timepipe/network/protocol"
+	series "github.com/codepr/timepipe/timeseries"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -49,12 +54,26 @@ func TestParseCreateWithNoRetention(t *testing.T) {
 	if err != nil {
 		t.Errorf("Failed to parse CREATE query")
 	}
-	expected := Command{CREATE, timeseries{"ts-test", 0}, 0, 0, timerange{}, 0, -1}
-	if command != expected {
+	expected := Command{Type: CREATE, TimeSeries: timeseries{"ts-test", 0}, Avg: -1}
+	if !reflect.DeepEqual(command, expected) {
 		t.Errorf("Failed to parse CREATE query")
 	}
 }
 
+func TestParseCreateWithDuplicates(t *testing.T) {
+	for _, query := range []string{"CREATE ts-test 3000 DUPLICATE sum", "CREATE ts-test DUPLICATE SUM"} {
+		parser := NewParser(query)
+		command, err := parser.Parse()
+		if err != nil || command.Duplicates != series.DuplicateSum {
+			t.Errorf("Failed to parse %v, got %v %v", query, command.Duplicates, err)
+		}
+	}
+	parser := NewParser("CREATE ts-test DUPLICATE newest")
+	if _, err := parser.Parse(); err != series.UnknownDuplicatePolicyErr {
+		t.Errorf("Expected UnknownDuplicatePolicyErr got %v", err)
+	}
+}
+
 func TestParseDelete(t *testing.T) {
 	parser := NewParser("DELETE ts-test")
 	command, err := parser.Parse()
@@ -66,14 +85,30 @@ func TestParseDelete(t *testing.T) {
 	}
 }
 
+func TestParseDeleteRange(t *testing.T) {
+	parser := NewParser("DELETE ts-test RANGE 1000 2000")
+	command, err := parser.Parse()
+	if err != nil {
+		t.Errorf("Failed to parse DELETE RANGE query")
+	}
+	expected := Command{Type: DELETERANGE, TimeSeries: timeseries{"ts-test", 0}, Range: timerange{1000, 2000}, Avg: -1}
+	if !reflect.DeepEqual(command, expected) {
+		t.Errorf("Failed to parse DELETE RANGE query, got %v", command)
+	}
+	parser = NewParser("DELETE ts-test RANGE 1000")
+	if _, err := parser.Parse(); err != MissingTimeStampErr {
+		t.Errorf("Expected MissingTimeStampErr got %v", err)
+	}
+}
+
 func TestParseAdd(t *testing.T) {
 	parser := NewParser("ADD ts-test * 12.2")
 	command, err := parser.Parse()
 	if err != nil {
 		t.Errorf("Failed to parse ADD query")
 	}
-	expected := Command{ADD, timeseries{"ts-test", 0}, 0, 12.2, timerange{}, 0, -1}
-	if command != expected {
+	expected := Command{Type: ADD, TimeSeries: timeseries{"ts-test", 0}, Value: 12.2, Avg: -1}
+	if !reflect.DeepEqual(command, expected) {
 		t.Errorf("Failed to parse ADD query")
 	}
 }
@@ -85,8 +120,8 @@ func TestParseAddWithTimestamp(t *testing.T) {
 	if err != nil {
 		t.Errorf("Failed to parse ADD query")
 	}
-	expected := Command{ADD, timeseries{"ts-test", 0}, now, 12.2, timerange{}, 0, -1}
-	if command != expected {
+	expected := Command{Type: ADD, TimeSeries: timeseries{"ts-test", 0}, Timestamp: now, Value: 12.2, Avg: -1}
+	if !reflect.DeepEqual(command, expected) {
 		t.Errorf("Failed to parse ADD query")
 	}
 }
@@ -97,8 +132,8 @@ func TestParseQuery(t *testing.T) {
 	if err != nil {
 		t.Errorf("Failed to parse QUERY query")
 	}
-	expected := Command{QUERY, timeseries{"ts-test", 0}, 0, 0, timerange{}, 0, -1}
-	if command != expected {
+	expected := Command{Type: QUERY, TimeSeries: timeseries{"ts-test", 0}, Avg: -1}
+	if !reflect.DeepEqual(command, expected) {
 		t.Errorf("Failed to parse QUERY query")
 	}
 }
@@ -110,8 +145,8 @@ func TestParseQueryWithMajorOf(t *testing.T) {
 	if err != nil {
 		t.Errorf("Failed to parse QUERY query")
 	}
-	expected := Command{QUERY, timeseries{"ts-test", 0}, 0, 0, timerange{now, 0}, 0, -1}
-	if command != expected {
+	expected := Command{Type: QUERY, TimeSeries: timeseries{"ts-test", 0}, Range: timerange{now, 0}, Avg: -1}
+	if !reflect.DeepEqual(command, expected) {
 		t.Errorf("Failed to parse QUERY query, expected %v got %v",
 			expected, command)
 	}
@@ -124,8 +159,8 @@ func TestParseQueryWithMinorOf(t *testing.T) {
 	if err != nil {
 		t.Errorf("Failed to parse QUERY query")
 	}
-	expected := Command{QUERY, timeseries{"ts-test", 0}, 0, 0, timerange{0, now}, 0, -1}
-	if command != expected {
+	expected := Command{Type: QUERY, TimeSeries: timeseries{"ts-test", 0}, Range: timerange{0, now}, Avg: -1}
+	if !reflect.DeepEqual(command, expected) {
 		t.Errorf("Failed to parse QUERY query")
 	}
 }
@@ -138,8 +173,271 @@ func TestParseQueryWithRange(t *testing.T) {
 	if err != nil {
 		t.Errorf("Failed to parse QUERY query")
 	}
-	expected := Command{QUERY, timeseries{"ts-test", 0}, 0, 0, timerange{now, then}, 0, -1}
-	if command != expected {
+	expected := Command{Type: QUERY, TimeSeries: timeseries{"ts-test", 0}, Range: timerange{now, then}, Avg: -1}
+	if !reflect.DeepEqual(command, expected) {
 		t.Errorf("Failed to parse QUERY query")
 	}
 }
+
+func TestParseSnapshot(t *testing.T) {
+	parser := NewParser("snapshot")
+	command, err := parser.Parse()
+	if err != nil || command.Type != SNAPSHOT {
+		t.Errorf("Failed to parse SNAPSHOT query")
+	}
+}
+
+func TestParseListAndInfo(t *testing.T) {
+	for query, expected := range map[string]Command{
+		"LIST":         {Type: LIST, Avg: -1},
+		"LIST cpu*":    {Type: LIST, Pattern: "cpu*", Avg: -1},
+		"INFO ts-test": {Type: INFO, TimeSeries: timeseries{"ts-test", 0}, Avg: -1},
+	} {
+		parser := NewParser(query)
+		command, err := parser.Parse()
+		if err != nil || !reflect.DeepEqual(command, expected) {
+			t.Errorf("Failed to parse %v, got %v (%v)", query, command, err)
+		}
+	}
+	parser := NewParser("INFO")
+	if _, err := parser.Parse(); err != MissingTimeSeriesNameErr {
+		t.Errorf("Expected MissingTimeSeriesNameErr got %v", err)
+	}
+}
+
+func TestParseMultiAdd(t *testing.T) {
+	parser := NewParser("MADD ts-a * 12.2 ts-b 1588000000 2.5 ts-a * 13")
+	command, err := parser.Parse()
+	if err != nil {
+		t.Errorf("Failed to parse MADD query")
+	}
+	expected := Command{
+		Type: MADD,
+		Avg:  -1,
+		Points: []Point{
+			{"ts-a", 0, 12.2},
+			{"ts-b", 1588000000, 2.5},
+			{"ts-a", 0, 13},
+		},
+	}
+	if !reflect.DeepEqual(command, expected) {
+		t.Errorf("Failed to parse MADD query, expected %v got %v", expected, command)
+	}
+	names := command.seriesNames()
+	if len(names) != 2 || names[0] != "ts-a" || names[1] != "ts-b" {
+		t.Errorf("Wrong timeseries names for MADD query, got %v", names)
+	}
+}
+
+func TestParseMultiAddMissingValue(t *testing.T) {
+	parser := NewParser("MADD ts-a * 12.2 ts-b 1588000000")
+	if _, err := parser.Parse(); err != MissingValueErr {
+		t.Errorf("Expected missing value error, got %v", err)
+	}
+	parser = NewParser("MADD")
+	if _, err := parser.Parse(); err != MissingTimeSeriesNameErr {
+		t.Errorf("Expected missing timeseries name error, got %v", err)
+	}
+}
+
+func TestParseMultiAddTooManySeries(t *testing.T) {
+	cmd := strings.Builder{}
+	cmd.WriteString("MADD")
+	for i := 0; i <= protocol.MaxSeries; i++ {
+		cmd.WriteString(" ts-" + strconv.Itoa(i) + " * 1")
+	}
+	parser := NewParser(cmd.String())
+	if _, err := parser.Parse(); err != protocol.TooManySeriesErr {
+		t.Errorf("Expected too many series error, got %v", err)
+	}
+}
+
+func TestTokenizeSelector(t *testing.T) {
+	tokens := tokenize(`QUERY cpu{host="a b", region=~"eu-\"x\"}"}  * AVG 60`)
+	expected := []string{"QUERY", `cpu{host="a b", region=~"eu-\"x\"}"}`, "*", "AVG", "60"}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Failed to tokenize selector, expected %q got %q", expected, tokens)
+	}
+}
+
+func TestParseCreateWithLabels(t *testing.T) {
+	parser := NewParser(`CREATE cpu{host="a", region="eu"} 3000`)
+	command, err := parser.Parse()
+	if err != nil {
+		t.Errorf("Failed to parse CREATE query")
+	}
+	expected := Command{
+		Type:       CREATE,
+		TimeSeries: timeseries{`cpu{host="a", region="eu"}`, 3e9},
+		Avg:        -1,
+	}
+	if !reflect.DeepEqual(command, expected) {
+		t.Errorf("Failed to parse CREATE query with labels, got %v", command)
+	}
+}
+
+func TestParseQueryAggregation(t *testing.T) {
+	parser := NewParser("QUERY ts-test * SUM 60000")
+	command, err := parser.Parse()
+	if err != nil {
+		t.Errorf("Failed to parse QUERY query with aggregation: %v", err)
+	}
+	expected := Command{
+		Type:        QUERY,
+		TimeSeries:  timeseries{"ts-test", 0},
+		Avg:         -1,
+		Aggregation: series.AggSum,
+		Interval:    60e9,
+	}
+	if !reflect.DeepEqual(command, expected) {
+		t.Errorf("Failed to parse QUERY query with aggregation, got %v", command)
+	}
+	parser = NewParser("QUERY ts-test RANGE 1578897600 1578898600 avg 1000")
+	command, err = parser.Parse()
+	if err != nil || command.Aggregation != series.AggAvg || command.Avg != 1e9 {
+		t.Errorf("Failed to parse QUERY query with AVG, got %v", command)
+	}
+	parser = NewParser("QUERY ts-test * MEDIAN 1000")
+	if _, err := parser.Parse(); err != series.UnknownAggregationErr {
+		t.Errorf("Expected an unknown aggregation error, got %v", err)
+	}
+}
+
+func TestParseQueryQuantile(t *testing.T) {
+	parser := NewParser("QUERY latency RANGE 1578897600 1578898600 P99 60000")
+	command, err := parser.Parse()
+	if err != nil {
+		t.Errorf("Failed to parse QUERY query with quantile: %v", err)
+	}
+	if command.Aggregation != series.AggQuantile || command.Quantile != 0.99 ||
+		command.Interval != 60e9 || command.Avg != -1 {
+		t.Errorf("Failed to parse QUERY query with quantile, got %v", command)
+	}
+}
+
+func TestParseQueryCounter(t *testing.T) {
+	parser := NewParser("QUERY requests * RATE 60000")
+	command, err := parser.Parse()
+	if err != nil {
+		t.Errorf("Failed to parse QUERY query with rate: %v", err)
+	}
+	q := protocol.QueryPacket{Flags: command.Flag}
+	if q.Counter() != protocol.RATE || command.Interval != 60e9 ||
+		command.Aggregation != series.AggNone {
+		t.Errorf("Failed to parse QUERY query with rate, got %v", command)
+	}
+	parser = NewParser("QUERY requests > 1578897600 derivative")
+	command, err = parser.Parse()
+	q = protocol.QueryPacket{Flags: command.Flag}
+	if err != nil || q.Counter() != protocol.DERIVATIVE || command.Interval != 0 {
+		t.Errorf("Failed to parse QUERY query with derivative, got %v", command)
+	}
+}
+
+func TestParseQueryFill(t *testing.T) {
+	cases := map[string]Command{
+		"QUERY ts-test * SUM 60000 FILL linear": {
+			Aggregation: series.AggSum, Interval: 60e9, Fill: series.FillLinear,
+		},
+		"QUERY ts-test * P99 1000 FILL -1": {
+			Aggregation: series.AggQuantile, Quantile: 0.99, Interval: 1e9,
+			Fill: series.FillValue, FillValue: -1,
+		},
+		"QUERY ts-test * RATE FILL previous": {
+			Flag: protocol.RATE << 4, Fill: series.FillPrevious,
+		},
+	}
+	for query, expected := range cases {
+		parser := NewParser(query)
+		command, err := parser.Parse()
+		if err != nil {
+			t.Errorf("Failed to parse %v: %v", query, err)
+		}
+		expected.Type = QUERY
+		expected.TimeSeries = timeseries{"ts-test", 0}
+		expected.Avg = -1
+		if !reflect.DeepEqual(command, expected) {
+			t.Errorf("Failed to parse %v, got %v", query, command)
+		}
+	}
+	for _, query := range []string{"QUERY ts-test * SUM 1000 FILL", "QUERY ts-test * SUM 1000 FILL zero", "QUERY ts-test * SUM 1000 FOO"} {
+		parser := NewParser(query)
+		if _, err := parser.Parse(); err == nil {
+			t.Errorf("Expected an error parsing %v", query)
+		}
+	}
+}
+
+func TestParseTimeExpressions(t *testing.T) {
+	now := time.Date(2020, 1, 13, 12, 0, 0, 0, time.UTC)
+	cases := map[string]timerange{
+		"QUERY ts-test RANGE 2020-01-13T10:00:00Z 2020-01-13T11:30:00.5+01:00": {
+			now.Add(-2 * time.Hour).UnixNano(), now.Add(-90*time.Minute + 500*time.Millisecond).UnixNano(),
+		},
+		"QUERY ts-test RANGE now-1h30m now": {
+			now.Add(-90 * time.Minute).UnixNano(), now.UnixNano(),
+		},
+		"QUERY ts-test > NOW-1d": {now.Add(-24 * time.Hour).UnixNano(), 0},
+		"QUERY ts-test < now+1w": {0, now.Add(7 * 24 * time.Hour).UnixNano()},
+		"DELETE ts-test RANGE 1578897600 now-500ms": {
+			1578897600 * 1e9, now.Add(-500 * time.Millisecond).UnixNano(),
+		},
+	}
+	for query, expected := range cases {
+		parser := NewParser(query)
+		parser.now = now
+		command, err := parser.Parse()
+		if err != nil || command.Range != expected {
+			t.Errorf("Failed to parse %v, expected %v got %v (%v)", query, expected, command.Range, err)
+		}
+	}
+	for _, query := range []string{
+		"QUERY ts-test > yesterday",
+		"QUERY ts-test > now-",
+		"QUERY ts-test > now*1h",
+		"QUERY ts-test > now-1y",
+		"QUERY ts-test RANGE 2020-01-13 now",
+	} {
+		parser := NewParser(query)
+		if _, err := parser.Parse(); !errors.Is(err, InvalidTimestampErr) && !errors.Is(err, InvalidDurationErr) {
+			t.Errorf("Expected %v to fail, got %v", query, err)
+		}
+	}
+}
+
+func TestParseDurations(t *testing.T) {
+	cases := map[string]time.Duration{
+		"QUERY ts-test * SUM 60000":     time.Minute,
+		"QUERY ts-test * SUM 5m":        5 * time.Minute,
+		"QUERY ts-test * AVG 1h30m":     90 * time.Minute,
+		"QUERY ts-test * RATE 1d":       24 * time.Hour,
+		"QUERY ts-test * P99 1s500ms":   1500 * time.Millisecond,
+		"QUERY ts-test * SUM 1500us":    1500 * time.Microsecond,
+		"QUERY ts-test * SUM 250ns":     250,
+		"QUERY ts-test * MAX 2w FILL 0": 14 * 24 * time.Hour,
+	}
+	for query, expected := range cases {
+		parser := NewParser(query)
+		command, err := parser.Parse()
+		if err != nil || command.Interval != int64(expected) {
+			t.Errorf("Failed to parse %v, expected %v got %v (%v)", query, expected, command.Interval, err)
+		}
+	}
+	parser := NewParser("CREATE ts-test 7d DUPLICATE LAST")
+	command, err := parser.Parse()
+	if err != nil || command.TimeSeries.Retention != int64(7*24*time.Hour) {
+		t.Errorf("Failed to parse CREATE with retention, got %v (%v)", command, err)
+	}
+	for _, query := range []string{
+		"QUERY ts-test * SUM 5x",
+		"QUERY ts-test * SUM m",
+		"QUERY ts-test * SUM 1h-5m",
+		"QUERY ts-test * SUM 99999999999999999999h",
+		"CREATE ts-test 1.5h",
+	} {
+		parser := NewParser(query)
+		if _, err := parser.Parse(); !errors.Is(err, InvalidDurationErr) {
+			t.Errorf("Expected %v to fail, got %v", query, err)
+		}
+	}
+}
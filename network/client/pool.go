@@ -0,0 +1,320 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/codepr/timepipe/network/protocol"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxConns            = 16
+	DefaultHealthCheckInterval = 10 * time.Second
+)
+
+var (
+	PoolClosedErr = errors.New("pool closed")
+)
+
+// PoolOptions configures a Pool, MinConns connections are kept open even
+// when idle and at most MaxConns are open at once, HealthCheckInterval is
+// the interval between two checks of the idle connections, each one pinged
+// and given as long to answer. Client configures each client of the pool.
+// Zero values fall back to their default.
+type PoolOptions struct {
+	MinConns            int
+	MaxConns            int
+	HealthCheckInterval time.Duration
+	Client              ClientOptions
+}
+
+// Pool is a set of clients connected to the same server, safe for concurrent
+// use. Each request borrows a client for its whole duration, so that slow
+// requests only hold their own connection, callers exceeding MaxConns wait
+// for a client to be returned. Broken connections are replaced, either when
+// they're returned or by the periodic health check.
+type Pool struct {
+	network, host, port string
+	opts                PoolOptions
+	// Holds a token for each client in use
+	slots  chan struct{}
+	mu     sync.Mutex
+	idle   []*Client
+	open   int
+	closed bool
+	done   chan struct{}
+}
+
+// NewPool creates a Pool connected to a timepipe server, opening MinConns
+// connections right away
+func NewPool(network, host, port string, opts PoolOptions) (*Pool, error) {
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = DefaultMaxConns
+	}
+	if opts.MinConns > opts.MaxConns {
+		opts.MinConns = opts.MaxConns
+	}
+	if opts.HealthCheckInterval <= 0 {
+		opts.HealthCheckInterval = DefaultHealthCheckInterval
+	}
+	p := &Pool{
+		network: network,
+		host:    host,
+		port:    port,
+		opts:    opts,
+		slots:   make(chan struct{}, opts.MaxConns),
+		done:    make(chan struct{}),
+	}
+	if err := p.fill(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	go p.healthCheck()
+	return p, nil
+}
+
+// Get borrows a client from the pool, waiting for one to be returned if
+// MaxConns are already in use. The client must be given back with Put.
+func (p *Pool) Get() (*Client, error) {
+	return p.GetContext(context.Background())
+}
+
+// GetContext is Get giving up waiting for a client when ctx is done
+func (p *Pool) GetContext(ctx context.Context) (*Client, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.done:
+		return nil, PoolClosedErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return nil, PoolClosedErr
+	}
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if c.Healthy() {
+			p.mu.Unlock()
+			return c, nil
+		}
+		p.open--
+		c.Close()
+	}
+	p.open++
+	p.mu.Unlock()
+	c, err := NewTimepipeClientWithOptions(p.network, p.host, p.port, p.opts.Client)
+	if err != nil {
+		p.mu.Lock()
+		p.open--
+		p.mu.Unlock()
+		<-p.slots
+		return nil, err
+	}
+	return c, nil
+}
+
+// Put gives back a client borrowed with Get, broken clients are closed and
+// replaced by the next health check if needed
+func (p *Pool) Put(c *Client) {
+	p.mu.Lock()
+	if p.closed || !c.Healthy() {
+		p.open--
+		p.mu.Unlock()
+		c.Close()
+	} else {
+		p.idle = append(p.idle, c)
+		p.mu.Unlock()
+	}
+	<-p.slots
+}
+
+// Do runs fn with a client borrowed from the pool
+func (p *Pool) Do(fn func(c *Client) error) error {
+	c, err := p.Get()
+	if err != nil {
+		return err
+	}
+	defer p.Put(c)
+	return fn(c)
+}
+
+// Close closes the idle clients, the ones in use are closed once returned
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+	for _, c := range p.idle {
+		c.Close()
+	}
+	p.open -= len(p.idle)
+	p.idle = nil
+}
+
+// healthCheck periodically replaces the broken idle clients and opens new
+// ones until MinConns are open
+func (p *Pool) healthCheck() {
+	ticker := time.NewTicker(p.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.probe()
+			if err := p.fill(); err != nil {
+				log.Println("Can't open connection:", err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// probe pings the idle clients, closing the ones not answering. They're taken
+// out of the idle ones meanwhile, so that Get doesn't borrow them while pinged.
+func (p *Pool) probe() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	healthy := idle[:0]
+	for _, c := range idle {
+		if c.Healthy() && p.ping(c) == nil {
+			healthy = append(healthy, c)
+			continue
+		}
+		c.Close()
+		p.mu.Lock()
+		p.open--
+		p.mu.Unlock()
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.open -= len(healthy)
+		for _, c := range healthy {
+			c.Close()
+		}
+	} else {
+		p.idle = append(p.idle, healthy...)
+	}
+	p.mu.Unlock()
+}
+
+// ping pings a client giving it up to HealthCheckInterval to answer
+func (p *Pool) ping(c *Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.opts.HealthCheckInterval)
+	defer cancel()
+	return c.PingContext(ctx)
+}
+
+// fill opens new idle clients until MinConns are open
+func (p *Pool) fill() error {
+	for {
+		p.mu.Lock()
+		if p.closed || p.open >= p.opts.MinConns {
+			p.mu.Unlock()
+			return nil
+		}
+		p.open++
+		p.mu.Unlock()
+		c, err := NewTimepipeClientWithOptions(p.network, p.host, p.port, p.opts.Client)
+		p.mu.Lock()
+		if err != nil {
+			p.open--
+			p.mu.Unlock()
+			return err
+		}
+		if p.closed {
+			p.open--
+			p.mu.Unlock()
+			c.Close()
+			return nil
+		}
+		p.idle = append(p.idle, c)
+		p.mu.Unlock()
+	}
+}
+
+// Len returns the number of clients open, idle or in use
+func (p *Pool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.open
+}
+
+// SendCommand sends a command on a client of the pool and waits for its
+// response
+func (p *Pool) SendCommand(cmdString string) (r *TpResponse, err error) {
+	err = p.Do(func(c *Client) error {
+		r, err = c.SendCommand(cmdString)
+		return err
+	})
+	return r, err
+}
+
+// Create works like Client.Create on a client of the pool
+func (p *Pool) Create(name string, retention time.Duration) error {
+	return p.Do(func(c *Client) error { return c.Create(name, retention) })
+}
+
+// Delete works like Client.Delete on a client of the pool
+func (p *Pool) Delete(name string) error {
+	return p.Do(func(c *Client) error { return c.Delete(name) })
+}
+
+// AddPoint works like Client.AddPoint on a client of the pool
+func (p *Pool) AddPoint(name string, timestamp int64, value float64) error {
+	return p.Do(func(c *Client) error { return c.AddPoint(name, timestamp, value) })
+}
+
+// AddPoints works like Client.AddPoints on a client of the pool
+func (p *Pool) AddPoints(points []Point) (errs map[string]error, err error) {
+	err = p.Do(func(c *Client) error {
+		errs, err = c.AddPoints(points)
+		return err
+	})
+	return errs, err
+}
+
+// Query works like Client.Query on a client of the pool
+func (p *Pool) Query(opts QueryOptions) (result []protocol.SeriesPoints, err error) {
+	err = p.Do(func(c *Client) error {
+		result, err = c.Query(opts)
+		return err
+	})
+	return result, err
+}
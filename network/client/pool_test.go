@@ -0,0 +1,255 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T, l net.Listener, opts PoolOptions) *Pool {
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, err := NewPool("tcp", host, port, opts)
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+	return p
+}
+
+func TestPoolConcurrentUse(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	p := newTestPool(t, l, PoolOptions{MaxConns: 4})
+	defer p.Close()
+	if err := p.Create("ts-test", 0); err != nil {
+		t.Fatalf("Failed to create timeseries: %v", err)
+	}
+	const n = 200
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := p.AddPoint("ts-test", int64(i+1), 1); err != nil {
+				t.Error(err)
+			}
+			if open := p.Len(); open > 4 {
+				t.Errorf("Expected at most 4 connections got %v", open)
+			}
+		}(i)
+	}
+	wg.Wait()
+	result, err := p.Query(QueryOptions{Name: "ts-test"})
+	if err != nil || len(result[0].Records) != n {
+		t.Errorf("Expected %v records got %v (%v)", n, result, err)
+	}
+}
+
+func TestPoolMaxConns(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	p := newTestPool(t, l, PoolOptions{MaxConns: 1})
+	defer p.Close()
+	c, err := p.Get()
+	if err != nil {
+		t.Fatalf("Failed to get client: %v", err)
+	}
+	got := make(chan *Client)
+	go func() {
+		c, _ := p.Get()
+		got <- c
+	}()
+	select {
+	case <-got:
+		t.Fatalf("Expected Get to wait for a client to be returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.Put(c)
+	if other := <-got; other != c {
+		t.Errorf("Expected the returned client to be reused")
+	} else {
+		p.Put(other)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	p := newTestPool(t, l, PoolOptions{MinConns: 2, HealthCheckInterval: 10 * time.Millisecond})
+	defer p.Close()
+	if p.Len() != 2 {
+		t.Fatalf("Expected 2 connections opened got %v", p.Len())
+	}
+	p.mu.Lock()
+	broken := append([]*Client(nil), p.idle...)
+	p.mu.Unlock()
+	for _, c := range broken {
+		c.conn.Close()
+	}
+	replaced := false
+	deadline := time.Now().Add(5 * time.Second)
+	for !replaced && time.Now().Before(deadline) {
+		p.mu.Lock()
+		replaced = len(p.idle) == 2
+		for _, c := range p.idle {
+			replaced = replaced && c != broken[0] && c != broken[1] && c.Healthy()
+		}
+		p.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !replaced {
+		t.Errorf("Expected broken connections to be replaced")
+	}
+	if p.Len() != 2 {
+		t.Errorf("Expected 2 connections open got %v", p.Len())
+	}
+	if err := p.Create("ts-test", 0); err != nil {
+		t.Errorf("Failed to create timeseries: %v", err)
+	}
+}
+
+// stallingProxy forwards the connections it accepts to a server, once stalled
+// the responses are dropped, the connections stay open but get no answer
+type stallingProxy struct {
+	net.Listener
+	stalled int32
+}
+
+func startStallingProxy(t *testing.T, server net.Listener) *stallingProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	proxy := &stallingProxy{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", server.Addr().String())
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				io.Copy(upstream, conn)
+				upstream.Close()
+			}()
+			go func() {
+				proxy.forward(conn, upstream)
+				conn.Close()
+			}()
+		}
+	}()
+	return proxy
+}
+
+func (p *stallingProxy) forward(dst io.Writer, src io.Reader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if atomic.LoadInt32(&p.stalled) == 1 {
+			continue
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func TestPoolHealthCheckPing(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	proxy := startStallingProxy(t, l)
+	defer proxy.Close()
+	p := newTestPool(t, proxy, PoolOptions{
+		MinConns:            1,
+		HealthCheckInterval: 20 * time.Millisecond,
+		Client:              ClientOptions{Timeout: 100 * time.Millisecond},
+	})
+	defer p.Close()
+	p.mu.Lock()
+	c := p.idle[0]
+	p.mu.Unlock()
+	// The connection of the idle client looks fine, only a ping finds out
+	// that the server doesn't answer anymore
+	atomic.StoreInt32(&proxy.stalled, 1)
+	for deadline := time.Now().Add(5 * time.Second); c.Healthy(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the stalled client to be closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	atomic.StoreInt32(&proxy.stalled, 0)
+	if err := p.Create("ts-test", 0); err != nil {
+		t.Errorf("Failed to create timeseries: %v", err)
+	}
+}
+
+func TestPoolGetContext(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	p := newTestPool(t, l, PoolOptions{MaxConns: 1})
+	defer p.Close()
+	c, err := p.Get()
+	if err != nil {
+		t.Fatalf("Failed to get client: %v", err)
+	}
+	defer p.Put(c)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.GetContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded waiting for a client got %v", err)
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	l := startTestServer(t)
+	defer l.Close()
+	p := newTestPool(t, l, PoolOptions{MinConns: 1})
+	c, _ := p.Get()
+	p.Close()
+	p.Put(c)
+	if c.Healthy() {
+		t.Errorf("Expected client returned after Close to be closed")
+	}
+	if _, err := p.Get(); err != PoolClosedErr {
+		t.Errorf("Expected PoolClosedErr got %v", err)
+	}
+	if p.Len() != 0 {
+		t.Errorf("Expected no connections open got %v", p.Len())
+	}
+}
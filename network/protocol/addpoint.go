@@ -28,7 +28,6 @@ package protocol
 
 import (
 	"bytes"
-	"encoding"
 	"encoding/binary"
 	"github.com/codepr/timepipe/timeseries"
 )
@@ -88,11 +87,24 @@ func (a *AddPointPacket) MarshalBinary() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (a *AddPointPacket) Apply(ts *timeseries.TimeSeries) (encoding.BinaryMarshaler, error) {
+// Apply adds the record to the timeseries, answering with the outcome
+func (a *AddPointPacket) Apply(ts *timeseries.TimeSeries) (*Response, error) {
 	record := &timeseries.Record{Timestamp: a.Timestamp, Value: a.Value}
-	ts.AddRecord(record)
-	r := Header{}
-	r.SetOpcode(ACK)
-	r.SetStatus(OK)
-	return r, nil
+	return NewAckResponse(addRecord(ts, record)), nil
+}
+
+// addRecord adds a record to a timeseries and returns the status telling its
+// outcome, ACCEPTED if stored, MERGED if merged with a record having the same
+// timestamp, TOOLATE or DUPLICATE if rejected
+func addRecord(ts *timeseries.TimeSeries, record *timeseries.Record) uint16 {
+	merged, err := ts.AddRecord(record)
+	switch {
+	case err == timeseries.OutOfOrderErr:
+		return TOOLATE
+	case err == timeseries.DuplicateErr:
+		return DUPLICATE
+	case merged:
+		return MERGED
+	}
+	return ACCEPTED
 }
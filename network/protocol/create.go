@@ -29,11 +29,39 @@ package protocol
 import (
 	"bytes"
 	"encoding/binary"
+	"github.com/codepr/timepipe/timeseries"
+	"sort"
 )
 
+// CreatePacket creates a series identified by its name and labels, labels
+// and then the duplicate policy trail the packet and are optional, older
+// clients just don't send them. Retention is in nanoseconds, sent in
+// milliseconds as by timeseries.Millis and, when it isn't a whole number of
+// them, at the end of the packet too. Created is the
+// creation time in nanoseconds since the epoch, written last and only when
+// set, the server sets it when logging the packet so that replaying it
+// restores the creation time.
 type CreatePacket struct {
-	Name      string
-	Retention int64
+	Name       string
+	Retention  int64
+	Labels     timeseries.Labels
+	Duplicates timeseries.DuplicatePolicy
+	Created    int64
+}
+
+// NewCreatePacket creates a CreatePacket from a series key, a name optionally
+// followed by labels in the {label="value",...} form
+func NewCreatePacket(key string, retention int64) (*CreatePacket, error) {
+	name, labels, err := timeseries.ParseSeriesKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &CreatePacket{Name: name, Retention: retention, Labels: labels}, nil
+}
+
+// Key returns the canonical key of the series to be created
+func (c *CreatePacket) Key() string {
+	return timeseries.SeriesKey(c.Name, c.Labels)
 }
 
 func (c *CreatePacket) UnmarshalBinary(buf []byte) error {
@@ -49,8 +77,48 @@ func (c *CreatePacket) UnmarshalBinary(buf []byte) error {
 	if err := binary.Read(reader, binary.BigEndian, &c.Retention); err != nil {
 		return err
 	}
+	c.Retention = timeseries.Nanos(c.Retention)
 	c.Name = string(name)
-	return nil
+	c.Labels = nil
+	c.Duplicates = timeseries.DuplicateAllow
+	c.Created = 0
+	if reader.Len() == 0 {
+		return nil
+	}
+	var labels uint16 = 0
+	if err := binary.Read(reader, binary.BigEndian, &labels); err != nil {
+		return err
+	}
+	for i := 0; i < int(labels); i++ {
+		label := timeseries.Label{}
+		if err := readString(reader, &label.Name); err != nil {
+			return err
+		}
+		if err := readString(reader, &label.Value); err != nil {
+			return err
+		}
+		c.Labels = append(c.Labels, label)
+	}
+	sort.Sort(c.Labels)
+	if reader.Len() == 0 {
+		return nil
+	}
+	if err := binary.Read(reader, binary.BigEndian, &c.Duplicates); err != nil {
+		return err
+	}
+	if c.Duplicates > timeseries.DuplicateMax {
+		return timeseries.UnknownDuplicatePolicyErr
+	}
+	if reader.Len() == 0 {
+		return nil
+	}
+	if err := binary.Read(reader, binary.BigEndian, &c.Retention); err != nil {
+		return err
+	}
+	if reader.Len() == 0 {
+		return nil
+	}
+	return binary.Read(reader, binary.BigEndian, &c.Created)
 }
 
 func (c *CreatePacket) MarshalBinary() ([]byte, error) {
@@ -61,8 +129,64 @@ func (c *CreatePacket) MarshalBinary() ([]byte, error) {
 	if err := binary.Write(buf, binary.BigEndian, []byte(c.Name)); err != nil {
 		return nil, err
 	}
+	if err := binary.Write(buf, binary.BigEndian, timeseries.Millis(c.Retention)); err != nil {
+		return nil, err
+	}
+	// The trailing fields are written up to the last one needed
+	exact := timeseries.WholeMillis(c.Retention) && c.Created == 0
+	if len(c.Labels) == 0 && c.Duplicates == timeseries.DuplicateAllow && exact {
+		return buf.Bytes(), nil
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(c.Labels))); err != nil {
+		return nil, err
+	}
+	for _, l := range c.Labels {
+		if err := writeString(buf, l.Name); err != nil {
+			return nil, err
+		}
+		if err := writeString(buf, l.Value); err != nil {
+			return nil, err
+		}
+	}
+	if c.Duplicates == timeseries.DuplicateAllow && exact {
+		return buf.Bytes(), nil
+	}
+	if err := binary.Write(buf, binary.BigEndian, c.Duplicates); err != nil {
+		return nil, err
+	}
+	if exact {
+		return buf.Bytes(), nil
+	}
 	if err := binary.Write(buf, binary.BigEndian, c.Retention); err != nil {
 		return nil, err
 	}
+	if c.Created == 0 {
+		return buf.Bytes(), nil
+	}
+	if err := binary.Write(buf, binary.BigEndian, c.Created); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
+
+// readString reads a string prefixed by its length
+func readString(r *bytes.Reader, str *string) error {
+	var strLen uint16 = 0
+	if err := binary.Read(r, binary.BigEndian, &strLen); err != nil {
+		return err
+	}
+	b := make([]byte, strLen)
+	if err := binary.Read(r, binary.BigEndian, &b); err != nil {
+		return err
+	}
+	*str = string(b)
+	return nil
+}
+
+// writeString writes a string prefixed by its length
+func writeString(buf *bytes.Buffer, str string) error {
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(str))); err != nil {
+		return err
+	}
+	return binary.Write(buf, binary.BigEndian, []byte(str))
+}
@@ -29,6 +29,8 @@ package protocol
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"github.com/codepr/timepipe/timeseries"
 )
 
 type DeletePacket struct {
@@ -59,3 +61,65 @@ func (d *DeletePacket) MarshalBinary() ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+// DeleteRangePacket removes the records of a series with timestamp between
+// Start and End, both included
+type DeleteRangePacket struct {
+	Name  string
+	Start int64
+	End   int64
+}
+
+// DeleteRangeResponsePacket answers a DeleteRangePacket with the number of
+// records removed
+type DeleteRangeResponsePacket struct {
+	Deleted uint64
+}
+
+func (d *DeleteRangePacket) UnmarshalBinary(buf []byte) error {
+	reader := bytes.NewReader(buf)
+	if err := readString(reader, &d.Name); err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &d.Start); err != nil {
+		return err
+	}
+	return binary.Read(reader, binary.BigEndian, &d.End)
+}
+
+func (d *DeleteRangePacket) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := writeString(buf, d.Name); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, d.Start); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, d.End); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Apply removes the records in range from the timeseries, answering with the
+// number of records removed
+func (d *DeleteRangePacket) Apply(ts *timeseries.TimeSeries) (*Response, error) {
+	deleted := ts.DeleteRange(d.Start, d.End)
+	return NewResponse(DELETERANGE, OK, &DeleteRangeResponsePacket{uint64(deleted)}), nil
+}
+
+func (d *DeleteRangeResponsePacket) UnmarshalBinary(buf []byte) error {
+	return binary.Read(bytes.NewReader(buf), binary.BigEndian, &d.Deleted)
+}
+
+func (d *DeleteRangeResponsePacket) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, d.Deleted); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *DeleteRangeResponsePacket) String() string {
+	return fmt.Sprintf("(ok) - %d records deleted", d.Deleted)
+}
@@ -0,0 +1,90 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Error codes carried by an ErrorPacket
+const (
+	MALFORMEDPACKET = iota + 1
+	TRUNCATEDPACKET
+	PAYLOADTOOLARGE
+	INTERNALERROR
+	QUERYTIMEOUT
+	BADQUERY
+)
+
+// ErrorPacket is the payload of an ERRORRESPONSE, sent back when a request
+// can't be processed
+type ErrorPacket struct {
+	Code    uint16
+	Message string
+}
+
+// NewErrorResponse creates an ERRORRESPONSE with the given code and message
+func NewErrorResponse(code uint16, message string) *Response {
+	return NewResponse(ERRORRESPONSE, OK, &ErrorPacket{code, message})
+}
+
+func (e *ErrorPacket) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+func (e *ErrorPacket) UnmarshalBinary(buf []byte) error {
+	reader := bytes.NewReader(buf)
+	if err := binary.Read(reader, binary.BigEndian, &e.Code); err != nil {
+		return err
+	}
+	var messageLen uint16 = 0
+	if err := binary.Read(reader, binary.BigEndian, &messageLen); err != nil {
+		return err
+	}
+	message := make([]byte, messageLen)
+	if err := binary.Read(reader, binary.BigEndian, &message); err != nil {
+		return err
+	}
+	e.Message = string(message)
+	return nil
+}
+
+func (e *ErrorPacket) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, e.Code); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(e.Message))); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, []byte(e.Message)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
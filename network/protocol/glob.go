@@ -0,0 +1,155 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protocol
+
+import "unicode/utf8"
+
+// glob tells if a name is matched by a pattern, '*' matches any sequence of
+// characters, '/' included, '?' any single character, [...] a class of
+// characters as understood by path.Match and '\\' escapes the character
+// following it. Malformed patterns are expected to be rejected by
+// validPattern first, the parts not understood just don't match.
+func glob(pattern, name string) bool {
+	p, n := 0, 0
+	// Position of the last '*' and of the name it's tried from
+	star, next := -1, 0
+	for p < len(pattern) || n < len(name) {
+		if p < len(pattern) {
+			c, w := utf8.DecodeRuneInString(name[n:])
+			switch pattern[p] {
+			case '*':
+				star, next = p, n
+				p++
+				continue
+			case '?':
+				if n < len(name) {
+					p, n = p+1, n+w
+					continue
+				}
+			case '[':
+				if n < len(name) {
+					if matched, end := matchClass(pattern, p+1, c); matched {
+						p, n = end, n+w
+						continue
+					}
+				}
+			default:
+				pc, pw := patternChar(pattern, p)
+				if n < len(name) && pw > 0 && pc == c {
+					p, n = p+pw, n+w
+					continue
+				}
+			}
+		}
+		// On a mismatch the last '*' swallows one more character
+		if star < 0 || next == len(name) {
+			return false
+		}
+		_, w := utf8.DecodeRuneInString(name[next:])
+		next += w
+		p, n = star+1, next
+	}
+	return true
+}
+
+// validPattern tells if every escape of a pattern is followed by a character
+// and every class of characters is well formed
+func validPattern(pattern string) bool {
+	for p := 0; p < len(pattern); {
+		switch pattern[p] {
+		case '*', '?':
+			p++
+		case '[':
+			_, end := matchClass(pattern, p+1, 0)
+			if end < 0 {
+				return false
+			}
+			p = end
+		default:
+			_, w := patternChar(pattern, p)
+			if w == 0 {
+				return false
+			}
+			p += w
+		}
+	}
+	return true
+}
+
+// matchClass matches c against the class of characters following a '[' at
+// pattern[p:], returning the position following its closing ']' or -1 if
+// the class is malformed. A leading '^' negates the class.
+func matchClass(pattern string, p int, c rune) (bool, int) {
+	negated := false
+	if p < len(pattern) && pattern[p] == '^' {
+		negated = true
+		p++
+	}
+	matched := false
+	for ranges := 0; ; ranges++ {
+		if p < len(pattern) && pattern[p] == ']' && ranges > 0 {
+			return matched != negated, p + 1
+		}
+		lo, w := classChar(pattern, p)
+		if w == 0 {
+			return false, -1
+		}
+		p += w
+		hi := lo
+		if p < len(pattern) && pattern[p] == '-' {
+			if hi, w = classChar(pattern, p+1); w == 0 {
+				return false, -1
+			}
+			p += 1 + w
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+}
+
+// patternChar decodes the possibly escaped character at pattern[p:],
+// returning a width of 0 for a dangling escape
+func patternChar(pattern string, p int) (rune, int) {
+	if pattern[p] != '\\' {
+		return utf8.DecodeRuneInString(pattern[p:])
+	}
+	if p+1 == len(pattern) {
+		return 0, 0
+	}
+	c, w := utf8.DecodeRuneInString(pattern[p+1:])
+	return c, w + 1
+}
+
+// classChar decodes a character of a class at pattern[p:], returning a width
+// of 0 if there's none
+func classChar(pattern string, p int) (rune, int) {
+	if p == len(pattern) || pattern[p] == '-' || pattern[p] == ']' {
+		return 0, 0
+	}
+	return patternChar(pattern, p)
+}
@@ -0,0 +1,73 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protocol
+
+import "testing"
+
+func TestGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		matched bool
+	}{
+		{"cpu", "cpu", true},
+		{"cpu", "cpus", false},
+		{"cpu*", `cpu{host="a"}`, true},
+		{`disk*`, `disk{mount="/var/log"}`, true},
+		{`*"/var*"}`, `disk{mount="/var/log"}`, true},
+		{`*/tmp*`, `disk{mount="/var/log"}`, false},
+		{"*", "", true},
+		{"c?u", "cpu", true},
+		{"c?u", "cu", false},
+		{"mem[0-9]", "mem1", true},
+		{"mem[^0-9]", "mem1", false},
+		{"mem[^0-9]", "memx", true},
+		{"mem[a-cx]", "memx", true},
+		{`mem\*`, "mem*", true},
+		{`mem\*`, "memx", false},
+		{`[\]]`, "]", true},
+		{"a*b*c", "abxbyc", true},
+		{"a*b*c", "abxbyd", false},
+		{"€*", "€uro", true},
+		{"?uro", "€uro", true},
+	}
+	for _, test := range tests {
+		if matched := glob(test.pattern, test.name); matched != test.matched {
+			t.Errorf("Expected %q matching %q to be %v", test.pattern, test.name, test.matched)
+		}
+	}
+	for _, pattern := range []string{"cpu[", "[]", "[a-]", "[-a]", `cpu\`, "[^]"} {
+		if validPattern(pattern) {
+			t.Errorf("Expected %q to be malformed", pattern)
+		}
+	}
+	for _, pattern := range []string{"", "*", "[a-z]*", `\[`} {
+		if !validPattern(pattern) {
+			t.Errorf("Expected %q to be valid", pattern)
+		}
+	}
+}
@@ -29,6 +29,8 @@ package protocol
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"math"
 )
 
 const (
@@ -39,6 +41,16 @@ const (
 	QUERY
 	QUERYRESPONSE
 	ACK
+	SNAPSHOT
+	MADDPOINTRESPONSE
+	ERRORRESPONSE
+	HELLO
+	MULTIQUERYRESPONSE
+	DELETERANGE
+	// DELETERANGE, LIST and INFO are answered with packets carrying their
+	// own opcode, V1 headers have no room for more
+	LIST
+	INFO
 )
 
 const (
@@ -47,13 +59,58 @@ const (
 	TSNOTFOUND
 	TSEXISTS
 	UNKNOWNCMD
+	TOOLATE
+	MERGED
+	DUPLICATE
+)
+
+// Protocol versions, every connection starts with V1 and switches to a newer
+// version after an HELLO exchange
+const (
+	V1      = 1
+	V2      = 2
+	VERSION = V2
+)
+
+// Header sizes in bytes for each protocol version
+const (
+	HEADERV1LEN = 9
+	HEADERV2LEN = 13
+)
+
+var (
+	UnsupportedVersionErr = errors.New("unsupported protocol version")
+	FrameTooLargeErr      = errors.New("payload exceeds the maximum size of the frame")
 )
 
 type AckResponse = Header
 
+// Header precedes every packet, its layout depends on the protocol version.
+// V1 packs opcode and status in a single byte, followed by the payload length
+//
+//	| opcode 4 bits | status 3 bits | unused 1 bit | length 8 bytes |
+//
+// V2 widens opcode and status and adds a request id and flags
+//
+//	| version 1 byte | opcode 1 byte | status 2 bytes | id 4 bytes |
+//	| flags 1 byte | length 4 bytes |
+//
+// A zero Version is treated as V1.
 type Header struct {
-	Value byte
-	Size  uint64
+	Version byte
+	opcode  byte
+	status  uint16
+	ID      uint32
+	Flags   byte
+	Size    uint64
+}
+
+// HeaderLen returns the size of the header of a protocol version
+func HeaderLen(version byte) int {
+	if version >= V2 {
+		return HEADERV2LEN
+	}
+	return HEADERV1LEN
 }
 
 func (h *Header) Len() uint64 {
@@ -61,50 +118,93 @@ func (h *Header) Len() uint64 {
 }
 
 func (h *Header) Opcode() byte {
-	return h.Value >> 4
+	return h.opcode
 }
 
 func (h *Header) SetOpcode(opcode byte) {
-	h.Value &= 0x0F
-	h.Value |= ((opcode << 4) & 0xF0)
+	h.opcode = opcode
 }
 
-func (h *Header) Status() byte {
-	return h.Value >> 1 & 0x03
+func (h *Header) Status() uint16 {
+	return h.status
 }
 
-func (h *Header) SetStatus(status byte) {
-	h.Value |= status << 1
+func (h *Header) SetStatus(status uint16) {
+	h.status = status
 }
 
 func (h Header) MarshalBinary() ([]byte, error) {
+	if h.Version < V2 {
+		buf := make([]byte, HEADERV1LEN)
+		buf[0] = h.opcode<<4 | byte(h.status&0x07)<<1
+		binary.BigEndian.PutUint64(buf[1:], h.Size)
+		return buf, nil
+	}
+	// V2 frames carry the size of the payload in 32 bits
+	if h.Size > math.MaxUint32 {
+		return nil, FrameTooLargeErr
+	}
 	buf := new(bytes.Buffer)
-	if err := binary.Write(buf, binary.BigEndian, h); err != nil {
-		return nil, err
+	data := []interface{}{
+		h.Version,
+		h.opcode,
+		h.status,
+		h.ID,
+		h.Flags,
+		uint32(h.Size),
+	}
+	for _, v := range data {
+		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
 	}
 	return buf.Bytes(), nil
 }
 
+// UnmarshalBinary decodes a header according to the Version already set
 func (h *Header) UnmarshalBinary(buf []byte) error {
-	// Read operation code
 	b := bytes.NewReader(buf)
-	var value uint8
-	if err := binary.Read(b, binary.BigEndian, &value); err != nil {
-		return err
+	if h.Version < V2 {
+		// Read operation code and status
+		var value uint8
+		if err := binary.Read(b, binary.BigEndian, &value); err != nil {
+			return err
+		}
+		// Read payload len in bytes
+		var size uint64
+		if err := binary.Read(b, binary.BigEndian, &size); err != nil {
+			return err
+		}
+		h.opcode = value >> 4
+		h.status = uint16(value >> 1 & 0x07)
+		h.Size = size
+		return nil
+	}
+	var (
+		version byte
+		size    uint32
+	)
+	data := []interface{}{&version, &h.opcode, &h.status, &h.ID, &h.Flags, &size}
+	for _, v := range data {
+		if err := binary.Read(b, binary.BigEndian, v); err != nil {
+			return err
+		}
 	}
-	// Read payload len in bytes
-	var size uint64
-	if err := binary.Read(b, binary.BigEndian, &size); err != nil {
-		return err
+	if version != h.Version {
+		return UnsupportedVersionErr
 	}
-	h.Value = value
-	h.Size = size
+	h.Size = uint64(size)
 	return nil
 }
 
 func (header Header) String() string {
+	return StatusString(header.Status())
+}
+
+// StatusString returns a human readable description of a status
+func StatusString(status uint16) string {
 	var response string = ""
-	switch header.Status() {
+	switch status {
 	case OK:
 		response = "(ok)"
 	case ACCEPTED:
@@ -115,6 +215,31 @@ func (header Header) String() string {
 		response = "(error) - timeseries not found"
 	case UNKNOWNCMD:
 		response = "(error) - unknown command"
+	case TOOLATE:
+		response = "(error) - record older than the out-of-order window"
+	case MERGED:
+		response = "(merged)"
+	case DUPLICATE:
+		response = "(error) - duplicate timestamp"
 	}
 	return response
 }
+
+// HelloPacket negotiates the protocol version of a connection, the client
+// sends the latest version it supports and the server answers with the one
+// to be used from the next packet on
+type HelloPacket struct {
+	Version byte
+}
+
+func (p *HelloPacket) UnmarshalBinary(buf []byte) error {
+	if len(buf) < 1 {
+		return UnsupportedVersionErr
+	}
+	p.Version = buf[0]
+	return nil
+}
+
+func (p *HelloPacket) MarshalBinary() ([]byte, error) {
+	return []byte{p.Version}, nil
+}
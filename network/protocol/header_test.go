@@ -51,3 +51,53 @@ func TestHeaderStatus(t *testing.T) {
 		t.Errorf("Expected %v got: %v", TSEXISTS, header.Opcode())
 	}
 }
+
+func TestHeaderV1MarshalBinary(t *testing.T) {
+	header := Header{Size: 42}
+	header.SetOpcode(ACK)
+	header.SetStatus(UNKNOWNCMD)
+	buf, _ := header.MarshalBinary()
+	if len(buf) != HEADERV1LEN || buf[0] != ACK<<4|UNKNOWNCMD<<1 {
+		t.Errorf("Failed to marshal V1 header, got %v", buf)
+	}
+	decoded := Header{}
+	if err := decoded.UnmarshalBinary(buf); err != nil {
+		t.Errorf("Failed to unmarshal V1 header: %v", err)
+	}
+	if decoded.Opcode() != ACK || decoded.Status() != UNKNOWNCMD || decoded.Len() != 42 {
+		t.Errorf("Failed to unmarshal V1 header, got %v", decoded)
+	}
+}
+
+func TestHeaderV2MarshalBinary(t *testing.T) {
+	header := Header{Version: V2, ID: 1234, Flags: 3, Size: 42}
+	header.SetOpcode(200)
+	header.SetStatus(1000)
+	buf, _ := header.MarshalBinary()
+	if len(buf) != HEADERV2LEN {
+		t.Errorf("Expected %v bytes got %v", HEADERV2LEN, len(buf))
+	}
+	decoded := Header{Version: V2}
+	if err := decoded.UnmarshalBinary(buf); err != nil {
+		t.Errorf("Failed to unmarshal V2 header: %v", err)
+	}
+	if decoded != header {
+		t.Errorf("Failed to unmarshal V2 header, expected %#v got %#v", header, decoded)
+	}
+	buf[0] = V2 + 1
+	if err := decoded.UnmarshalBinary(buf); err != UnsupportedVersionErr {
+		t.Errorf("Expected UnsupportedVersionErr got %v", err)
+	}
+}
+
+func TestHeaderV2FrameTooLarge(t *testing.T) {
+	header := Header{Version: V2, Size: 1 << 32}
+	if _, err := header.MarshalBinary(); err != FrameTooLargeErr {
+		t.Errorf("Expected FrameTooLargeErr got %v", err)
+	}
+	// V1 frames carry 64 bits sizes
+	header.Version = V1
+	if _, err := header.MarshalBinary(); err != nil {
+		t.Errorf("Failed to marshal V1 header: %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/codepr/timepipe/timeseries"
+	"strings"
+	"time"
+)
+
+// BadPatternErr is returned unmarshaling a ListPacket with a malformed pattern
+var BadPatternErr = errors.New("malformed pattern")
+
+// ListPacket asks for the keys of the series matching a glob pattern, where
+// '*' matches '/' too so that label values holding paths are matched, an
+// empty pattern matches every series
+type ListPacket struct {
+	Pattern string
+}
+
+// ListResponsePacket carries the sorted keys of the series matched by a
+// ListPacket
+type ListResponsePacket struct {
+	Keys []string
+}
+
+// InfoPacket asks for the details of a series
+type InfoPacket struct {
+	Name string
+}
+
+// InfoResponsePacket describes a series, timestamps of the first and last
+// records are 0 for empty series, Retention is in nanoseconds and Memory is
+// an estimate in bytes
+type InfoResponsePacket struct {
+	Name      string
+	Retention int64
+	Records   uint64
+	First     int64
+	Last      int64
+	Memory    uint64
+	Created   int64
+}
+
+// Match tells if a series key is matched by the pattern of the packet
+func (l *ListPacket) Match(key string) bool {
+	if l.Pattern == "" {
+		return true
+	}
+	return glob(l.Pattern, key)
+}
+
+func (l *ListPacket) UnmarshalBinary(buf []byte) error {
+	if err := readString(bytes.NewReader(buf), &l.Pattern); err != nil {
+		return err
+	}
+	if !validPattern(l.Pattern) {
+		return BadPatternErr
+	}
+	return nil
+}
+
+func (l *ListPacket) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := writeString(buf, l.Pattern); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (l *ListResponsePacket) UnmarshalBinary(buf []byte) error {
+	reader := bytes.NewReader(buf)
+	var count uint32 = 0
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	l.Keys = nil
+	for i := uint32(0); i < count; i++ {
+		var key string
+		if err := readString(reader, &key); err != nil {
+			return err
+		}
+		l.Keys = append(l.Keys, key)
+	}
+	return nil
+}
+
+func (l *ListResponsePacket) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, uint32(len(l.Keys))); err != nil {
+		return nil, err
+	}
+	for _, key := range l.Keys {
+		if err := writeString(buf, key); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (l *ListResponsePacket) String() string {
+	if len(l.Keys) == 0 {
+		return "(empty)"
+	}
+	return strings.Join(l.Keys, "\n")
+}
+
+func (i *InfoPacket) UnmarshalBinary(buf []byte) error {
+	return readString(bytes.NewReader(buf), &i.Name)
+}
+
+func (i *InfoPacket) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := writeString(buf, i.Name); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Apply answers with the details of the timeseries
+func (i *InfoPacket) Apply(ts *timeseries.TimeSeries) (*Response, error) {
+	info := &InfoResponsePacket{
+		Name:      ts.Key(),
+		Retention: ts.Retention,
+		Records:   uint64(ts.Len()),
+		Memory:    uint64(ts.MemoryUsage()),
+		Created:   ts.Created().UnixNano(),
+	}
+	if first, err := ts.First(); err == nil {
+		info.First = first.Timestamp
+	}
+	if last, err := ts.Last(); err == nil {
+		info.Last = last.Timestamp
+	}
+	return NewResponse(INFO, OK, info), nil
+}
+
+func (i *InfoResponsePacket) UnmarshalBinary(buf []byte) error {
+	reader := bytes.NewReader(buf)
+	if err := readString(reader, &i.Name); err != nil {
+		return err
+	}
+	data := []interface{}{&i.Retention, &i.Records, &i.First, &i.Last, &i.Memory, &i.Created}
+	for _, v := range data {
+		if err := binary.Read(reader, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *InfoResponsePacket) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := writeString(buf, i.Name); err != nil {
+		return nil, err
+	}
+	data := []interface{}{i.Retention, i.Records, i.First, i.Last, i.Memory, i.Created}
+	for _, v := range data {
+		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (i *InfoResponsePacket) String() string {
+	return fmt.Sprintf("name: %s\nretention: %v\nrecords: %d\nfirst: %d\nlast: %d\nmemory: %d bytes\ncreated: %s",
+		i.Name, time.Duration(i.Retention), i.Records, i.First, i.Last, i.Memory,
+		time.Unix(0, i.Created).Format(time.RFC3339))
+}
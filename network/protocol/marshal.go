@@ -28,9 +28,24 @@ package protocol
 
 import "encoding"
 
+// Response is a complete packet, the header size is set on marshaling
+// according to the payload, which may be nil
 type Response struct {
-	header  Header
-	payload encoding.BinaryMarshaler
+	Header  Header
+	Payload encoding.BinaryMarshaler
+}
+
+// NewResponse creates a response with the given opcode, status and payload
+func NewResponse(opcode byte, status uint16, payload encoding.BinaryMarshaler) *Response {
+	r := &Response{Payload: payload}
+	r.Header.SetOpcode(opcode)
+	r.Header.SetStatus(status)
+	return r
+}
+
+// NewAckResponse creates an ACK response with no payload
+func NewAckResponse(status uint16) *Response {
+	return NewResponse(ACK, status, nil)
 }
 
 func UnmarshalBinary(buf []byte, u encoding.BinaryUnmarshaler) error {
@@ -42,25 +57,19 @@ func MarshalBinary(m encoding.BinaryMarshaler) ([]byte, error) {
 }
 
 func MarshalBinaryFull(opcode uint8, m encoding.BinaryMarshaler) ([]byte, error) {
-	bytesarray, err := m.MarshalBinary()
-	if err != nil {
-		return nil, err
-	}
-	header := Header{opcode, uint64(len(bytesarray))}
-	byteshdr, err := header.MarshalBinary()
-	if err != nil {
-		return nil, err
-	}
-	return append(byteshdr, bytesarray...), err
+	return NewResponse(opcode, OK, m).MarshalBinary()
 }
 
 func (r *Response) MarshalBinary() ([]byte, error) {
-	payloadBytes, err := r.payload.MarshalBinary()
-	if err != nil {
-		return nil, err
+	var payloadBytes []byte
+	if r.Payload != nil {
+		var err error
+		if payloadBytes, err = r.Payload.MarshalBinary(); err != nil {
+			return nil, err
+		}
 	}
-	r.header.Size = uint64(len(payloadBytes))
-	headerBytes, err := r.header.MarshalBinary()
+	r.Header.Size = uint64(len(payloadBytes))
+	headerBytes, err := r.Header.MarshalBinary()
 	if err != nil {
 		return nil, err
 	}
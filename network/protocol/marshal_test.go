@@ -29,11 +29,12 @@ package protocol
 import (
 	"bytes"
 	"github.com/codepr/timepipe/timeseries"
+	"reflect"
 	"testing"
 )
 
 func TestMarshalBinaryCreate(t *testing.T) {
-	create := CreatePacket{"test-ts", 3000}
+	create := CreatePacket{Name: "test-ts", Retention: 3e9}
 	b, err := MarshalBinary(&create)
 	if err != nil {
 		t.Errorf("Failed to marshal CREATE packet. Got error %v", err)
@@ -51,6 +52,73 @@ func TestMarshalBinaryCreate(t *testing.T) {
 	}
 }
 
+func TestMarshalBinaryCreateRetention(t *testing.T) {
+	create := CreatePacket{Name: "test-ts", Retention: 1500e3}
+	b, _ := MarshalBinary(&create)
+	test := CreatePacket{}
+	if err := UnmarshalBinary(b, &test); err != nil || test.Retention != 1500e3 {
+		t.Errorf("Expected a retention of 1500us got %v (%v)", test.Retention, err)
+	}
+	// Without its trailer the retention is left in milliseconds
+	if err := UnmarshalBinary(b[:len(b)-8], &test); err != nil || test.Retention != 2e6 {
+		t.Errorf("Expected a retention of 2ms got %v (%v)", test.Retention, err)
+	}
+}
+
+func TestMarshalBinaryCreateWithLabels(t *testing.T) {
+	create := CreatePacket{
+		Name:      "cpu",
+		Retention: 3e9,
+		Labels:    timeseries.Labels{{Name: "region", Value: "eu"}, {Name: "host", Value: "a"}},
+	}
+	b, err := MarshalBinary(&create)
+	if err != nil {
+		t.Errorf("Failed to marshal CREATE packet. Got error %v", err)
+	}
+	test := CreatePacket{}
+	if err := UnmarshalBinary(b, &test); err != nil {
+		t.Errorf("Failed to unmarshal CREATE packet. Got error %v", err)
+	}
+	if test.Key() != `cpu{host="a",region="eu"}` {
+		t.Errorf("Failed to unmarshal CREATE labels, got %v", test.Key())
+	}
+	if err := UnmarshalBinary(b[:len(b)-1], &test); err == nil {
+		t.Errorf("Expected an error unmarshaling truncated labels")
+	}
+}
+
+func TestMarshalBinaryCreateWithDuplicates(t *testing.T) {
+	create := CreatePacket{Name: "test-ts", Duplicates: timeseries.DuplicateMax}
+	b, err := MarshalBinary(&create)
+	if err != nil {
+		t.Errorf("Failed to marshal CREATE packet. Got error %v", err)
+	}
+	test := CreatePacket{}
+	if err := UnmarshalBinary(b, &test); err != nil {
+		t.Errorf("Failed to unmarshal CREATE packet. Got error %v", err)
+	}
+	if test.Duplicates != timeseries.DuplicateMax || len(test.Labels) != 0 {
+		t.Errorf("Failed to unmarshal CREATE duplicate policy, got %v", test)
+	}
+	b[len(b)-1] = 0xff
+	if err := UnmarshalBinary(b, &test); err != timeseries.UnknownDuplicatePolicyErr {
+		t.Errorf("Expected UnknownDuplicatePolicyErr got %v", err)
+	}
+}
+
+func TestMarshalBinaryCreateWithCreated(t *testing.T) {
+	create := CreatePacket{Name: "test-ts", Retention: 3e9, Created: 1234567890123456789}
+	b, _ := MarshalBinary(&create)
+	test := CreatePacket{}
+	if err := UnmarshalBinary(b, &test); err != nil || !reflect.DeepEqual(test, create) {
+		t.Errorf("Failed to unmarshal CREATE creation time, got %v (%v)", test, err)
+	}
+	// Packets without it leave it unset
+	if err := UnmarshalBinary(b[:len(b)-8], &test); err != nil || test.Created != 0 {
+		t.Errorf("Expected no creation time got %v (%v)", test.Created, err)
+	}
+}
+
 func TestMarshalBinaryDelete(t *testing.T) {
 	delete := DeletePacket{"test-ts"}
 	b, err := MarshalBinary(&delete)
@@ -70,6 +138,95 @@ func TestMarshalBinaryDelete(t *testing.T) {
 	}
 }
 
+func TestMarshalBinaryDeleteRange(t *testing.T) {
+	delete := DeleteRangePacket{"test-ts", 1000, 2000}
+	b, err := MarshalBinary(&delete)
+	if err != nil {
+		t.Errorf("Failed to marshal DELETERANGE packet. Got error %v", err)
+	}
+	test := DeleteRangePacket{}
+	if err := UnmarshalBinary(b, &test); err != nil || test != delete {
+		t.Errorf("Failed to marshal DELETERANGE packet. Expected %v got %v (%v)",
+			delete, test, err)
+	}
+	if err := UnmarshalBinary(b[:len(b)-1], &test); err == nil {
+		t.Errorf("Expected an error unmarshaling a truncated DELETERANGE packet")
+	}
+}
+
+func TestMarshalBinaryDeleteRangeResponse(t *testing.T) {
+	response := DeleteRangeResponsePacket{42}
+	b, err := MarshalBinary(&response)
+	if err != nil {
+		t.Errorf("Failed to marshal DELETERANGE response. Got error %v", err)
+	}
+	test := DeleteRangeResponsePacket{}
+	if err := UnmarshalBinary(b, &test); err != nil || test != response {
+		t.Errorf("Failed to marshal DELETERANGE response. Expected %v got %v (%v)",
+			response, test, err)
+	}
+}
+
+func TestMarshalBinaryList(t *testing.T) {
+	list := ListPacket{Pattern: "cpu*"}
+	b, err := MarshalBinary(&list)
+	if err != nil {
+		t.Errorf("Failed to marshal LIST packet. Got error %v", err)
+	}
+	test := ListPacket{}
+	if err := UnmarshalBinary(b, &test); err != nil || test != list {
+		t.Errorf("Failed to marshal LIST packet. Expected %v got %v (%v)", list, test, err)
+	}
+	if !test.Match(`cpu{host="a"}`) || test.Match("mem") {
+		t.Errorf("Failed to match series keys with %v", test.Pattern)
+	}
+	b, _ = MarshalBinary(&ListPacket{Pattern: "cpu["})
+	if err := UnmarshalBinary(b, &test); err != BadPatternErr {
+		t.Errorf("Expected BadPatternErr unmarshaling a malformed pattern, got %v", err)
+	}
+	response := ListResponsePacket{Keys: []string{"cpu", "mem"}}
+	b, _ = MarshalBinary(&response)
+	testResponse := ListResponsePacket{}
+	if err := UnmarshalBinary(b, &testResponse); err != nil ||
+		!reflect.DeepEqual(testResponse, response) {
+		t.Errorf("Failed to marshal LIST response. Expected %v got %v (%v)",
+			response, testResponse, err)
+	}
+}
+
+func TestMarshalBinaryInfo(t *testing.T) {
+	ts := timeseries.NewTimeSeries("test-ts", 3e9)
+	ts.AddRecord(&timeseries.Record{Timestamp: 10, Value: 1})
+	ts.AddRecord(&timeseries.Record{Timestamp: 20, Value: 2})
+	info := InfoPacket{Name: "test-ts"}
+	b, err := MarshalBinary(&info)
+	if err != nil {
+		t.Errorf("Failed to marshal INFO packet. Got error %v", err)
+	}
+	test := InfoPacket{}
+	if err := UnmarshalBinary(b, &test); err != nil || test != info {
+		t.Errorf("Failed to marshal INFO packet. Expected %v got %v (%v)", info, test, err)
+	}
+	response, _ := info.Apply(ts)
+	b, _ = response.Payload.MarshalBinary()
+	testResponse := InfoResponsePacket{}
+	if err := UnmarshalBinary(b, &testResponse); err != nil {
+		t.Errorf("Failed to unmarshal INFO response. Got error %v", err)
+	}
+	expected := InfoResponsePacket{
+		Name:      "test-ts",
+		Retention: 3e9,
+		Records:   2,
+		First:     10,
+		Last:      20,
+		Memory:    uint64(ts.MemoryUsage()),
+		Created:   ts.Created().UnixNano(),
+	}
+	if response.Header.Opcode() != INFO || testResponse != expected {
+		t.Errorf("Failed to marshal INFO response. Expected %v got %v", expected, testResponse)
+	}
+}
+
 func TestMarshalBinaryAddPoint(t *testing.T) {
 	add := AddPointPacket{"test-ts", false, 2.29, 0}
 	b, err := MarshalBinary(&add)
@@ -90,7 +247,7 @@ func TestMarshalBinaryAddPoint(t *testing.T) {
 }
 
 func TestMarshalBinaryQuery(t *testing.T) {
-	query := QueryPacket{"test-ts", 0, [2]int64{0, 0}, 0}
+	query := QueryPacket{Name: "test-ts", Range: [2]int64{0, 0}}
 	b, err := MarshalBinary(&query)
 	if err != nil {
 		t.Errorf("Failed to marshal QUERY packet. Got error %v", err)
@@ -108,11 +265,66 @@ func TestMarshalBinaryQuery(t *testing.T) {
 	}
 }
 
+func TestMarshalBinaryQueryAggregation(t *testing.T) {
+	query := QueryPacket{
+		Name:        "test-ts",
+		Avg:         -1,
+		Aggregation: timeseries.AggStddev,
+		Interval:    60e9,
+	}
+	b, err := MarshalBinary(&query)
+	if err != nil {
+		t.Errorf("Failed to marshal QUERY packet. Got error %v", err)
+	}
+	test := QueryPacket{}
+	if err := UnmarshalBinary(b, &test); err != nil || test != query {
+		t.Errorf("Failed to marshal QUERY packet. Expected %v got %v", query, test)
+	}
+}
+
+func TestMarshalBinaryQueryNanoseconds(t *testing.T) {
+	query := QueryPacket{
+		Name:        "test-ts",
+		Avg:         1500e3,
+		Aggregation: timeseries.AggAvg,
+		Interval:    1500e3,
+	}
+	b, _ := MarshalBinary(&query)
+	test := QueryPacket{}
+	if err := UnmarshalBinary(b, &test); err != nil || test != query {
+		t.Errorf("Failed to marshal QUERY packet. Expected %v got %v", query, test)
+	}
+	// Without their trailer both are left in milliseconds
+	if err := UnmarshalBinary(b[:len(b)-16], &test); err != nil ||
+		test.Avg != 2e6 || test.Interval != 2e6 {
+		t.Errorf("Expected intervals of 2ms got %v (%v)", test, err)
+	}
+}
+
+func TestMarshalBinaryQueryQuantile(t *testing.T) {
+	query := QueryPacket{
+		Name:        "latency",
+		Range:       [2]int64{1, 2},
+		Avg:         -1,
+		Aggregation: timeseries.AggQuantile,
+		Interval:    60e9,
+		Quantile:    0.99,
+	}
+	b, err := MarshalBinary(&query)
+	if err != nil {
+		t.Errorf("Failed to marshal QUERY packet. Got error %v", err)
+	}
+	test := QueryPacket{}
+	if err := UnmarshalBinary(b, &test); err != nil || test != query {
+		t.Errorf("Failed to marshal QUERY packet. Expected %v got %v", query, test)
+	}
+}
+
 func TestMarshalBinaryQueryResponse(t *testing.T) {
 	response := QueryResponsePacket{
 		Records: []timeseries.Record{
-			timeseries.Record{21424, 98.2},
-			timeseries.Record{28732, 99.42},
+			{Timestamp: 21424, Value: 98.2},
+			{Timestamp: 28732, Value: 99.42},
 		},
 	}
 	b, err := MarshalBinary(&response)
@@ -139,3 +351,104 @@ func TestMarshalBinaryQueryResponse(t *testing.T) {
 		}
 	}
 }
+
+func TestMarshalBinaryMultiAddPoint(t *testing.T) {
+	madd := MultiAddPointPacket{}
+	madd.Add("ts-a", 1, 2.5)
+	madd.Add("ts-b", 0, 1.5)
+	madd.Add("ts-a", 2, 3.5)
+	if len(madd.Series) != 2 || len(madd.Series[0].Records) != 2 {
+		t.Fatalf("Failed to group MADDPOINT records by timeseries, got %v", madd)
+	}
+	b, err := MarshalBinary(&madd)
+	if err != nil {
+		t.Errorf("Failed to marshal MADDPOINT packet. Got error %v", err)
+	}
+	test := MultiAddPointPacket{}
+	if err := UnmarshalBinary(b, &test); err != nil {
+		t.Fatalf("Failed to unmarshal MADDPOINT packet. Got error %v", err)
+	}
+	if len(test.Series) != len(madd.Series) {
+		t.Fatalf("Failed to marshal MADDPOINT packet. Expected %v got %v",
+			madd, test)
+	}
+	for i, series := range madd.Series {
+		if test.Series[i].Name != series.Name ||
+			len(test.Series[i].Records) != len(series.Records) {
+			t.Fatalf("Failed to marshal MADDPOINT packet. Expected %v got %v",
+				madd, test)
+		}
+		for j, r := range series.Records {
+			if test.Series[i].Records[j] != r {
+				t.Errorf("Failed to marshal MADDPOINT packet. Expected %v got %v",
+					madd, test)
+			}
+		}
+	}
+	// A record count exceeding the payload must not be trusted
+	b[len(b)-20] = 0xff
+	if err := UnmarshalBinary(b, &test); err == nil {
+		t.Errorf("Expected error unmarshaling a truncated MADDPOINT packet")
+	}
+}
+
+func TestMarshalBinaryMultiAddPointTooManySeries(t *testing.T) {
+	madd := MultiAddPointPacket{Series: make([]SeriesPoints, MaxSeries+1)}
+	if _, err := madd.MarshalBinary(); err != TooManySeriesErr {
+		t.Errorf("Expected TooManySeriesErr got %v", err)
+	}
+}
+
+func TestMarshalBinaryMultiAddPointResponse(t *testing.T) {
+	response := MultiAddPointResponsePacket{[]byte{ACCEPTED, TSNOTFOUND}}
+	b, err := MarshalBinary(&response)
+	if err != nil {
+		t.Errorf("Failed to marshal MADDPOINTRESPONSE packet. Got error %v", err)
+	}
+	expected := []byte{0, 2, ACCEPTED, TSNOTFOUND}
+	if bytes.Compare(b, expected) != 0 {
+		t.Errorf("Failed to marshal MADDPOINTRESPONSE. Expected %v got %v", expected, b)
+	}
+	test := MultiAddPointResponsePacket{}
+	UnmarshalBinary(b, &test)
+	if bytes.Compare(test.Statuses, response.Statuses) != 0 {
+		t.Errorf("Failed to marshal MADDPOINTRESPONSE packet. Expected %v got %v",
+			response, test)
+	}
+}
+
+func TestMarshalBinaryError(t *testing.T) {
+	e := ErrorPacket{MALFORMEDPACKET, "bad"}
+	b, err := MarshalBinary(&e)
+	if err != nil {
+		t.Errorf("Failed to marshal ERRORRESPONSE packet. Got error %v", err)
+	}
+	expected := []byte{0, 1, 0, 3, 98, 97, 100}
+	if bytes.Compare(b, expected) != 0 {
+		t.Errorf("Failed to marshal ERRORRESPONSE. Expected %v got %v", expected, b)
+	}
+	test := ErrorPacket{}
+	UnmarshalBinary(b, &test)
+	if test != e {
+		t.Errorf("Failed to marshal ERRORRESPONSE packet. Expected %v got %v", e, test)
+	}
+}
+
+func TestMarshalBinaryMultiQueryResponse(t *testing.T) {
+	mr := MultiQueryResponsePacket{Series: []SeriesPoints{
+		{`cpu{host="a"}`, []timeseries.Record{{Timestamp: 1, Value: 2.5}}},
+		{`cpu{host="b"}`, []timeseries.Record{}},
+	}}
+	b, err := MarshalBinary(&mr)
+	if err != nil {
+		t.Errorf("Failed to marshal MULTIQUERYRESPONSE packet. Got error %v", err)
+	}
+	test := MultiQueryResponsePacket{}
+	if err := UnmarshalBinary(b, &test); err != nil {
+		t.Errorf("Failed to unmarshal MULTIQUERYRESPONSE packet. Got error %v", err)
+	}
+	if len(test.Series) != 2 || test.Series[0].Name != `cpu{host="a"}` ||
+		test.Series[0].Records[0].Value != 2.5 || len(test.Series[1].Records) != 0 {
+		t.Errorf("Failed to unmarshal MULTIQUERYRESPONSE, got %v", test)
+	}
+}
@@ -0,0 +1,189 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/codepr/timepipe/timeseries"
+	"io"
+	"math"
+)
+
+// MaxSeries is the maximum number of timeseries a MultiAddPointPacket can
+// carry, their count takes 16 bits
+const MaxSeries = math.MaxUint16
+
+var TooManySeriesErr = errors.New("too many timeseries in a single packet")
+
+// SeriesPoints carries a batch of records to be added to a single timeseries,
+// records with a 0 timestamp are stamped by the server on arrival
+type SeriesPoints struct {
+	Name    string
+	Records []timeseries.Record
+}
+
+// MultiAddPointPacket carries batches of records for one or many timeseries
+// in a single request
+type MultiAddPointPacket struct {
+	Series []SeriesPoints
+}
+
+// MultiAddPointResponsePacket carries a status for each batch of the
+// corresponding MultiAddPointPacket, in the same order
+type MultiAddPointResponsePacket struct {
+	Statuses []byte
+}
+
+// Add appends a record to the batch of the named timeseries, creating it if
+// it's not already part of the packet
+func (m *MultiAddPointPacket) Add(name string, timestamp int64, value float64) {
+	record := timeseries.Record{Timestamp: timestamp, Value: value}
+	for i := range m.Series {
+		if m.Series[i].Name == name {
+			m.Series[i].Records = append(m.Series[i].Records, record)
+			return
+		}
+	}
+	m.Series = append(m.Series, SeriesPoints{name, []timeseries.Record{record}})
+}
+
+func (s *SeriesPoints) read(r *bytes.Reader) error {
+	var nameLen uint16 = 0
+	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		return err
+	}
+	name := make([]byte, nameLen)
+	if err := binary.Read(r, binary.BigEndian, &name); err != nil {
+		return err
+	}
+	var count uint32 = 0
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	// Every record takes 16 bytes, don't trust the count blindly
+	if int64(count)*16 > int64(r.Len()) {
+		return io.ErrUnexpectedEOF
+	}
+	s.Name = string(name)
+	s.Records = make([]timeseries.Record, count)
+	return binary.Read(r, binary.BigEndian, s.Records)
+}
+
+func (s *SeriesPoints) write(buf *bytes.Buffer) error {
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(s.Name))); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, binary.BigEndian, []byte(s.Name)); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint32(len(s.Records))); err != nil {
+		return err
+	}
+	return binary.Write(buf, binary.BigEndian, s.Records)
+}
+
+func (s *SeriesPoints) UnmarshalBinary(buf []byte) error {
+	return s.read(bytes.NewReader(buf))
+}
+
+func (s *SeriesPoints) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := s.write(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Apply adds all the records of the batch to the timeseries atomically, if
+// any record is rejected the batch is answered with its status and none is
+// stored, otherwise with MERGED if any record was merged
+func (s *SeriesPoints) Apply(ts *timeseries.TimeSeries) (*Response, error) {
+	merged, err := ts.AddRecords(s.Records)
+	switch {
+	case err == timeseries.OutOfOrderErr:
+		return NewAckResponse(TOOLATE), nil
+	case err == timeseries.DuplicateErr:
+		return NewAckResponse(DUPLICATE), nil
+	case merged > 0:
+		return NewAckResponse(MERGED), nil
+	}
+	return NewAckResponse(ACCEPTED), nil
+}
+
+func (m *MultiAddPointPacket) UnmarshalBinary(buf []byte) error {
+	r := bytes.NewReader(buf)
+	var count uint16 = 0
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	m.Series = make([]SeriesPoints, count)
+	for i := range m.Series {
+		if err := m.Series[i].read(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MultiAddPointPacket) MarshalBinary() ([]byte, error) {
+	if len(m.Series) > MaxSeries {
+		return nil, TooManySeriesErr
+	}
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(m.Series))); err != nil {
+		return nil, err
+	}
+	for i := range m.Series {
+		if err := m.Series[i].write(buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *MultiAddPointResponsePacket) UnmarshalBinary(buf []byte) error {
+	r := bytes.NewReader(buf)
+	var count uint16 = 0
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	m.Statuses = make([]byte, count)
+	return binary.Read(r, binary.BigEndian, m.Statuses)
+}
+
+func (m *MultiAddPointResponsePacket) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(m.Statuses))); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, m.Statuses); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -28,12 +28,14 @@ package protocol
 
 import (
 	"bytes"
-	"encoding"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"github.com/codepr/timepipe/timeseries"
+	"math"
 )
 
+// Single record selectors, encoded in the bits 1-3 of the query flags
 const (
 	MIN   = 1
 	MAX   = 2
@@ -41,33 +43,64 @@ const (
 	LAST  = 4
 )
 
+// Counter functions, encoded in the bits 4-6 of the query flags
+const (
+	RATE       = 1
+	IRATE      = 2
+	INCREASE   = 3
+	DERIVATIVE = 4
+)
+
+// QueryPacket selects the records of one or more series, optionally reduced
+// by an aggregation in windows of Interval nanoseconds, Quantile is set only
+// with the AggQuantile aggregation and FillValue only with the FillValue
+// policy. Avg is the legacy average-only aggregation, still honored when no
+// Aggregation is set. Avg and Interval are sent in milliseconds as by
+// timeseries.Millis and, when any of them isn't a whole number of them, at
+// the end of the packet too.
 type QueryPacket struct {
-	Name  string
-	Flags byte
-	Range [2]int64
-	Avg   int64
+	Name        string
+	Flags       byte
+	Range       [2]int64
+	Avg         int64
+	Aggregation timeseries.Aggregation
+	Interval    int64
+	Quantile    float64
+	Fill        timeseries.FillPolicy
+	FillValue   float64
 }
 
 func (q *QueryPacket) Min() bool {
-	return q.Flags>>1&0x03 == MIN
+	return q.Flags>>1&0x07 == MIN
 }
 
 func (q *QueryPacket) Max() bool {
-	return q.Flags>>1&0x03 == MAX
+	return q.Flags>>1&0x07 == MAX
 }
 
 func (q *QueryPacket) First() bool {
-	return q.Flags>>1&0x03 == FIRST
+	return q.Flags>>1&0x07 == FIRST
 }
 
 func (q *QueryPacket) Last() bool {
-	return q.Flags>>1&0x03 == LAST
+	return q.Flags>>1&0x07 == LAST
+}
+
+// Counter returns the counter function of the query, 0 if none
+func (q *QueryPacket) Counter() byte {
+	return q.Flags >> 4 & 0x07
 }
 
 type QueryResponsePacket struct {
 	Records []timeseries.Record
 }
 
+// MultiQueryResponsePacket carries the records of all the series matched by
+// a selector, each one named by its key
+type MultiQueryResponsePacket struct {
+	Series []SeriesPoints
+}
+
 func (q *QueryPacket) UnmarshalBinary(buf []byte) error {
 	reader := bytes.NewReader(buf)
 	var nameLen uint16 = 0
@@ -88,7 +121,43 @@ func (q *QueryPacket) UnmarshalBinary(buf []byte) error {
 	if err := binary.Read(reader, binary.BigEndian, &q.Avg); err != nil {
 		return err
 	}
-	return nil
+	q.Avg = timeseries.Nanos(q.Avg)
+	// Older clients don't send aggregations
+	q.Aggregation, q.Interval, q.Quantile = timeseries.AggNone, 0, 0
+	q.Fill, q.FillValue = timeseries.FillNone, 0
+	if reader.Len() == 0 {
+		return nil
+	}
+	if err := binary.Read(reader, binary.BigEndian, &q.Aggregation); err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &q.Interval); err != nil {
+		return err
+	}
+	q.Interval = timeseries.Nanos(q.Interval)
+	if q.Aggregation == timeseries.AggQuantile {
+		if err := binary.Read(reader, binary.BigEndian, &q.Quantile); err != nil {
+			return err
+		}
+	}
+	if reader.Len() == 0 {
+		return nil
+	}
+	if err := binary.Read(reader, binary.BigEndian, &q.Fill); err != nil {
+		return err
+	}
+	if q.Fill == timeseries.FillValue {
+		if err := binary.Read(reader, binary.BigEndian, &q.FillValue); err != nil {
+			return err
+		}
+	}
+	if reader.Len() == 0 {
+		return nil
+	}
+	if err := binary.Read(reader, binary.BigEndian, &q.Avg); err != nil {
+		return err
+	}
+	return binary.Read(reader, binary.BigEndian, &q.Interval)
 }
 
 func (q *QueryPacket) MarshalBinary() ([]byte, error) {
@@ -106,101 +175,223 @@ func (q *QueryPacket) MarshalBinary() ([]byte, error) {
 	if err := binary.Write(buf, binary.BigEndian, q.Range); err != nil {
 		return nil, err
 	}
+	if err := binary.Write(buf, binary.BigEndian, timeseries.Millis(q.Avg)); err != nil {
+		return nil, err
+	}
+	exact := timeseries.WholeMillis(q.Avg) && timeseries.WholeMillis(q.Interval)
+	// Counter functions share the window interval of aggregations
+	if q.Aggregation == timeseries.AggNone && q.Counter() == 0 && exact {
+		return buf.Bytes(), nil
+	}
+	if err := binary.Write(buf, binary.BigEndian, q.Aggregation); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, timeseries.Millis(q.Interval)); err != nil {
+		return nil, err
+	}
+	if q.Aggregation == timeseries.AggQuantile {
+		if err := binary.Write(buf, binary.BigEndian, q.Quantile); err != nil {
+			return nil, err
+		}
+	}
+	if q.Fill == timeseries.FillNone && exact {
+		return buf.Bytes(), nil
+	}
+	if err := binary.Write(buf, binary.BigEndian, q.Fill); err != nil {
+		return nil, err
+	}
+	if q.Fill == timeseries.FillValue {
+		if err := binary.Write(buf, binary.BigEndian, q.FillValue); err != nil {
+			return nil, err
+		}
+	}
+	if exact {
+		return buf.Bytes(), nil
+	}
 	if err := binary.Write(buf, binary.BigEndian, q.Avg); err != nil {
 		return nil, err
 	}
+	if err := binary.Write(buf, binary.BigEndian, q.Interval); err != nil {
+		return nil, err
+	}
 	return buf.Bytes(), nil
 }
 
-func (q *QueryPacket) Apply(ts *timeseries.TimeSeries) (encoding.BinaryMarshaler, error) {
+func (q *QueryPacket) Apply(ts *timeseries.TimeSeries) (*Response, error) {
+	return q.ApplyContext(context.Background(), ts)
+}
+
+// ApplyContext runs the query on the timeseries, giving up with the error of
+// ctx once it's done
+func (q *QueryPacket) ApplyContext(ctx context.Context, ts *timeseries.TimeSeries) (*Response, error) {
+	qr, err := q.query(ctx, ts)
+	if err != nil {
+		return nil, err
+	}
+	return NewResponse(QUERYRESPONSE, OK, qr), nil
+}
+
+// QuerySeries runs the query on one of the series matched by a selector,
+// giving up with the error of ctx once it's done
+func (q *QueryPacket) QuerySeries(ctx context.Context, ts *timeseries.TimeSeries) (SeriesPoints, error) {
+	qr, err := q.query(ctx, ts)
+	if err != nil {
+		return SeriesPoints{}, err
+	}
+	return SeriesPoints{ts.Key(), qr.Records}, nil
+}
+
+// query runs the query on the timeseries, an empty timeseries or range is
+// answered with an empty result. Queries given up return the error of ctx,
+// the other failures are invalid queries and return a BADQUERY error packet.
+func (q *QueryPacket) query(ctx context.Context, ts *timeseries.TimeSeries) (*QueryResponsePacket, error) {
+	qr, err := q.answer(ctx, ts)
+	// Reads given up may fail with any error, or none at all
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	if err != nil {
+		return nil, &ErrorPacket{Code: BADQUERY, Message: err.Error()}
+	}
+	return qr, nil
+}
+
+func (q *QueryPacket) answer(ctx context.Context, ts *timeseries.TimeSeries) (*QueryResponsePacket, error) {
 	qr := &QueryResponsePacket{}
-	if q.Max() {
+	if q.Max() || q.Min() {
 		qr.Records = make([]timeseries.Record, 1)
-		r, err := ts.Max()
+		summary, err := ts.SummarizeContext(ctx, math.MinInt64, math.MaxInt64)
 		if err != nil {
-			return qr, nil
+			return nil, err
 		}
-		qr.Records[0] = *r
-	} else if q.Min() {
-		qr.Records = make([]timeseries.Record, 1)
-		r, err := ts.Min()
-		if err != nil {
+		if summary.Count == 0 {
 			return qr, nil
 		}
-		qr.Records[0] = *r
+		if q.Max() {
+			qr.Records[0] = summary.Max
+		} else {
+			qr.Records[0] = summary.Min
+		}
 	} else if q.First() {
 		qr.Records = make([]timeseries.Record, 1)
-		r, err := ts.First()
-		if err != nil {
-			return qr, nil
+		if r, err := ts.First(); err == nil {
+			qr.Records[0] = *r
 		}
-		qr.Records[0] = *r
 	} else if q.Last() {
 		qr.Records = make([]timeseries.Record, 1)
-		r, err := ts.Last()
+		if r, err := ts.Last(); err == nil {
+			qr.Records[0] = *r
+		}
+	} else if q.Counter() != 0 || q.Aggregation != timeseries.AggNone {
+		records, err := q.applyWindowed(ctx, ts)
+		if err == timeseries.EmptyTimeSeriesErr {
+			return qr, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		qr.Records = records
+	} else if q.Avg == 0 {
+		// Answered by the chunk summaries, only the edges of the range
+		// are decoded
+		lo, hi := q.bounds()
+		summary, err := ts.SummarizeContext(ctx, lo, hi)
 		if err != nil {
+			return nil, err
+		}
+		if summary.Count == 0 {
 			return qr, nil
 		}
-		qr.Records[0] = *r
+		qr.Records = make([]timeseries.Record, 1)
+		qr.Records[0] = timeseries.Record{
+			Timestamp: 0,
+			Value:     summary.Value(timeseries.AggAvg),
+		}
 	} else {
-		var (
-			tmp *timeseries.TimeSeries = nil
-			err error                  = nil
-		)
-		if q.Range[0] != 0 && q.Range[1] != 0 {
-			tmp, err = ts.Range(q.Range[0], q.Range[1])
-			if err != nil {
-				return qr, nil
-			}
-		} else if q.Range[0] != 0 {
-			last, err := ts.Last()
-			if err != nil {
-				return qr, nil
-			}
-			tmp, err = ts.Range(q.Range[0], last.Timestamp)
-			if err != nil {
-				return qr, nil
-			}
-		} else if q.Range[1] != 0 {
-			first, err := ts.First()
-			if err != nil {
+		lo, hi := q.bounds()
+		tmp, err := ts.RangeContext(ctx, lo, hi)
+		if err == timeseries.EmptyTimeSeriesErr {
+			return qr, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if q.Avg > 0 {
+			records, err := tmp.AverageInterval(q.Avg)
+			if err == timeseries.EmptyTimeSeriesErr {
 				return qr, nil
 			}
-			tmp, err = ts.Range(first.Timestamp, q.Range[1])
 			if err != nil {
-				return qr, nil
+				return nil, err
 			}
+			qr.Records = records
 		} else {
-			tmp = ts
+			qr.Records = tmp.Records()
 		}
-		if q.Avg == 0 {
-			val, err := tmp.Average()
-			if err != nil {
-				return qr, nil
-			}
-			qr.Records = make([]timeseries.Record, 1)
-			qr.Records[0] = timeseries.Record{Timestamp: 0, Value: val}
-		} else if q.Avg > 0 {
-			records, err := tmp.AverageInterval(q.Avg)
-			if err != nil {
-				return qr, nil
-			}
-			qr.Records = make([]timeseries.Record, len(records))
-			for i, v := range records {
-				qr.Records[i] = v
-			}
+	}
+	return qr, nil
+}
+
+// bounds returns the range of the query, a 0 bound leaves that side open
+func (q *QueryPacket) bounds() (int64, int64) {
+	lo, hi := q.Range[0], q.Range[1]
+	if lo == 0 {
+		lo = math.MinInt64
+	}
+	if hi == 0 {
+		hi = math.MaxInt64
+	}
+	return lo, hi
+}
+
+// applyWindowed runs the counter function or the aggregation of the query,
+// filling the empty windows according to the fill policy. Plain aggregations
+// are computed on the range directly, merging the chunk summaries, the others
+// need the records of the range.
+func (q *QueryPacket) applyWindowed(ctx context.Context, ts *timeseries.TimeSeries) ([]timeseries.Record, error) {
+	var (
+		records []timeseries.Record
+		err     error
+	)
+	lo, hi := q.bounds()
+	if q.Counter() != 0 || q.Aggregation == timeseries.AggQuantile {
+		tmp, err := ts.RangeContext(ctx, lo, hi)
+		if err != nil {
+			return nil, err
+		}
+		if q.Counter() != 0 {
+			records, err = q.applyCounter(ctx, tmp)
 		} else {
-			qr.Records = make([]timeseries.Record, tmp.Len())
-			for i, v := range tmp.Records {
-				qr.Records[i] = *v
-			}
+			records, err = tmp.QuantileContext(ctx, q.Quantile, q.Interval)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		records, err = ts.AggregateRangeContext(ctx, q.Aggregation, q.Interval, lo, hi)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return nil, timeseries.EmptyTimeSeriesErr
 		}
 	}
-	header := Header{}
-	header.SetOpcode(QUERYRESPONSE)
-	header.SetStatus(OK)
-	response := &Response{header, qr}
-	return response, nil
+	return timeseries.FillWindows(records, q.Interval, q.Range[0], q.Range[1],
+		q.Fill, q.FillValue)
+}
+
+func (q *QueryPacket) applyCounter(ctx context.Context, ts *timeseries.TimeSeries) ([]timeseries.Record, error) {
+	switch q.Counter() {
+	case RATE:
+		return ts.RateContext(ctx, q.Interval)
+	case IRATE:
+		return ts.IRateContext(ctx, q.Interval)
+	case INCREASE:
+		return ts.IncreaseContext(ctx, q.Interval)
+	case DERIVATIVE:
+		return ts.DerivativeContext(ctx, q.Interval)
+	}
+	return nil, nil
 }
 
 func (qr *QueryResponsePacket) UnmarshalBinary(buf []byte) error {
@@ -251,3 +442,45 @@ func (qr *QueryResponsePacket) String() string {
 	}
 	return response
 }
+
+func (m *MultiQueryResponsePacket) UnmarshalBinary(buf []byte) error {
+	r := bytes.NewReader(buf)
+	var count uint32 = 0
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	m.Series = nil
+	for i := uint32(0); i < count; i++ {
+		s := SeriesPoints{}
+		if err := s.read(r); err != nil {
+			return err
+		}
+		m.Series = append(m.Series, s)
+	}
+	return nil
+}
+
+func (m *MultiQueryResponsePacket) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, uint32(len(m.Series))); err != nil {
+		return nil, err
+	}
+	for i := range m.Series {
+		if err := m.Series[i].write(buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *MultiQueryResponsePacket) String() string {
+	if len(m.Series) == 0 {
+		return "(empty)"
+	}
+	var response string = ""
+	for _, s := range m.Series {
+		qr := QueryResponsePacket{s.Records}
+		response += fmt.Sprintf("%s\n%s", s.Name, qr.String())
+	}
+	return response
+}
@@ -26,7 +26,11 @@
 
 package protocol
 
-import "testing"
+import (
+	"github.com/codepr/timepipe/timeseries"
+	"math"
+	"testing"
+)
 
 func TestQueryFlagMin(t *testing.T) {
 	q := QueryPacket{}
@@ -63,3 +67,116 @@ func TestQueryFlagLast(t *testing.T) {
 		t.Errorf("Failed QUERY LAST flag check")
 	}
 }
+
+func TestQueryApplyAggregation(t *testing.T) {
+	ts := timeseries.NewTimeSeries("test-ts", 0)
+	for i := int64(0); i < 6; i++ {
+		ts.AddRecord(&timeseries.Record{Timestamp: i * 30e9, Value: float64(i)})
+	}
+	q := QueryPacket{
+		Name:        "test-ts",
+		Range:       [2]int64{30e9, 0},
+		Avg:         -1,
+		Aggregation: timeseries.AggSum,
+		Interval:    60e9,
+	}
+	response, _ := q.Apply(ts)
+	records := response.Payload.(*QueryResponsePacket).Records
+	expected := []timeseries.Record{{Timestamp: 0, Value: 1}, {Timestamp: 60e9, Value: 5}, {Timestamp: 120e9, Value: 9}}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %v got %v", expected, records)
+	}
+	for i := range records {
+		if records[i] != expected[i] {
+			t.Errorf("Expected %v got %v", expected, records)
+		}
+	}
+}
+
+func TestQueryFlagCounter(t *testing.T) {
+	q := QueryPacket{}
+	q.Flags = LAST<<1 | IRATE<<4
+	if !q.Last() || q.Counter() != IRATE {
+		t.Errorf("Failed QUERY counter flag check")
+	}
+}
+
+func TestQueryApplyCounter(t *testing.T) {
+	ts := timeseries.NewTimeSeries("requests", 0)
+	for i, v := range []float64{0, 10, 20, 5, 15} {
+		ts.AddRecord(&timeseries.Record{Timestamp: int64(i) * 10e9, Value: v})
+	}
+	q := QueryPacket{Name: "requests", Flags: INCREASE << 4, Avg: -1}
+	b, _ := q.MarshalBinary()
+	test := QueryPacket{}
+	if err := test.UnmarshalBinary(b); err != nil || test != q {
+		t.Fatalf("Failed to marshal QUERY with counter, got %v", test)
+	}
+	response, _ := test.Apply(ts)
+	records := response.Payload.(*QueryResponsePacket).Records
+	if len(records) != 1 || records[0].Value != 35 {
+		t.Errorf("Failed to apply INCREASE, got %v", records)
+	}
+}
+
+func TestQueryApplyFill(t *testing.T) {
+	ts := timeseries.NewTimeSeries("test-ts", 0)
+	ts.AddRecord(&timeseries.Record{Timestamp: 10e9, Value: 1})
+	ts.AddRecord(&timeseries.Record{Timestamp: 40e9, Value: 4})
+	q := QueryPacket{
+		Name:        "test-ts",
+		Range:       [2]int64{1e9, 50e9},
+		Avg:         -1,
+		Aggregation: timeseries.AggMax,
+		Interval:    10e9,
+		Fill:        timeseries.FillValue,
+		FillValue:   -1,
+	}
+	b, _ := q.MarshalBinary()
+	test := QueryPacket{}
+	if err := test.UnmarshalBinary(b); err != nil || test != q {
+		t.Fatalf("Failed to marshal QUERY with fill, got %v", test)
+	}
+	response, _ := test.Apply(ts)
+	records := response.Payload.(*QueryResponsePacket).Records
+	expected := []float64{-1, 1, -1, -1, 4, -1}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %v got %v", expected, records)
+	}
+	for i, r := range records {
+		if r.Timestamp != int64(i)*10e9 || r.Value != expected[i] {
+			t.Errorf("Expected %v got %v", expected, records)
+		}
+	}
+}
+
+func TestQueryApplyBadQuery(t *testing.T) {
+	ts := timeseries.NewTimeSeries("test-ts", 0)
+	ts.AddRecord(&timeseries.Record{Timestamp: 10e9, Value: 1})
+	tests := []QueryPacket{
+		{Name: "test-ts", Avg: -1, Aggregation: 99, Interval: 10e9},
+		{Name: "test-ts", Avg: -1, Aggregation: timeseries.AggQuantile, Quantile: 2},
+		{
+			Name:        "test-ts",
+			Range:       [2]int64{0, math.MaxInt64},
+			Avg:         -1,
+			Aggregation: timeseries.AggMax,
+			Interval:    1,
+			Fill:        timeseries.FillValue,
+		},
+	}
+	for _, q := range tests {
+		response, err := q.Apply(ts)
+		e, ok := err.(*ErrorPacket)
+		if response != nil || !ok || e.Code != BADQUERY {
+			t.Errorf("Expected %v to fail with BADQUERY, got %v (%v)", q, response, err)
+		}
+	}
+	// An empty timeseries is still answered with an empty result
+	empty := timeseries.NewTimeSeries("empty-ts", 0)
+	q := QueryPacket{Name: "empty-ts", Avg: -1, Aggregation: timeseries.AggSum, Interval: 10e9}
+	response, err := q.Apply(empty)
+	if err != nil || len(response.Payload.(*QueryResponsePacket).Records) != 0 {
+		t.Errorf("Expected an empty result, got %v (%v)", response, err)
+	}
+}
@@ -28,216 +28,885 @@ package network
 
 import (
 	"bufio"
+	"context"
 	"encoding"
+	"errors"
+	"fmt"
 	. "github.com/codepr/timepipe/network/protocol"
+	"github.com/codepr/timepipe/snapshot"
 	. "github.com/codepr/timepipe/timeseries"
+	"github.com/codepr/timepipe/wal"
 	"io"
 	"log"
 	"net"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type TimeSeriesOperation struct {
-	Conn       *net.Conn
-	TimeSeries *TimeSeries
-	Operation  TimeSeriesApplicable
-}
-
+// ServerResponse is a response to be written to a connection, if Close is set
+// the connection is closed right after
 type ServerResponse struct {
-	Conn    *net.Conn
-	Payload encoding.BinaryMarshaler
+	Response *Response
+	Close    bool
 }
 
 type TimeSeriesApplicable interface {
-	Apply(*TimeSeries) (encoding.BinaryMarshaler, error)
+	Apply(*TimeSeries) (*Response, error)
 }
 
-type Server struct {
-	protocol string
-	host     string
-	port     string
-	db       *sync.Map
-	r        chan *TimeSeriesOperation
-	w        chan *TimeSeriesOperation
+// writeOperation is an operation modifying a timeseries, logged to the
+// write-ahead log before being applied
+type writeOperation interface {
+	encoding.BinaryMarshaler
+	TimeSeriesApplicable
+}
+
+// session holds the state of a client connection, its responses are queued
+// to out and written by a goroutine of its own, so that a client slow to
+// read them only holds up its own requests. Requests tracks the ones being
+// served concurrently, inflight bounds them.
+type session struct {
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	version  byte
 	out      chan ServerResponse
+	requests sync.WaitGroup
+	inflight chan struct{}
+}
+
+const (
+	// Interval between two consecutive sweeps evicting the records out of
+	// the retention window of each timeseries
+	RetentionSweepInterval = 1 * time.Second
+	// Requests carrying larger payloads are rejected
+	MaxPayloadSize = 64 << 20
+	// Responses queued for each connection, once full the requests of the
+	// connection wait for the client to read them
+	ResponseQueueSize = 64
+	// Requests of a V2 connection served at once, the following ones
+	// wait for some of them to complete
+	MaxInflightRequests = 64
+)
+
+// Timeouts bounds the time spent serving each connection, zero values leave
+// the corresponding bound out. Idle is how long a connection can wait for its
+// next request, Read how long a request can take to be received once started
+// and Write how long a response can take to be sent, connections exceeding
+// them are closed. Query bounds the execution of each query, answered with a
+// QUERYTIMEOUT error once expired.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	Idle  time.Duration
+	Query time.Duration
+}
+
+type Server struct {
+	protocol       string
+	host           string
+	port           string
+	db             *sync.Map
+	index          *Index
+	retentionSweep time.Duration
+	walOpts        *wal.Options
+	wal            *wal.WAL
+	snapshotPath   string
+	snapshotReq    chan struct{}
+	snapshotting   int32
+	// Out-of-order window given to every timeseries, a time.Duration in
+	// nanoseconds
+	outOfOrderWindow int64
+	timeouts         Timeouts
+	// Every timeseries is guarded by its own *sync.RWMutex, removed
+	// along with the series, so that reads of a series run in parallel
+	// and writes to different series don't contend
+	locks sync.Map
+	// Serializes CREATE and DELETE so that they're logged in the same
+	// order they're applied, writes hold it for reading, so that snapshots
+	// don't miss any of them nor see them twice
+	mu sync.RWMutex
 }
 
 func NewServer(protocol, host, port string) *Server {
 	return &Server{
-		protocol: protocol,
-		host:     host,
-		port:     port,
-		db:       new(sync.Map),
-		r:        make(chan *TimeSeriesOperation),
-		w:        make(chan *TimeSeriesOperation),
-		out:      make(chan ServerResponse),
+		protocol:       protocol,
+		host:           host,
+		port:           port,
+		db:             new(sync.Map),
+		index:          NewIndex(),
+		retentionSweep: RetentionSweepInterval,
+		snapshotReq:    make(chan struct{}),
 	}
 }
 
+// EnableWAL makes the server log every CREATE, DELETE and ADD operation to a
+// write-ahead log before applying them, the log is replayed on Run to restore
+// the state preceding the last shutdown
+func (s *Server) EnableWAL(opts wal.Options) {
+	s.walOpts = &opts
+}
+
+// SetOutOfOrderWindow sets how late, with respect to the most recent record
+// of its timeseries, a record can be before being rejected with TOOLATE, 0
+// accepts any late record
+func (s *Server) SetOutOfOrderWindow(window time.Duration) {
+	s.outOfOrderWindow = int64(window)
+}
+
+// SetTimeouts sets the bounds on the time spent serving each connection
+func (s *Server) SetTimeouts(timeouts Timeouts) {
+	s.timeouts = timeouts
+}
+
+// EnableSnapshot makes the server accept SNAPSHOT requests, saving a copy of
+// all the timeseries to path, which is also restored on Run if present
+func (s *Server) EnableSnapshot(path string) {
+	s.snapshotPath = path
+}
+
 func (s *Server) Run() {
+	var walIndex uint64 = 0
+	if s.snapshotPath != "" {
+		index, err := s.restoreSnapshot()
+		if err != nil {
+			log.Fatal(err)
+		}
+		walIndex = index
+	}
+
+	if s.walOpts != nil {
+		if err := s.openWAL(walIndex); err != nil {
+			log.Fatal(err)
+		}
+		defer s.wal.Close()
+	}
+
 	l, err := net.Listen(s.protocol, s.host+":"+s.port)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer l.Close()
-
 	log.Print("Listening on " + s.host + ":" + s.port)
 
-	ch := make(chan net.Conn)
+	log.Fatal(s.Serve(l))
+}
 
-	// Start single goroutine responsible for timeseries management
-	go s.processRequests()
+// Serve accepts connections on the listener l, serving the requests of each
+// one on a dedicated goroutine. It returns when the listener fails or gets
+// closed, always closing it.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
 
-	// Start goroutine for responses
-	go func() {
-		for {
-			response := <-s.out
-			data, err := response.Payload.MarshalBinary()
-			if err != nil {
-				log.Print(err)
-				return
-			}
-			_, err = (*response.Conn).Write(data)
-			if err != nil {
-				log.Print("Error sending response")
-			}
-		}
-	}()
+	done := make(chan struct{})
+	defer close(done)
 
-	// Scale on accept
-	go func() {
-		for {
-			conn, err := l.Accept()
-			if err != nil {
-				log.Fatal(err)
-			}
-			log.Print("Connection accepted")
-			ch <- conn
-		}
-	}()
+	// Start goroutine for retention sweeps and snapshots
+	go s.maintain(done)
 
-	// And on process as well
 	for {
-		go s.serveConn(<-ch)
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		log.Print("Connection accepted")
+		go s.serveConn(conn)
 	}
 }
 
-func (s *Server) serveConn(conn net.Conn) {
-	// Handle connection close
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Fatal(err)
+// writeResponses writes the responses queued by a connection until the queue
+// is closed, once writing fails the connection is closed and the responses
+// left are discarded
+func (s *Server) writeResponses(sess *session) {
+	closed := false
+	for response := range sess.out {
+		if closed {
+			continue
 		}
-	}()
+		data, err := response.Response.MarshalBinary()
+		if err != nil {
+			log.Print("Can't marshal response:", err)
+			e := NewErrorResponse(INTERNALERROR, err.Error())
+			e.Header = response.Response.Header
+			e.Header.SetOpcode(ERRORRESPONSE)
+			data, _ = e.MarshalBinary()
+		}
+		sess.conn.SetWriteDeadline(deadline(s.timeouts.Write))
+		if _, err := sess.conn.Write(data); err != nil {
+			// The response may be partially written, the stream
+			// can't be trusted anymore
+			log.Print("Error sending response:", err)
+			response.Close = true
+		}
+		if response.Close {
+			sess.conn.Close()
+			closed = true
+		}
+	}
+}
 
+func (s *Server) serveConn(conn net.Conn) {
 	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	sess := &session{
+		conn:     conn,
+		rw:       rw,
+		version:  V1,
+		out:      make(chan ServerResponse, ResponseQueueSize),
+		inflight: make(chan struct{}, MaxInflightRequests),
+	}
+	go s.writeResponses(sess)
+	defer close(sess.out)
+	defer sess.requests.Wait()
 
 	for {
-		buf := make([]byte, 9)
-		if _, err := io.ReadAtLeast(rw, buf, 9); err != nil {
+		conn.SetReadDeadline(deadline(s.timeouts.Idle))
+		if _, err := rw.Peek(1); err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				log.Print("Closing idle connection")
+			} else {
+				log.Print("Can't read header bytes:", err)
+			}
+			conn.Close()
+			return
+		}
+		// The request started, the whole of it must be received in time
+		conn.SetReadDeadline(deadline(s.timeouts.Read))
+		buf := make([]byte, HeaderLen(sess.version))
+		if _, err := io.ReadAtLeast(rw, buf, len(buf)); err != nil {
 			log.Print("Can't read header bytes:", err)
+			conn.Close()
 			return
 		}
-		header := &Header{}
-		if err := header.UnmarshalBinary(buf); err != nil {
-			log.Print("Can't unmarshal header:", err)
+		header := &Header{Version: sess.version}
+		var (
+			payload []byte
+			err     *ErrorPacket
+		)
+		if e := header.UnmarshalBinary(buf); e != nil {
+			err = &ErrorPacket{Code: MALFORMEDPACKET, Message: e.Error()}
+		} else {
+			payload, err = s.readPayload(sess, header)
+		}
+		if err != nil {
+			// The stream can't be trusted anymore, the client gets
+			// the error and the connection is closed right after
+			log.Print("Closing connection: ", err)
+			response := NewErrorResponse(err.Code, err.Message)
+			response.Header.Version = sess.version
+			response.Header.ID = header.ID
+			sess.out <- ServerResponse{Response: response, Close: true}
 			return
 		}
-		s.handleRequest(&conn, rw, header)
+		// V2 responses carry the ID of their request, so requests are
+		// served concurrently and answered as soon as they're done. V1
+		// ones are served in order, as well as HELLO, which changes the
+		// framing of the requests following it.
+		if sess.version < V2 || header.Opcode() == HELLO {
+			s.handleRequest(sess, header, payload)
+			continue
+		}
+		sess.inflight <- struct{}{}
+		sess.requests.Add(1)
+		go func() {
+			defer sess.requests.Done()
+			s.handleRequest(sess, header, payload)
+			<-sess.inflight
+		}()
 	}
 }
 
-func (s *Server) handleRequest(conn *net.Conn,
-	rw *bufio.ReadWriter, h *Header) {
-	response := AckResponse{}
-	response.SetOpcode(ACK)
-	// Read the bytes left, a.k.a. payload of the request
+// deadline returns the time d from now, the zero time, meaning no deadline,
+// if d isn't positive
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// respond queues a response to a request, framing it with the same protocol
+// version of the request and echoing its ID, so that clients pipelining
+// requests can match responses coming back out of order
+func (s *Server) respond(sess *session, request *Header, response *Response) {
+	response.Header.Version = request.Version
+	response.Header.ID = request.ID
+	sess.out <- ServerResponse{Response: response}
+}
+
+// respondError sends an ERRORRESPONSE back to the client
+func (s *Server) respondError(sess *session, request *Header, code uint16, err error) {
+	log.Print(err)
+	s.respond(sess, request, NewErrorResponse(code, err.Error()))
+}
+
+// respondQueryError answers a failed query, invalid queries fail with their
+// own error packet and queries given up with QUERYTIMEOUT, anything else is
+// an INTERNALERROR
+func (s *Server) respondQueryError(sess *session, request *Header, err error) {
+	if e, ok := err.(*ErrorPacket); ok {
+		log.Print(e)
+		s.respond(sess, request, NewErrorResponse(e.Code, e.Message))
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		s.respondError(sess, request, QUERYTIMEOUT, fmt.Errorf("query aborted: %v", err))
+		return
+	}
+	s.respondError(sess, request, INTERNALERROR, fmt.Errorf("query failed: %v", err))
+}
+
+// readPayload reads the payload of a request, errors leave the connection
+// stream in an unknown state
+func (s *Server) readPayload(sess *session, h *Header) ([]byte, *ErrorPacket) {
+	if h.Len() > MaxPayloadSize {
+		return nil, &ErrorPacket{Code: PAYLOADTOOLARGE, Message: "payload exceeds the maximum size"}
+	}
 	buf := make([]byte, h.Len())
-	if _, err := io.ReadAtLeast(rw, buf, int(h.Len())); err != nil {
-		log.Fatal("Can't read remaining bytes left", err)
+	if _, err := io.ReadAtLeast(sess.rw, buf, int(h.Len())); err != nil {
+		return nil, &ErrorPacket{
+			Code:    TRUNCATEDPACKET,
+			Message: "can't read payload: " + err.Error(),
+		}
 	}
+	return buf, nil
+}
+
+// handleRequest dispatches a request and answers it, errors are answered
+// with an ERRORRESPONSE
+func (s *Server) handleRequest(sess *session, h *Header, buf []byte) {
 	switch h.Opcode() {
 	case CREATE:
 		create := CreatePacket{}
 		if err := UnmarshalBinary(buf, &create); err != nil {
-			log.Fatal("UnmarshalBinary:", err)
+			s.respondError(sess, h, MALFORMEDPACKET, err)
+			return
 		}
 		timeseries := NewTimeSeries(create.Name, create.Retention)
-		if _, ok := s.db.LoadOrStore(create.Name, timeseries); ok {
-			log.Println("Timeseries named " + timeseries.Name + " already exists")
-			response.SetStatus(TSEXISTS)
+		timeseries.Labels = create.Labels
+		timeseries.Duplicates = create.Duplicates
+		var status uint16 = OK
+		s.mu.Lock()
+		if _, ok := s.db.Load(timeseries.Key()); ok {
+			log.Println("Timeseries named " + timeseries.Key() + " already exists")
+			status = TSEXISTS
 		} else {
-			log.Println("Created new timeseries named " + timeseries.Name)
-			response.SetStatus(OK)
+			create.Created = timeseries.Created().UnixNano()
+			if err := s.logOperation(CREATE, &create); err != nil {
+				s.mu.Unlock()
+				s.respondError(sess, h, INTERNALERROR, err)
+				return
+			}
+			s.storeSeries(timeseries)
+			log.Println("Created new timeseries named " + timeseries.Key())
 		}
-		s.out <- ServerResponse{conn, response}
+		s.mu.Unlock()
+		s.respond(sess, h, NewAckResponse(status))
 	case DELETE:
 		delete := &DeletePacket{}
 		if err := UnmarshalBinary(buf, delete); err != nil {
-			log.Fatal("UnmarshalBinary:", err)
+			s.respondError(sess, h, MALFORMEDPACKET, err)
+			return
+		}
+		s.mu.Lock()
+		if err := s.logOperation(DELETE, delete); err != nil {
+			s.mu.Unlock()
+			s.respondError(sess, h, INTERNALERROR, err)
+			return
 		}
-		s.db.Delete(delete.Name)
+		s.deleteSeries(delete.Name)
+		s.mu.Unlock()
 		log.Println("Deleted timeseries named " + delete.Name)
-		response.SetStatus(OK)
-		s.out <- ServerResponse{conn, response}
+		s.respond(sess, h, NewAckResponse(OK))
+	case DELETERANGE:
+		delete := DeleteRangePacket{}
+		if err := UnmarshalBinary(buf, &delete); err != nil {
+			s.respondError(sess, h, MALFORMEDPACKET, err)
+			return
+		}
+		log.Println("Received DELETERANGE on " + delete.Name)
+		s.write(sess, h, delete.Name, &delete)
 	case ADDPOINT:
 		add := AddPointPacket{}
 		if err := UnmarshalBinary(buf, &add); err != nil {
-			log.Fatal("UnmarshalBinary: ", err)
+			s.respondError(sess, h, MALFORMEDPACKET, err)
+			return
 		}
 		log.Println("Received ADDPOINT on " + add.Name)
 		if add.HaveTimestamp == false {
+			add.HaveTimestamp = true
 			add.Timestamp = time.Now().UnixNano()
 		}
-		ts, ok := s.db.Load(add.Name)
-		if !ok {
-			response.SetStatus(TSNOTFOUND)
+		s.write(sess, h, add.Name, &add)
+	case MADDPOINT:
+		madd := MultiAddPointPacket{}
+		if err := UnmarshalBinary(buf, &madd); err != nil {
+			s.respondError(sess, h, MALFORMEDPACKET, err)
+			return
+		}
+		log.Printf("Received MADDPOINT on %d timeseries", len(madd.Series))
+		now := time.Now().UnixNano()
+		statuses := make([]byte, len(madd.Series))
+		for i := range madd.Series {
+			points := &madd.Series[i]
+			ts, ok := s.lookup(points.Name)
+			if !ok {
+				statuses[i] = TSNOTFOUND
+				continue
+			}
+			for j := range points.Records {
+				if points.Records[j].Timestamp == 0 {
+					points.Records[j].Timestamp = now
+				}
+			}
+			// Each batch is logged and applied under the lock of
+			// its timeseries, either all of its records are stored
+			// or none
+			response, err := s.applyWrite(ts, MADDPOINT, points)
+			if err != nil {
+				s.respondError(sess, h, INTERNALERROR, err)
+				return
+			}
+			statuses[i] = byte(response.Header.Status())
+		}
+		payload := &MultiAddPointResponsePacket{Statuses: statuses}
+		s.respond(sess, h, NewResponse(MADDPOINTRESPONSE, OK, payload))
+	case SNAPSHOT:
+		if s.snapshotPath == "" {
+			s.respond(sess, h, NewAckResponse(UNKNOWNCMD))
 		} else {
-			s.w <- &TimeSeriesOperation{conn, ts.(*TimeSeries), &add}
-			response.SetStatus(ACCEPTED)
+			s.snapshotReq <- struct{}{}
+			s.respond(sess, h, NewAckResponse(ACCEPTED))
 		}
-		s.out <- ServerResponse{conn, response}
-	case MADDPOINT:
-		log.Println("Received MADDPOINT")
-		// TODO
 	case QUERY:
 		query := QueryPacket{}
 		if err := UnmarshalBinary(buf, &query); err != nil {
-			log.Fatal("UnmarshalBinary: ", err)
+			s.respondError(sess, h, MALFORMEDPACKET, err)
+			return
+		}
+		ctx, cancel := context.Background(), func() {}
+		if s.timeouts.Query > 0 {
+			ctx, cancel = context.WithTimeout(ctx, s.timeouts.Query)
 		}
-		ts, ok := s.db.Load(query.Name)
+		defer cancel()
+		// A series key is answered with its records alone, anything
+		// else is a selector possibly matching many series
+		if ts, ok := s.lookup(query.Name); ok {
+			var response *Response
+			found, err := s.runQuery(ctx, ts, func() (err error) {
+				response, err = query.ApplyContext(ctx, ts)
+				return err
+			})
+			if err != nil {
+				s.respondQueryError(sess, h, err)
+			} else if !found {
+				s.respond(sess, h, NewAckResponse(TSNOTFOUND))
+			} else {
+				s.respond(sess, h, response)
+			}
+			break
+		}
+		selector, err := ParseSelector(query.Name)
+		if err != nil {
+			s.respond(sess, h, NewAckResponse(TSNOTFOUND))
+			break
+		}
+		// Series are locked one at a time, never holding more than
+		// one lock at once
+		response := &MultiQueryResponsePacket{}
+		for _, ts := range s.index.Select(selector) {
+			var points SeriesPoints
+			found, err := s.runQuery(ctx, ts, func() (err error) {
+				points, err = query.QuerySeries(ctx, ts)
+				return err
+			})
+			if err != nil {
+				s.respondQueryError(sess, h, err)
+				return
+			}
+			if found {
+				response.Series = append(response.Series, points)
+			}
+		}
+		if len(response.Series) == 0 {
+			s.respond(sess, h, NewAckResponse(TSNOTFOUND))
+			break
+		}
+		s.respond(sess, h, NewResponse(MULTIQUERYRESPONSE, OK, response))
+	case LIST:
+		list := ListPacket{}
+		if err := UnmarshalBinary(buf, &list); err != nil {
+			s.respondError(sess, h, MALFORMEDPACKET, err)
+			return
+		}
+		response := &ListResponsePacket{}
+		s.db.Range(func(key, value interface{}) bool {
+			if list.Match(key.(string)) {
+				response.Keys = append(response.Keys, key.(string))
+			}
+			return true
+		})
+		sort.Strings(response.Keys)
+		s.respond(sess, h, NewResponse(LIST, OK, response))
+	case INFO:
+		info := InfoPacket{}
+		if err := UnmarshalBinary(buf, &info); err != nil {
+			s.respondError(sess, h, MALFORMEDPACKET, err)
+			return
+		}
+		ts, ok := s.lookup(info.Name)
 		if !ok {
-			response := AckResponse{}
-			response.SetOpcode(QUERYRESPONSE)
-			response.SetStatus(TSNOTFOUND)
-			s.out <- ServerResponse{conn, response}
-		} else {
-			s.r <- &TimeSeriesOperation{conn, ts.(*TimeSeries), &query}
+			s.respond(sess, h, NewAckResponse(TSNOTFOUND))
+			break
+		}
+		runlock, ok := s.rlockSeries(ts)
+		if !ok {
+			s.respond(sess, h, NewAckResponse(TSNOTFOUND))
+			break
 		}
+		response, err := info.Apply(ts)
+		runlock()
+		if err != nil {
+			s.respondError(sess, h, INTERNALERROR, err)
+			return
+		}
+		s.respond(sess, h, response)
+	case HELLO:
+		hello := HelloPacket{}
+		if err := UnmarshalBinary(buf, &hello); err != nil {
+			s.respondError(sess, h, MALFORMEDPACKET, err)
+			return
+		}
+		// Agree on the latest version supported by both ends, the
+		// answer is still framed with the current one
+		version := hello.Version
+		if version > VERSION {
+			version = VERSION
+		} else if version < V1 {
+			version = V1
+		}
+		s.respond(sess, h, NewResponse(HELLO, OK, &HelloPacket{Version: version}))
+		sess.version = version
 	default:
-		response.SetStatus(UNKNOWNCMD)
-		s.out <- ServerResponse{conn, response}
-		// TODO
+		s.respond(sess, h, NewAckResponse(UNKNOWNCMD))
 	}
 }
 
-func (s *Server) processRequests() {
+// maintain runs the periodic retention sweeps and the snapshots requested,
+// one at a time. Sweeps also merge the late records buffered by the series,
+// reads merge them on the fly without modifying the series. Merging is a
+// step of its own, rewriting the chunks covering late records is far more
+// expensive than expiring, only series buffering some are locked for it.
+func (s *Server) maintain(done <-chan struct{}) {
+	sweep := time.NewTicker(s.retentionSweep)
+	defer sweep.Stop()
 	for {
 		select {
-		case r := <-s.r:
-			response, err := r.Operation.Apply(r.TimeSeries)
-			if err != nil {
-				// FIXME remove fatal, marshal error
-				log.Fatal(err)
+		case <-sweep.C:
+			s.expireRecords()
+			s.mergeLate()
+		case <-s.snapshotReq:
+			s.takeSnapshot()
+		case <-done:
+			return
+		}
+	}
+}
+
+// write applies a write operation to the series identified by key and
+// answers the request with its outcome
+func (s *Server) write(sess *session, h *Header, key string, op writeOperation) {
+	ts, ok := s.lookup(key)
+	if !ok {
+		s.respond(sess, h, NewAckResponse(TSNOTFOUND))
+		return
+	}
+	response, err := s.applyWrite(ts, h.Opcode(), op)
+	if err != nil {
+		s.respondError(sess, h, INTERNALERROR, err)
+		return
+	}
+	s.respond(sess, h, response)
+}
+
+// applyWrite logs a write operation to the write-ahead log and then applies
+// it, holding the lock of the series so that operations on the same series
+// are logged in the same order they're applied. Rejected records are logged
+// as well, replaying them rejects them again. Writes to a series deleted in
+// the meantime are answered with TSNOTFOUND.
+func (s *Server) applyWrite(ts *TimeSeries, opcode byte, op writeOperation) (*Response, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	mu, ok := s.seriesLock(ts)
+	if !ok {
+		return NewAckResponse(TSNOTFOUND), nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if err := s.logOperation(opcode, op); err != nil {
+		return nil, fmt.Errorf("WAL append: %v", err)
+	}
+	return op.Apply(ts)
+}
+
+// seriesLock returns the lock guarding a timeseries, false if the series
+// was deleted
+func (s *Server) seriesLock(ts *TimeSeries) (*sync.RWMutex, bool) {
+	mu, ok := s.locks.Load(ts)
+	if !ok {
+		return nil, false
+	}
+	return mu.(*sync.RWMutex), true
+}
+
+// rlockSeries locks a timeseries for reading and returns the function
+// unlocking it, false if the series was deleted
+func (s *Server) rlockSeries(ts *TimeSeries) (func(), bool) {
+	mu, ok := s.seriesLock(ts)
+	if !ok {
+		return nil, false
+	}
+	mu.RLock()
+	return mu.RUnlock, true
+}
+
+// runQuery runs a query on a timeseries holding its read lock, false if the
+// series was deleted. The query is expected to give up as soon as ctx is
+// done, returning its error, so that the lock is released right away.
+func (s *Server) runQuery(ctx context.Context, ts *TimeSeries, query func() error) (bool, error) {
+	runlock, ok := s.rlockSeries(ts)
+	if !ok {
+		return false, nil
+	}
+	defer runlock()
+	if err := ctx.Err(); err != nil {
+		return true, err
+	}
+	return true, query()
+}
+
+// expireRecords evicts the records out of the retention window from every
+// timeseries, returning the number of records evicted
+func (s *Server) expireRecords() int {
+	evicted := 0
+	s.db.Range(func(key, value interface{}) bool {
+		ts := value.(*TimeSeries)
+		mu, ok := s.seriesLock(ts)
+		if !ok {
+			return true
+		}
+		mu.Lock()
+		if n := ts.Expire(); n > 0 {
+			log.Printf("Expired %d records from timeseries %s", n, ts.Name)
+			evicted += n
+		}
+		mu.Unlock()
+		return true
+	})
+	return evicted
+}
+
+// mergeLate merges the late records buffered by the timeseries into their
+// chunks, the series buffering none aren't locked for writing
+func (s *Server) mergeLate() {
+	s.db.Range(func(key, value interface{}) bool {
+		ts := value.(*TimeSeries)
+		mu, ok := s.seriesLock(ts)
+		if !ok {
+			return true
+		}
+		mu.RLock()
+		pending := ts.Pending()
+		mu.RUnlock()
+		if pending > 0 {
+			mu.Lock()
+			ts.Flush()
+			mu.Unlock()
+		}
+		return true
+	})
+}
+
+// openWAL opens the write-ahead log and replays its operations starting from
+// the segment index, the ones preceding it are already restored by a snapshot
+func (s *Server) openWAL(index uint64) error {
+	w, err := wal.Open(*s.walOpts)
+	if err != nil {
+		return err
+	}
+	s.wal = w
+	n := 0
+	err = w.ReplayFrom(index, func(opcode byte, payload []byte) error {
+		n++
+		return s.replayOperation(opcode, payload)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Replayed %d operations from %s", n, s.walOpts.Dir)
+	return nil
+}
+
+// logOperation appends an operation to the write-ahead log, if enabled
+func (s *Server) logOperation(opcode byte, op encoding.BinaryMarshaler) error {
+	if s.wal == nil {
+		return nil
+	}
+	payload, err := op.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return s.wal.Append(opcode, payload)
+}
+
+// lookup returns the series identified by a key, labels of the key can be
+// in any order
+func (s *Server) lookup(key string) (*TimeSeries, bool) {
+	if ts, ok := s.db.Load(key); ok {
+		return ts.(*TimeSeries), true
+	}
+	name, labels, err := ParseSeriesKey(key)
+	if err != nil {
+		return nil, false
+	}
+	if ts, ok := s.db.Load(SeriesKey(name, labels)); ok {
+		return ts.(*TimeSeries), true
+	}
+	return nil, false
+}
+
+// storeSeries adds a series to the db and to the index of its labels
+func (s *Server) storeSeries(ts *TimeSeries) {
+	ts.OutOfOrderWindow = s.outOfOrderWindow
+	s.locks.Store(ts, new(sync.RWMutex))
+	s.db.Store(ts.Key(), ts)
+	s.index.Add(ts)
+}
+
+func (s *Server) deleteSeries(key string) {
+	if ts, ok := s.lookup(key); ok {
+		s.db.Delete(ts.Key())
+		s.index.Remove(ts.Key())
+		s.locks.Delete(ts)
+	}
+}
+
+// replayOperation applies an operation read from the write-ahead log
+func (s *Server) replayOperation(opcode byte, payload []byte) error {
+	switch opcode {
+	case CREATE:
+		create := CreatePacket{}
+		if err := UnmarshalBinary(payload, &create); err != nil {
+			return err
+		}
+		if _, ok := s.db.Load(create.Key()); !ok {
+			ts := NewTimeSeries(create.Name, create.Retention)
+			ts.Labels = create.Labels
+			ts.Duplicates = create.Duplicates
+			if create.Created != 0 {
+				ts.SetCreated(time.Unix(0, create.Created))
+			}
+			s.storeSeries(ts)
+		}
+	case DELETE:
+		delete := DeletePacket{}
+		if err := UnmarshalBinary(payload, &delete); err != nil {
+			return err
+		}
+		s.deleteSeries(delete.Name)
+	case DELETERANGE:
+		delete := DeleteRangePacket{}
+		if err := UnmarshalBinary(payload, &delete); err != nil {
+			return err
+		}
+		if ts, ok := s.lookup(delete.Name); ok {
+			delete.Apply(ts)
+		}
+	case ADDPOINT:
+		add := AddPointPacket{}
+		if err := UnmarshalBinary(payload, &add); err != nil {
+			return err
+		}
+		if ts, ok := s.lookup(add.Name); ok {
+			if _, err := add.Apply(ts); err != nil {
+				return err
 			}
-			s.out <- ServerResponse{r.Conn, response}
-		case w := <-s.w:
-			if _, err := w.Operation.Apply(w.TimeSeries); err != nil {
-				// FIXME remove fatal, marshal error
-				log.Fatal(err)
+		}
+	case MADDPOINT:
+		points := SeriesPoints{}
+		if err := UnmarshalBinary(payload, &points); err != nil {
+			return err
+		}
+		if ts, ok := s.lookup(points.Name); ok {
+			if _, err := points.Apply(ts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// takeSnapshot copies all the timeseries and saves them to disk in
+// background, writes wait for the copy to complete
+func (s *Server) takeSnapshot() {
+	if !atomic.CompareAndSwapInt32(&s.snapshotting, 0, 1) {
+		log.Println("Snapshot already in progress")
+		return
+	}
+	snap := &snapshot.Snapshot{}
+	s.mu.Lock()
+	if s.wal != nil {
+		// Operations logged from now on won't be part of the snapshot
+		index, err := s.wal.Checkpoint()
+		if err != nil {
+			s.mu.Unlock()
+			atomic.StoreInt32(&s.snapshotting, 0)
+			log.Println("Snapshot failed:", err)
+			return
+		}
+		snap.WALIndex = index
+	}
+	s.db.Range(func(key, value interface{}) bool {
+		ts := value.(*TimeSeries)
+		// Reads may be merging the late records of the series
+		if mu, ok := s.seriesLock(ts); ok {
+			mu.RLock()
+			snap.TimeSeries = append(snap.TimeSeries, ts.Clone())
+			mu.RUnlock()
+		}
+		return true
+	})
+	s.mu.Unlock()
+	go func() {
+		defer atomic.StoreInt32(&s.snapshotting, 0)
+		start := time.Now()
+		if err := snapshot.Write(s.snapshotPath, snap); err != nil {
+			log.Println("Snapshot failed:", err)
+			return
+		}
+		log.Printf("Saved %d timeseries to %s in %v",
+			len(snap.TimeSeries), s.snapshotPath, time.Since(start))
+		if s.wal != nil {
+			if err := s.wal.Truncate(snap.WALIndex); err != nil {
+				log.Println("WAL truncate failed:", err)
 			}
 		}
+	}()
+}
+
+// restoreSnapshot loads the timeseries saved by the last snapshot, if any,
+// and returns the first write-ahead log segment to replay
+func (s *Server) restoreSnapshot() (uint64, error) {
+	snap, err := snapshot.Read(s.snapshotPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	for _, ts := range snap.TimeSeries {
+		s.storeSeries(ts)
 	}
+	log.Printf("Restored %d timeseries from %s", len(snap.TimeSeries), s.snapshotPath)
+	return snap.WALIndex, nil
 }
@@ -0,0 +1,1300 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	. "github.com/codepr/timepipe/network/protocol"
+	. "github.com/codepr/timepipe/timeseries"
+	"github.com/codepr/timepipe/wal"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+func startTestServer(t *testing.T) (*Server, net.Listener) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := NewServer("tcp", "127.0.0.1", "0")
+	go s.Serve(l)
+	return s, l
+}
+
+func dialTestServer(t *testing.T, l net.Listener) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// readResponse reads a whole V1 response, returning its header and payload
+func readResponse(t *testing.T, r *bufio.Reader) (Header, []byte) {
+	return readVersionedResponse(t, r, V1)
+}
+
+func readVersionedResponse(t *testing.T, r *bufio.Reader, version byte) (Header, []byte) {
+	buf := make([]byte, HeaderLen(version))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("Failed to read response header: %v", err)
+	}
+	header := Header{Version: version}
+	if err := header.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("Failed to unmarshal response header: %v", err)
+	}
+	payload := make([]byte, header.Len())
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("Failed to read response payload: %v", err)
+	}
+	return header, payload
+}
+
+func rawFrame(opcode byte, size uint64, payload []byte) []byte {
+	frame := make([]byte, 9, 9+len(payload))
+	frame[0] = opcode << 4
+	binary.BigEndian.PutUint64(frame[1:], size)
+	return append(frame, payload...)
+}
+
+func expectError(t *testing.T, r *bufio.Reader, code uint16) {
+	header, payload := readResponse(t, r)
+	if header.Opcode() != ERRORRESPONSE {
+		t.Fatalf("Expected ERRORRESPONSE got opcode %v", header.Opcode())
+	}
+	e := ErrorPacket{}
+	if err := e.UnmarshalBinary(payload); err != nil || e.Code != code {
+		t.Errorf("Expected error code %v got %v (%v)", code, e.Code, err)
+	}
+}
+
+func expectCreate(t *testing.T, conn net.Conn, r *bufio.Reader, name string) {
+	frame, _ := MarshalBinaryFull(CREATE, &CreatePacket{Name: name})
+	conn.Write(frame)
+	header, _ := readResponse(t, r)
+	if header.Opcode() != ACK || header.Status() != OK {
+		t.Errorf("Expected CREATE to succeed, got %v", header)
+	}
+}
+
+func TestServerMalformedPayload(t *testing.T) {
+	_, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	// Name length exceeding the payload
+	conn.Write(rawFrame(CREATE, 3, []byte{0, 100, 97}))
+	expectError(t, r, MALFORMEDPACKET)
+	conn.Write(rawFrame(QUERY, 1, []byte{0xff}))
+	expectError(t, r, MALFORMEDPACKET)
+	conn.Write(rawFrame(MADDPOINT, 0, nil))
+	expectError(t, r, MALFORMEDPACKET)
+	// The connection is still usable
+	expectCreate(t, conn, r, "test-ts")
+}
+
+func TestServerTruncatedPayload(t *testing.T) {
+	_, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	conn.Write(rawFrame(ADDPOINT, 30, []byte{0, 2, 97}))
+	conn.(*net.TCPConn).CloseWrite()
+	expectError(t, r, TRUNCATEDPACKET)
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected connection to be closed, got %v", err)
+	}
+	conn.Close()
+	// The server keeps serving other clients
+	conn, r = dialTestServer(t, l)
+	defer conn.Close()
+	expectCreate(t, conn, r, "test-ts")
+}
+
+func TestServerPayloadTooLarge(t *testing.T) {
+	_, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	conn.Write(rawFrame(CREATE, 1<<62, nil))
+	expectError(t, r, PAYLOADTOOLARGE)
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected connection to be closed, got %v", err)
+	}
+}
+
+func TestServerGarbage(t *testing.T) {
+	_, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	// Whatever the server makes of it, it must either answer or close
+	// the connection, never crash
+	r.ReadByte()
+	conn.Close()
+	conn, r = dialTestServer(t, l)
+	defer conn.Close()
+	expectCreate(t, conn, r, "test-ts")
+}
+
+func TestServerUnknownOpcode(t *testing.T) {
+	_, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	conn.Write(rawFrame(15, 2, []byte{1, 2}))
+	if header, _ := readResponse(t, r); header.Opcode() != ACK || header.Status() != UNKNOWNCMD {
+		t.Errorf("Expected ACK UNKNOWNCMD got %v %v", header.Opcode(), header.Status())
+	}
+	expectCreate(t, conn, r, "test-ts")
+}
+
+// hello negotiates a protocol version, returning the one agreed
+func hello(t *testing.T, conn net.Conn, r *bufio.Reader, version byte) byte {
+	frame, _ := MarshalBinaryFull(HELLO, &HelloPacket{Version: version})
+	conn.Write(frame)
+	header, payload := readResponse(t, r)
+	if header.Opcode() != HELLO {
+		t.Fatalf("Expected HELLO got opcode %v", header.Opcode())
+	}
+	p := HelloPacket{}
+	if err := p.UnmarshalBinary(payload); err != nil {
+		t.Fatalf("Failed to unmarshal HELLO: %v", err)
+	}
+	return p.Version
+}
+
+func TestServerHelloV2(t *testing.T) {
+	_, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	if v := hello(t, conn, r, V2); v != V2 {
+		t.Fatalf("Expected version %v got %v", V2, v)
+	}
+	create := NewResponse(CREATE, OK, &CreatePacket{Name: "test-ts"})
+	create.Header.Version = V2
+	frame, _ := create.MarshalBinary()
+	conn.Write(frame)
+	header, _ := readVersionedResponse(t, r, V2)
+	if header.Opcode() != ACK || header.Status() != OK {
+		t.Errorf("Failed to create over V2, got %v %v", header.Opcode(), header.Status())
+	}
+	// Wider opcodes are answered with UNKNOWNCMD
+	unknown := NewResponse(200, OK, nil)
+	unknown.Header.Version = V2
+	frame, _ = unknown.MarshalBinary()
+	conn.Write(frame)
+	header, _ = readVersionedResponse(t, r, V2)
+	if header.Opcode() != ACK || header.Status() != UNKNOWNCMD {
+		t.Errorf("Expected UNKNOWNCMD got %v %v", header.Opcode(), header.Status())
+	}
+	// A V1 frame on a V2 connection is rejected
+	conn.Write(rawFrame(CREATE, 4, []byte{0, 2, 97, 98}))
+	header, _ = readVersionedResponse(t, r, V2)
+	if header.Opcode() != ERRORRESPONSE {
+		t.Errorf("Expected ERRORRESPONSE got %v", header.Opcode())
+	}
+}
+
+func TestServerHelloNewerClient(t *testing.T) {
+	_, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	if v := hello(t, conn, r, VERSION+1); v != VERSION {
+		t.Errorf("Expected version %v got %v", VERSION, v)
+	}
+}
+
+func TestServerV1Client(t *testing.T) {
+	_, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	expectCreate(t, conn, r, "test-ts")
+	frame, _ := MarshalBinaryFull(CREATE, &CreatePacket{Name: "test-ts"})
+	conn.Write(frame)
+	if header, _ := readResponse(t, r); header.Status() != TSEXISTS {
+		t.Errorf("Expected TSEXISTS got %v", header.Status())
+	}
+}
+
+func TestServerEchoRequestID(t *testing.T) {
+	_, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	hello(t, conn, r, V2)
+	const n = 100
+	for i := 1; i <= n; i++ {
+		request := NewResponse(CREATE, OK, &CreatePacket{Name: "test-ts"})
+		if i%2 == 0 {
+			request = NewResponse(QUERY, OK, &QueryPacket{Name: "test-ts"})
+		}
+		request.Header.Version = V2
+		request.Header.ID = uint32(i)
+		frame, _ := request.MarshalBinary()
+		conn.Write(frame)
+	}
+	seen := make(map[uint32]bool)
+	for i := 0; i < n; i++ {
+		header, _ := readVersionedResponse(t, r, V2)
+		if seen[header.ID] || header.ID < 1 || header.ID > n {
+			t.Errorf("Unexpected response ID %v", header.ID)
+		}
+		seen[header.ID] = true
+	}
+}
+
+func TestServerOutOfOrderResponses(t *testing.T) {
+	s, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	expectCreate(t, conn, r, "busy-ts")
+	expectCreate(t, conn, r, "test-ts")
+	hello(t, conn, r, V2)
+	busy, _ := s.lookup("busy-ts")
+	mu, _ := s.seriesLock(busy)
+	mu.Lock()
+	send := func(id uint32, opcode byte, m encoding.BinaryMarshaler) {
+		request := NewResponse(opcode, OK, m)
+		request.Header.Version = V2
+		request.Header.ID = id
+		frame, _ := request.MarshalBinary()
+		conn.Write(frame)
+	}
+	// The query waits for the lock of its series, the write pipelined
+	// behind it is answered first
+	send(1, QUERY, &QueryPacket{Name: "busy-ts", Avg: -1})
+	send(2, ADDPOINT, &AddPointPacket{Name: "test-ts", HaveTimestamp: true, Timestamp: 1e9})
+	header, _ := readVersionedResponse(t, r, V2)
+	if header.ID != 2 || header.Status() != ACCEPTED {
+		t.Errorf("Expected ADDPOINT to be answered first, got ID %v %v", header.ID, header.Status())
+	}
+	mu.Unlock()
+	header, _ = readVersionedResponse(t, r, V2)
+	if header.ID != 1 || header.Opcode() != QUERYRESPONSE {
+		t.Errorf("Expected the QUERY response, got ID %v opcode %v", header.ID, header.Opcode())
+	}
+}
+
+func TestServerReplayLabeledSeries(t *testing.T) {
+	s := NewServer("tcp", "127.0.0.1", "0")
+	create, _ := NewCreatePacket(`cpu{region="eu",host="a"}`, 0)
+	payload, _ := create.MarshalBinary()
+	if err := s.replayOperation(CREATE, payload); err != nil {
+		t.Fatalf("Failed to replay CREATE: %v", err)
+	}
+	add := &AddPointPacket{Name: `cpu{host="a",region="eu"}`, HaveTimestamp: true, Timestamp: 1, Value: 2}
+	payload, _ = add.MarshalBinary()
+	if err := s.replayOperation(ADDPOINT, payload); err != nil {
+		t.Fatalf("Failed to replay ADDPOINT: %v", err)
+	}
+	ts, ok := s.lookup(`cpu{region="eu",host="a"}`)
+	if !ok || ts.Len() != 1 {
+		t.Fatalf("Failed to replay labeled series")
+	}
+	selector, _ := ParseSelector(`{host="a"}`)
+	if series := s.index.Select(selector); len(series) != 1 || series[0] != ts {
+		t.Errorf("Failed to index replayed series, got %v", series)
+	}
+}
+
+func TestServerOutOfOrderWindow(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	s := NewServer("tcp", "127.0.0.1", "0")
+	s.SetOutOfOrderWindow(time.Second)
+	go s.Serve(l)
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	expectCreate(t, conn, r, "test-ts")
+	for _, c := range []struct {
+		timestamp int64
+		status    uint16
+	}{{10e9, ACCEPTED}, {9.5e9, ACCEPTED}, {8e9, TOOLATE}, {11e9, ACCEPTED}} {
+		add := &AddPointPacket{Name: "test-ts", HaveTimestamp: true, Timestamp: c.timestamp}
+		frame, _ := MarshalBinaryFull(ADDPOINT, add)
+		conn.Write(frame)
+		if header, _ := readResponse(t, r); header.Status() != c.status {
+			t.Errorf("Expected status %v adding %v got %v", c.status, c.timestamp, header.Status())
+		}
+	}
+	madd := &MultiAddPointPacket{}
+	madd.Add("test-ts", 12e9, 1)
+	madd.Add("test-ts", 1e9, 1)
+	madd.Add("missing", 1e9, 1)
+	frame, _ := MarshalBinaryFull(MADDPOINT, madd)
+	conn.Write(frame)
+	_, payload := readResponse(t, r)
+	response := MultiAddPointResponsePacket{}
+	if err := response.UnmarshalBinary(payload); err != nil {
+		t.Fatalf("Failed to unmarshal MADDPOINT response: %v", err)
+	}
+	if len(response.Statuses) != 2 || response.Statuses[0] != TOOLATE ||
+		response.Statuses[1] != TSNOTFOUND {
+		t.Errorf("Expected TOOLATE and TSNOTFOUND got %v", response.Statuses)
+	}
+	// Batches are stored atomically, the record within the window is
+	// rejected along with the late one
+	ts, _ := s.lookup("test-ts")
+	mu, _ := s.seriesLock(ts)
+	mu.RLock()
+	n := ts.Len()
+	mu.RUnlock()
+	if n != 3 {
+		t.Errorf("Expected 3 records stored got %v", n)
+	}
+}
+
+func TestServerMultiAddPointStatuses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	s := NewServer("tcp", "127.0.0.1", "0")
+	s.SetOutOfOrderWindow(time.Second)
+	go s.Serve(l)
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	for _, create := range []*CreatePacket{
+		{Name: "sum-ts", Duplicates: DuplicateSum},
+		{Name: "block-ts", Duplicates: DuplicateBlock},
+		{Name: "late-ts"},
+	} {
+		if header, _, err := exchange(conn, r, CREATE, create); err != nil || header.Status() != OK {
+			t.Fatalf("Failed to CREATE: %v (%v)", header.Status(), err)
+		}
+	}
+	type point struct {
+		name      string
+		timestamp int64
+		value     float64
+	}
+	for _, c := range []struct {
+		points   []point
+		statuses []byte
+	}{
+		{
+			[]point{{"sum-ts", 1e9, 1}, {"block-ts", 1e9, 1}, {"late-ts", 10e9, 1}},
+			[]byte{ACCEPTED, ACCEPTED, ACCEPTED},
+		},
+		{
+			[]point{{"sum-ts", 2e9, 1}, {"sum-ts", 1e9, 1}, {"block-ts", 2e9, 1},
+				{"block-ts", 1e9, 1}, {"late-ts", 11e9, 1}, {"late-ts", 5e9, 1},
+				{"missing", 1e9, 1}},
+			[]byte{MERGED, DUPLICATE, TOOLATE, TSNOTFOUND},
+		},
+	} {
+		madd := &MultiAddPointPacket{}
+		for _, p := range c.points {
+			madd.Add(p.name, p.timestamp, p.value)
+		}
+		_, payload, err := exchange(conn, r, MADDPOINT, madd)
+		response := MultiAddPointResponsePacket{}
+		if err != nil || response.UnmarshalBinary(payload) != nil {
+			t.Fatalf("Failed to MADDPOINT: %v", err)
+		}
+		if !reflect.DeepEqual(response.Statuses, c.statuses) {
+			t.Errorf("Expected statuses %v got %v", c.statuses, response.Statuses)
+		}
+	}
+	// Rejected batches leave their series untouched
+	for name, expected := range map[string]int{"sum-ts": 2, "block-ts": 1, "late-ts": 1} {
+		ts, _ := s.lookup(name)
+		mu, _ := s.seriesLock(ts)
+		mu.RLock()
+		n := ts.Len()
+		mu.RUnlock()
+		if n != expected {
+			t.Errorf("Expected %v records in %v got %v", expected, name, n)
+		}
+	}
+}
+
+func TestServerDuplicatePolicy(t *testing.T) {
+	_, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	for _, create := range []*CreatePacket{
+		{Name: "sum-ts", Duplicates: DuplicateSum},
+		{Name: "block-ts", Duplicates: DuplicateBlock},
+	} {
+		frame, _ := MarshalBinaryFull(CREATE, create)
+		conn.Write(frame)
+		if header, _ := readResponse(t, r); header.Status() != OK {
+			t.Fatalf("Expected CREATE to succeed, got %v", header)
+		}
+	}
+	for _, c := range []struct {
+		name   string
+		status uint16
+	}{{"sum-ts", ACCEPTED}, {"sum-ts", MERGED}, {"block-ts", ACCEPTED}, {"block-ts", DUPLICATE}} {
+		add := &AddPointPacket{Name: c.name, HaveTimestamp: true, Timestamp: 1e9, Value: 1}
+		frame, _ := MarshalBinaryFull(ADDPOINT, add)
+		conn.Write(frame)
+		if header, _ := readResponse(t, r); header.Status() != c.status {
+			t.Errorf("Expected status %v adding to %v got %v", c.status, c.name, header.Status())
+		}
+	}
+}
+
+func TestServerDeleteRange(t *testing.T) {
+	s, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	expectCreate(t, conn, r, "test-ts")
+	for i := 1; i <= 5; i++ {
+		add := &AddPointPacket{Name: "test-ts", HaveTimestamp: true, Timestamp: int64(i) * 1e9}
+		frame, _ := MarshalBinaryFull(ADDPOINT, add)
+		conn.Write(frame)
+		readResponse(t, r)
+	}
+	for _, c := range []struct {
+		name   string
+		status uint16
+	}{{"test-ts", OK}, {"missing", TSNOTFOUND}} {
+		frame, _ := MarshalBinaryFull(DELETERANGE, &DeleteRangePacket{Name: c.name, Start: 2e9, End: 4e9})
+		conn.Write(frame)
+		header, payload := readResponse(t, r)
+		if header.Status() != c.status {
+			t.Errorf("Expected status %v deleting from %v got %v", c.status, c.name, header.Status())
+		}
+		if c.status != OK {
+			continue
+		}
+		response := DeleteRangeResponsePacket{}
+		if err := response.UnmarshalBinary(payload); err != nil || response.Deleted != 3 {
+			t.Errorf("Expected 3 records deleted got %v (%v)", response.Deleted, err)
+		}
+	}
+	// Operations on the series are serialized, a query issued after the
+	// delete sees its outcome
+	frame, _ := MarshalBinaryFull(QUERY, &QueryPacket{Name: "test-ts", Avg: -1})
+	conn.Write(frame)
+	readResponse(t, r)
+	if ts, _ := s.lookup("test-ts"); ts.Len() != 2 {
+		t.Errorf("Expected 2 records left got %v", ts.Len())
+	}
+}
+
+func TestServerListAndInfo(t *testing.T) {
+	_, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	for _, name := range []string{"cpu-b", "cpu-a", "mem"} {
+		expectCreate(t, conn, r, name)
+	}
+	add := &AddPointPacket{Name: "cpu-a", HaveTimestamp: true, Timestamp: 1e9, Value: 1}
+	frame, _ := MarshalBinaryFull(ADDPOINT, add)
+	conn.Write(frame)
+	readResponse(t, r)
+	for pattern, expected := range map[string][]string{
+		"":      {"cpu-a", "cpu-b", "mem"},
+		"cpu-*": {"cpu-a", "cpu-b"},
+		"disk":  nil,
+	} {
+		frame, _ := MarshalBinaryFull(LIST, &ListPacket{Pattern: pattern})
+		conn.Write(frame)
+		header, payload := readResponse(t, r)
+		list := ListResponsePacket{}
+		if err := list.UnmarshalBinary(payload); err != nil || header.Opcode() != LIST {
+			t.Fatalf("Failed to unmarshal LIST response: %v", err)
+		}
+		if !reflect.DeepEqual(list.Keys, expected) {
+			t.Errorf("Expected %v listing %q got %v", expected, pattern, list.Keys)
+		}
+	}
+	frame, _ = MarshalBinaryFull(INFO, &InfoPacket{Name: "cpu-a"})
+	conn.Write(frame)
+	header, payload := readResponse(t, r)
+	info := InfoResponsePacket{}
+	if err := info.UnmarshalBinary(payload); err != nil || header.Opcode() != INFO {
+		t.Fatalf("Failed to unmarshal INFO response: %v", err)
+	}
+	if info.Name != "cpu-a" || info.Records != 1 || info.First != 1e9 || info.Last != 1e9 ||
+		info.Memory == 0 || info.Created == 0 {
+		t.Errorf("Unexpected INFO response %v", info)
+	}
+	frame, _ = MarshalBinaryFull(INFO, &InfoPacket{Name: "disk"})
+	conn.Write(frame)
+	if header, _ := readResponse(t, r); header.Status() != TSNOTFOUND {
+		t.Errorf("Expected TSNOTFOUND got %v", header.Status())
+	}
+}
+
+// exchange sends a request and reads its V1 response, unlike readResponse it
+// can be called by goroutines other than the test one
+func exchange(conn net.Conn, r *bufio.Reader, opcode byte, m encoding.BinaryMarshaler) (Header, []byte, error) {
+	frame, _ := MarshalBinaryFull(opcode, m)
+	if _, err := conn.Write(frame); err != nil {
+		return Header{}, nil, err
+	}
+	buf := make([]byte, HeaderLen(V1))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Header{}, nil, err
+	}
+	header := Header{Version: V1}
+	if err := header.UnmarshalBinary(buf); err != nil {
+		return Header{}, nil, err
+	}
+	payload := make([]byte, header.Len())
+	_, err := io.ReadFull(r, payload)
+	return header, payload, err
+}
+
+func TestServerWriteDuringRead(t *testing.T) {
+	s, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	expectCreate(t, conn, r, "busy-ts")
+	expectCreate(t, conn, r, "test-ts")
+	// A long operation holds the lock of a series, writes to the others
+	// go through meanwhile
+	busy, _ := s.lookup("busy-ts")
+	mu, _ := s.seriesLock(busy)
+	mu.Lock()
+	add := &AddPointPacket{Name: "test-ts", HaveTimestamp: true, Timestamp: 1e9}
+	if header, _, err := exchange(conn, r, ADDPOINT, add); err != nil || header.Status() != ACCEPTED {
+		t.Errorf("Expected ADDPOINT to be accepted, got %v (%v)", header.Status(), err)
+	}
+	done := make(chan error)
+	go func() {
+		c, r := dialTestServer(t, l)
+		defer c.Close()
+		_, _, err := exchange(c, r, QUERY, &QueryPacket{Name: "busy-ts", Avg: -1})
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Errorf("Expected QUERY to wait for the lock of the series")
+	case <-time.After(50 * time.Millisecond):
+	}
+	mu.Unlock()
+	if err := <-done; err != nil {
+		t.Errorf("Failed to QUERY: %v", err)
+	}
+}
+
+// newDurableServer creates a server keeping its snapshot and write-ahead log
+// in dir, restoring them like Run does
+func newDurableServer(t *testing.T, dir string) *Server {
+	s := NewServer("tcp", "127.0.0.1", "0")
+	s.EnableSnapshot(filepath.Join(dir, "snapshot"))
+	s.EnableWAL(wal.Options{Dir: filepath.Join(dir, "wal")})
+	index, err := s.restoreSnapshot()
+	if err != nil {
+		t.Fatalf("Failed to restore snapshot: %v", err)
+	}
+	if err := s.openWAL(index); err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	return s
+}
+
+func TestServerSnapshotRestore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "server")
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	s := newDurableServer(t, dir)
+	go s.Serve(l)
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	add := func(name string, timestamp int64) {
+		add := &AddPointPacket{Name: name, HaveTimestamp: true, Timestamp: timestamp, Value: 1}
+		if header, _, err := exchange(conn, r, ADDPOINT, add); err != nil || header.Status() != ACCEPTED {
+			t.Fatalf("Failed to ADDPOINT: %v (%v)", header.Status(), err)
+		}
+	}
+	expectCreate(t, conn, r, "test-ts")
+	add("test-ts", 1e9)
+	add("test-ts", 2e9)
+	if header, _, err := exchange(conn, r, SNAPSHOT, nil); err != nil || header.Status() != ACCEPTED {
+		t.Fatalf("Expected SNAPSHOT to be accepted, got %v (%v)", header.Status(), err)
+	}
+	// Operations following the snapshot are only in the write-ahead log
+	for {
+		_, err := os.Stat(filepath.Join(dir, "snapshot"))
+		if err == nil && atomic.LoadInt32(&s.snapshotting) == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	add("test-ts", 3e9)
+	expectCreate(t, conn, r, "tail-ts")
+	add("tail-ts", 1e9)
+	s.wal.Close()
+
+	restored := newDurableServer(t, dir)
+	defer restored.wal.Close()
+	for name, expected := range map[string][]int64{
+		"test-ts": {1e9, 2e9, 3e9},
+		"tail-ts": {1e9},
+	} {
+		ts, ok := restored.lookup(name)
+		if !ok {
+			t.Fatalf("Expected %v to be restored", name)
+		}
+		var timestamps []int64
+		for _, r := range ts.Records() {
+			timestamps = append(timestamps, r.Timestamp)
+		}
+		if !reflect.DeepEqual(timestamps, expected) {
+			t.Errorf("Expected %v restored in %v got %v", expected, name, timestamps)
+		}
+	}
+}
+
+func TestServerRestoreCreated(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "server")
+	defer os.RemoveAll(dir)
+	created := func(conn net.Conn, r *bufio.Reader) int64 {
+		header, payload, err := exchange(conn, r, INFO, &InfoPacket{Name: "test-ts"})
+		if err != nil || header.Opcode() != INFO {
+			t.Fatalf("Expected an INFO response, got %v (%v)", header, err)
+		}
+		info := InfoResponsePacket{}
+		if err := UnmarshalBinary(payload, &info); err != nil {
+			t.Fatalf("Failed to unmarshal INFO response: %v", err)
+		}
+		return info.Created
+	}
+	serve := func(s *Server) (net.Listener, net.Conn, *bufio.Reader) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		go s.Serve(l)
+		conn, r := dialTestServer(t, l)
+		return l, conn, r
+	}
+	s := newDurableServer(t, dir)
+	l, conn, r := serve(s)
+	expectCreate(t, conn, r, "test-ts")
+	expected := created(conn, r)
+	conn.Close()
+	l.Close()
+	s.wal.Close()
+
+	// The series is recreated by replaying the write-ahead log alone
+	time.Sleep(10 * time.Millisecond)
+	restored := newDurableServer(t, dir)
+	defer restored.wal.Close()
+	l, conn, r = serve(restored)
+	defer l.Close()
+	defer conn.Close()
+	if ctime := created(conn, r); ctime != expected {
+		t.Errorf("Expected creation time %v got %v", time.Unix(0, expected), time.Unix(0, ctime))
+	}
+}
+
+func TestServerSlowReader(t *testing.T) {
+	s, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	expectCreate(t, conn, r, "big-ts")
+	big, _ := s.lookup("big-ts")
+	mu, _ := s.seriesLock(big)
+	mu.Lock()
+	for i := int64(0); i < 1<<18; i++ {
+		big.AddRecord(&Record{Timestamp: i * 1e9, Value: float64(i)})
+	}
+	mu.Unlock()
+	// The client keeps asking for megabytes of records without reading
+	// any of them
+	slow, _ := dialTestServer(t, l)
+	defer slow.Close()
+	go func() {
+		frame, _ := MarshalBinaryFull(QUERY, &QueryPacket{Name: "big-ts", Avg: -1})
+		for i := 0; i < 4; i++ {
+			if _, err := slow.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	// Other clients are answered right away meanwhile
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < 10; i++ {
+		create := &CreatePacket{Name: "ts-" + strconv.Itoa(i)}
+		if header, _, err := exchange(conn, r, CREATE, create); err != nil || header.Status() != OK {
+			t.Fatalf("Expected CREATE to succeed, got %v (%v)", header.Status(), err)
+		}
+		add := &AddPointPacket{Name: create.Name, HaveTimestamp: true, Timestamp: 1e9}
+		if header, _, err := exchange(conn, r, ADDPOINT, add); err != nil || header.Status() != ACCEPTED {
+			t.Fatalf("Expected ADDPOINT to be accepted, got %v (%v)", header.Status(), err)
+		}
+	}
+}
+
+// TestServerConcurrentOperations runs writes, reads, deletes and snapshots
+// concurrently, meant to be run with the race detector, and checks that the
+// snapshot and the write-ahead log restore the same state
+func TestServerConcurrentOperations(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "server")
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	s := newDurableServer(t, dir)
+	s.retentionSweep = 5 * time.Millisecond
+	go s.Serve(l)
+
+	const (
+		nseries = 4
+		npoints = 200
+	)
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	for i := 0; i < nseries; i++ {
+		create := &CreatePacket{Name: "cpu", Labels: Labels{{Name: "host", Value: strconv.Itoa(i)}}}
+		if header, _, err := exchange(conn, r, CREATE, create); err != nil || header.Status() != OK {
+			t.Fatalf("Failed to CREATE: %v (%v)", header.Status(), err)
+		}
+	}
+	var wg sync.WaitGroup
+	run := func(fn func(conn net.Conn, r *bufio.Reader) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, r := dialTestServer(t, l)
+			defer conn.Close()
+			if err := fn(conn, r); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for i := 0; i < nseries; i++ {
+		name := fmt.Sprintf(`cpu{host="%d"}`, i)
+		// Pairs of records are swapped so that half of them are late
+		run(func(conn net.Conn, r *bufio.Reader) error {
+			for j := 0; j < npoints; j++ {
+				add := &AddPointPacket{Name: name, HaveTimestamp: true,
+					Timestamp: int64(j^1+1) * 1e6, Value: float64(j)}
+				if _, _, err := exchange(conn, r, ADDPOINT, add); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		run(func(conn net.Conn, r *bufio.Reader) error {
+			for j := 0; j < npoints/10; j++ {
+				query := &QueryPacket{Name: name, Avg: -1}
+				if _, _, err := exchange(conn, r, QUERY, query); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	run(func(conn net.Conn, r *bufio.Reader) error {
+		for j := 0; j < npoints/10; j++ {
+			query := &QueryPacket{Name: `{host=~".+"}`, Aggregation: AggSum, Interval: 10e6}
+			if _, _, err := exchange(conn, r, QUERY, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	run(func(conn net.Conn, r *bufio.Reader) error {
+		for j := 0; j < npoints/10; j++ {
+			madd := &MultiAddPointPacket{}
+			madd.Add("tmp-ts", int64(j+1)*1e6, 1)
+			madd.Add(`cpu{host="0"}`, int64(npoints+j+1)*1e6, 1)
+			if _, _, err := exchange(conn, r, CREATE, &CreatePacket{Name: "tmp-ts"}); err != nil {
+				return err
+			}
+			if _, _, err := exchange(conn, r, MADDPOINT, madd); err != nil {
+				return err
+			}
+			if _, _, err := exchange(conn, r, DELETE, &DeletePacket{Name: "tmp-ts"}); err != nil {
+				return err
+			}
+			if _, _, err := exchange(conn, r, SNAPSHOT, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	wg.Wait()
+	for atomic.LoadInt32(&s.snapshotting) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.wal.Close()
+
+	restored := newDurableServer(t, dir)
+	defer restored.wal.Close()
+	for i := 0; i < nseries; i++ {
+		name := fmt.Sprintf(`cpu{host="%d"}`, i)
+		expected := npoints
+		if i == 0 {
+			expected += npoints / 10
+		}
+		for _, s := range []*Server{s, restored} {
+			if ts, ok := s.lookup(name); !ok || ts.Len() != expected {
+				t.Errorf("Expected %v records in %v", expected, name)
+			}
+		}
+	}
+	if _, ok := restored.lookup("tmp-ts"); ok {
+		t.Errorf("Expected deleted series not to be restored")
+	}
+}
+
+func BenchmarkServerAddPointParallel(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	s := NewServer("tcp", "127.0.0.1", "0")
+	go s.Serve(l)
+	var n int32
+	b.RunParallel(func(pb *testing.PB) {
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		// Every goroutine writes to its own series
+		name := fmt.Sprintf("bench-ts-%d", atomic.AddInt32(&n, 1))
+		exchange(conn, r, CREATE, &CreatePacket{Name: name})
+		add := &AddPointPacket{Name: name, HaveTimestamp: true}
+		for pb.Next() {
+			add.Timestamp++
+			if _, _, err := exchange(conn, r, ADDPOINT, add); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkServerQueryParallel(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	s := NewServer("tcp", "127.0.0.1", "0")
+	go s.Serve(l)
+	ts := NewTimeSeries("bench-ts", 0)
+	for i := 0; i < 10000; i++ {
+		ts.AddRecord(&Record{Timestamp: int64(i) * 1e9, Value: float64(i)})
+	}
+	s.storeSeries(ts)
+	// Every goroutine aggregates the whole series
+	query := &QueryPacket{Name: "bench-ts", Aggregation: AggAvg, Interval: 60e9}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for pb.Next() {
+			if _, _, err := exchange(conn, r, QUERY, query); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func startTimeoutServer(t *testing.T, timeouts Timeouts) (*Server, net.Listener) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := NewServer("tcp", "127.0.0.1", "0")
+	s.SetTimeouts(timeouts)
+	go s.Serve(l)
+	return s, l
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	_, l := startTimeoutServer(t, Timeouts{Idle: 50 * time.Millisecond})
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	expectCreate(t, conn, r, "test-ts")
+	start := time.Now()
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected idle connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected connection to be closed after 50ms, got %v", elapsed)
+	}
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	_, l := startTimeoutServer(t, Timeouts{Read: 50 * time.Millisecond})
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	// Idle connections are fine, stalled requests aren't
+	time.Sleep(100 * time.Millisecond)
+	expectCreate(t, conn, r, "test-ts")
+	conn.Write(rawFrame(ADDPOINT, 30, []byte{0, 2, 97}))
+	expectError(t, r, TRUNCATEDPACKET)
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected connection to be closed, got %v", err)
+	}
+}
+
+func TestServerQueryTimeout(t *testing.T) {
+	_, l := startTimeoutServer(t, Timeouts{Query: time.Nanosecond})
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	expectCreate(t, conn, r, "test-ts")
+	create := &CreatePacket{Name: "cpu", Labels: Labels{{Name: "host", Value: "a"}}}
+	if header, _, err := exchange(conn, r, CREATE, create); err != nil || header.Status() != OK {
+		t.Fatalf("Expected CREATE to succeed, got %v (%v)", header, err)
+	}
+	// Both queries by key and by selector are aborted
+	for _, name := range []string{"test-ts", `cpu{host="a"}`, "cpu"} {
+		frame, _ := MarshalBinaryFull(QUERY, &QueryPacket{Name: name, Avg: -1})
+		conn.Write(frame)
+		expectError(t, r, QUERYTIMEOUT)
+	}
+	// The connection is still usable
+	expectCreate(t, conn, r, "other-ts")
+}
+
+func TestServerBadQuery(t *testing.T) {
+	_, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	expectCreate(t, conn, r, "test-ts")
+	create := &CreatePacket{Name: "cpu", Labels: Labels{{Name: "host", Value: "a"}}}
+	if header, _, err := exchange(conn, r, CREATE, create); err != nil || header.Status() != OK {
+		t.Fatalf("Expected CREATE to succeed, got %v (%v)", header, err)
+	}
+	for _, name := range []string{"test-ts", `cpu{host="a"}`} {
+		add := &AddPointPacket{Name: name, HaveTimestamp: true, Timestamp: 1e9, Value: 1}
+		if header, _, err := exchange(conn, r, ADDPOINT, add); err != nil || header.Status() != ACCEPTED {
+			t.Fatalf("Expected ADDPOINT to succeed, got %v (%v)", header, err)
+		}
+	}
+	// Invalid queries fail both by key and by selector
+	for _, name := range []string{"test-ts", "cpu"} {
+		query := &QueryPacket{Name: name, Avg: -1, Aggregation: AggQuantile, Quantile: 2}
+		frame, _ := MarshalBinaryFull(QUERY, query)
+		conn.Write(frame)
+		expectError(t, r, BADQUERY)
+	}
+	expectCreate(t, conn, r, "other-ts")
+}
+
+func TestServerQueryErrorCodes(t *testing.T) {
+	s := NewServer("tcp", "127.0.0.1", "0")
+	sess := &session{out: make(chan ServerResponse, 1)}
+	cases := []struct {
+		err  error
+		code uint16
+	}{
+		{&ErrorPacket{Code: BADQUERY, Message: "bad"}, BADQUERY},
+		{context.DeadlineExceeded, QUERYTIMEOUT},
+		{fmt.Errorf("read: %w", context.Canceled), QUERYTIMEOUT},
+		{errors.New("failed"), INTERNALERROR},
+	}
+	for _, c := range cases {
+		s.respondQueryError(sess, &Header{Version: V2}, c.err)
+		response := <-sess.out
+		e, ok := response.Response.Payload.(*ErrorPacket)
+		if !ok || e.Code != c.code {
+			t.Errorf("Expected code %d for %v, got %v", c.code, c.err, response.Response.Payload)
+		}
+	}
+}
+
+// expiringContext expires once its error has been checked n times, so that
+// queries give up halfway deterministically
+type expiringContext struct {
+	context.Context
+	mu sync.Mutex
+	n  int
+}
+
+func (c *expiringContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n == 0 {
+		return context.DeadlineExceeded
+	}
+	c.n--
+	return nil
+}
+
+func TestServerRunQueryTimeout(t *testing.T) {
+	s, l := startTestServer(t)
+	defer l.Close()
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	expectCreate(t, conn, r, "test-ts")
+	ts, _ := s.lookup("test-ts")
+	mu, _ := s.seriesLock(ts)
+	mu.Lock()
+	// Records spanning a few hours, queries check their context between
+	// blocks
+	for i := int64(0); i < 4*3600; i += 10 {
+		ts.AddRecord(&Record{Timestamp: i * 1e9, Value: float64(i)})
+	}
+	mu.Unlock()
+	ctx := &expiringContext{Context: context.Background(), n: 2}
+	query := &QueryPacket{Name: "test-ts", Avg: -1}
+	found, err := s.runQuery(ctx, ts, func() error {
+		_, err := query.ApplyContext(ctx, ts)
+		return err
+	})
+	if !found || err != context.DeadlineExceeded {
+		t.Fatalf("Expected the query to be aborted, got %v %v", found, err)
+	}
+	// The lock of the series is released as soon as the query gives up,
+	// writes go through right away
+	conn.SetDeadline(time.Now().Add(time.Second))
+	add := &AddPointPacket{Name: "test-ts", HaveTimestamp: true, Timestamp: 5 * 3600e9}
+	if header, _, err := exchange(conn, r, ADDPOINT, add); err != nil || header.Status() != ACCEPTED {
+		t.Errorf("Expected ADDPOINT to be accepted, got %v (%v)", header.Status(), err)
+	}
+	found, err = s.runQuery(context.Background(), ts, func() error {
+		_, err := query.ApplyContext(context.Background(), ts)
+		return err
+	})
+	if !found || err != nil {
+		t.Errorf("Expected the query to complete, got %v %v", found, err)
+	}
+}
+
+// testClock is a Clock moved forward by hand, safe for concurrent use
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestServerRetentionSweep(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	s := NewServer("tcp", "127.0.0.1", "0")
+	s.retentionSweep = 5 * time.Millisecond
+	go s.Serve(l)
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	clock := &testClock{now: time.Unix(1000, 0)}
+	for _, create := range []*CreatePacket{
+		{Name: "expiring-ts", Retention: 1e9},
+		{Name: "forever-ts"},
+	} {
+		if header, _, err := exchange(conn, r, CREATE, create); err != nil || header.Status() != OK {
+			t.Fatalf("Failed to CREATE: %v (%v)", header.Status(), err)
+		}
+		ts, _ := s.lookup(create.Name)
+		mu, _ := s.seriesLock(ts)
+		mu.Lock()
+		ts.SetClock(clock)
+		mu.Unlock()
+		for _, ago := range []time.Duration{500, 200, 0} {
+			add := &AddPointPacket{
+				Name:          create.Name,
+				HaveTimestamp: true,
+				Timestamp:     clock.Now().Add(-ago * time.Millisecond).UnixNano(),
+			}
+			if header, _, err := exchange(conn, r, ADDPOINT, add); err != nil || header.Status() != ACCEPTED {
+				t.Fatalf("Failed to ADDPOINT: %v (%v)", header.Status(), err)
+			}
+		}
+	}
+	length := func(name string) int {
+		ts, _ := s.lookup(name)
+		mu, _ := s.seriesLock(ts)
+		mu.RLock()
+		defer mu.RUnlock()
+		return ts.Len()
+	}
+	// No writes follow, only the sweep can evict the records out of the
+	// retention window
+	clock.Advance(700 * time.Millisecond)
+	for deadline := time.Now().Add(5 * time.Second); length("expiring-ts") != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the sweep to evict 1 record, %v left", length("expiring-ts"))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	clock.Advance(time.Hour)
+	for deadline := time.Now().Add(5 * time.Second); length("expiring-ts") != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the sweep to evict all records, %v left", length("expiring-ts"))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := length("forever-ts"); n != 3 {
+		t.Errorf("Expected records without retention to be kept, %v left", n)
+	}
+}
+
+func TestServerExpireRecordsCount(t *testing.T) {
+	s := NewServer("tcp", "127.0.0.1", "0")
+	clock := &testClock{now: time.Unix(1000, 0)}
+	for i, retention := range []int64{1e9, 2e9, 0} {
+		ts := NewTimeSeries("ts-"+strconv.Itoa(i), retention)
+		ts.SetClock(clock)
+		s.storeSeries(ts)
+		for j := 0; j < 3; j++ {
+			ts.AddPoint(float64(j))
+			clock.Advance(400 * time.Millisecond)
+		}
+	}
+	// The clock is at 1003.6s, all the records of ts-0, added from 1000s
+	// to 1000.8s, are out of its window, only the first of ts-1, added from
+	// 1001.2s to 1002s, is
+	if n := s.expireRecords(); n != 4 {
+		t.Errorf("Expected 4 records evicted got %v", n)
+	}
+	clock.Advance(time.Hour)
+	if n := s.expireRecords(); n != 2 {
+		t.Errorf("Expected 2 records evicted got %v", n)
+	}
+	if n := s.expireRecords(); n != 0 {
+		t.Errorf("Expected nothing left to evict got %v", n)
+	}
+}
+
+func TestServerMergeLate(t *testing.T) {
+	s := NewServer("tcp", "127.0.0.1", "0")
+	late, ordered := NewTimeSeries("late-ts", 0), NewTimeSeries("ordered-ts", 0)
+	s.storeSeries(late)
+	s.storeSeries(ordered)
+	for _, timestamp := range []int64{10e9, 5e9} {
+		late.AddRecord(&Record{Timestamp: timestamp})
+		ordered.AddRecord(&Record{Timestamp: 20e9 - timestamp})
+	}
+	// Expiring leaves late records alone, they're merged by a step of its own
+	s.expireRecords()
+	if late.Pending() != 1 {
+		t.Errorf("Expected 1 late record pending got %v", late.Pending())
+	}
+	s.mergeLate()
+	if late.Pending() != 0 || ordered.Pending() != 0 || late.Len() != 2 {
+		t.Errorf("Expected the late records merged, %v pending", late.Pending())
+	}
+}
+
+func TestServerMergeSweep(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	s := NewServer("tcp", "127.0.0.1", "0")
+	s.retentionSweep = 5 * time.Millisecond
+	go s.Serve(l)
+	conn, r := dialTestServer(t, l)
+	defer conn.Close()
+	expectCreate(t, conn, r, "test-ts")
+	for _, timestamp := range []int64{10e9, 5e9} {
+		add := &AddPointPacket{Name: "test-ts", HaveTimestamp: true, Timestamp: timestamp}
+		if header, _, err := exchange(conn, r, ADDPOINT, add); err != nil || header.Status() != ACCEPTED {
+			t.Fatalf("Failed to ADDPOINT: %v (%v)", header.Status(), err)
+		}
+	}
+	ts, _ := s.lookup("test-ts")
+	mu, _ := s.seriesLock(ts)
+	pending := func() int {
+		mu.RLock()
+		defer mu.RUnlock()
+		return ts.Pending()
+	}
+	// Late records are merged in background, queries see them anyway
+	_, payload, err := exchange(conn, r, QUERY, &QueryPacket{Name: "test-ts", Avg: -1})
+	response := QueryResponsePacket{}
+	if err != nil || response.UnmarshalBinary(payload) != nil {
+		t.Fatalf("Failed to QUERY: %v", err)
+	}
+	if len(response.Records) != 2 || response.Records[0].Timestamp != 5e9 {
+		t.Errorf("Expected the late record first got %v", response.Records)
+	}
+	for deadline := time.Now().Add(5 * time.Second); pending() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the sweep to merge the late records, %v pending", pending())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if ts.Len() != 2 {
+		t.Errorf("Expected 2 records got %v", ts.Len())
+	}
+}
@@ -0,0 +1,184 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package snapshot saves and restores point-in-time copies of the whole set
+// of timeseries to a single versioned file.
+//
+// The file starts with a magic string and the format version, followed by
+// the index of the first write-ahead log segment not included in the
+// snapshot, the timeseries and a trailing crc32 of the whole content.
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/codepr/timepipe/timeseries"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Version 2 adds the labels of the timeseries and version 3 their duplicate
+// policy, older snapshots are still readable
+const (
+	magic   = "TPSNAP"
+	Version = 3
+)
+
+var (
+	BadMagicErr           = errors.New("not a timepipe snapshot")
+	UnsupportedVersionErr = errors.New("unsupported snapshot version")
+	ChecksumMismatchErr   = errors.New("snapshot checksum mismatch")
+)
+
+// Snapshot is a point-in-time copy of a set of timeseries, WALIndex is the
+// first write-ahead log segment holding operations following the snapshot
+type Snapshot struct {
+	Version    uint16
+	WALIndex   uint64
+	TimeSeries []*timeseries.TimeSeries
+}
+
+func (s *Snapshot) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteString(magic)
+	data := []interface{}{
+		uint16(Version),
+		s.WALIndex,
+		uint32(len(s.TimeSeries)),
+	}
+	for _, v := range data {
+		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	for _, ts := range s.TimeSeries {
+		b, err := ts.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buf, binary.BigEndian, uint32(len(b))); err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+	crc := crc32.ChecksumIEEE(buf.Bytes())
+	if err := binary.Write(buf, binary.BigEndian, crc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *Snapshot) UnmarshalBinary(buf []byte) error {
+	if len(buf) < len(magic)+4 || string(buf[:len(magic)]) != magic {
+		return BadMagicErr
+	}
+	content, crc := buf[:len(buf)-4], buf[len(buf)-4:]
+	if crc32.ChecksumIEEE(content) != binary.BigEndian.Uint32(crc) {
+		return ChecksumMismatchErr
+	}
+	reader := bytes.NewReader(content[len(magic):])
+	if err := binary.Read(reader, binary.BigEndian, &s.Version); err != nil {
+		return err
+	}
+	if s.Version < 1 || s.Version > Version {
+		return UnsupportedVersionErr
+	}
+	var count uint32
+	for _, v := range []interface{}{&s.WALIndex, &count} {
+		if err := binary.Read(reader, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	s.TimeSeries = make([]*timeseries.TimeSeries, count)
+	for i := range s.TimeSeries {
+		var size uint32
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			return err
+		}
+		b := make([]byte, size)
+		if err := binary.Read(reader, binary.BigEndian, &b); err != nil {
+			return err
+		}
+		ts := &timeseries.TimeSeries{}
+		if err := ts.UnmarshalBinary(b); err != nil {
+			return err
+		}
+		s.TimeSeries[i] = ts
+	}
+	return nil
+}
+
+// Write saves the snapshot to path atomically, the file is first written
+// to a temporary file in the same directory and then renamed
+func Write(path string, s *Snapshot) error {
+	b, err := s.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	// Persist the rename as well
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Read loads the snapshot stored at path
+func Read(path string) (*Snapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{}
+	if err := s.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
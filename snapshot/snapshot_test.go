@@ -0,0 +1,80 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package snapshot
+
+import (
+	"github.com/codepr/timepipe/timeseries"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotWriteRead(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snapshot")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "timepipe.snapshot")
+	ts1 := timeseries.NewTimeSeries("ts-1", 3000)
+	ts1.Labels = timeseries.Labels{{Name: "host", Value: "a"}}
+	ts1.AddRecord(&timeseries.Record{Timestamp: 1, Value: 2.4})
+	ts1.AddRecord(&timeseries.Record{Timestamp: 2, Value: 2.6})
+	ts2 := timeseries.NewTimeSeries("ts-2", 0)
+	s := &Snapshot{WALIndex: 12, TimeSeries: []*timeseries.TimeSeries{ts1, ts2}}
+	if err := Write(path, s); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	test, err := Read(path)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	if test.Version != Version || test.WALIndex != 12 || len(test.TimeSeries) != 2 {
+		t.Fatalf("Failed to read snapshot, got %v", test)
+	}
+	if test.TimeSeries[0].Name != "ts-1" || test.TimeSeries[0].Len() != 2 ||
+		test.TimeSeries[1].Name != "ts-2" || test.TimeSeries[1].Len() != 0 {
+		t.Errorf("Failed to read snapshot timeseries")
+	}
+	if test.TimeSeries[0].Key() != `ts-1{host="a"}` {
+		t.Errorf("Failed to read snapshot labels, got %v", test.TimeSeries[0].Key())
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected temporary files to be removed, got %v files", len(files))
+	}
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	s := &Snapshot{TimeSeries: []*timeseries.TimeSeries{timeseries.NewTimeSeries("ts", 0)}}
+	b, _ := s.MarshalBinary()
+	b[len(b)-6] ^= 0xff
+	if err := (&Snapshot{}).UnmarshalBinary(b); err != ChecksumMismatchErr {
+		t.Errorf("Expected checksum mismatch, got %v", err)
+	}
+	if err := (&Snapshot{}).UnmarshalBinary([]byte("garbage-data")); err != BadMagicErr {
+		t.Errorf("Expected bad magic, got %v", err)
+	}
+}
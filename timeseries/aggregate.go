@@ -0,0 +1,246 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+)
+
+// Aggregation is a function reducing the records of a window to a value
+type Aggregation byte
+
+const (
+	AggNone Aggregation = iota
+	AggAvg
+	AggSum
+	AggCount
+	AggMin
+	AggMax
+	AggFirst
+	AggLast
+	AggStddev
+	AggVariance
+	// AggQuantile needs the quantile to compute, see Quantile
+	AggQuantile
+)
+
+var (
+	UnknownAggregationErr = errors.New("unknown aggregation")
+	InvalidIntervalErr    = errors.New("interval must be positive")
+)
+
+var aggregationNames = map[Aggregation]string{
+	AggAvg:      "AVG",
+	AggSum:      "SUM",
+	AggCount:    "COUNT",
+	AggMin:      "MIN",
+	AggMax:      "MAX",
+	AggFirst:    "FIRST",
+	AggLast:     "LAST",
+	AggStddev:   "STDDEV",
+	AggVariance: "VARIANCE",
+}
+
+// ParseAggregation returns the aggregation named, case insensitive
+func ParseAggregation(name string) (Aggregation, error) {
+	name = strings.ToUpper(name)
+	for agg, n := range aggregationNames {
+		if n == name {
+			return agg, nil
+		}
+	}
+	return AggNone, UnknownAggregationErr
+}
+
+func (a Aggregation) String() string {
+	if a == AggQuantile {
+		return "QUANTILE"
+	}
+	return aggregationNames[a]
+}
+
+// window accumulates the records of a window, variance is computed with the
+// Welford's online algorithm to avoid cancellation errors
+type window struct {
+	Summary
+	start     int64
+	quantiles *QuantileSketch
+}
+
+func (w *window) reset(start int64, quantiles bool) {
+	*w = window{start: start}
+	if quantiles {
+		w.quantiles = NewQuantileSketch()
+	}
+}
+
+func (w *window) add(record Record) {
+	if w.quantiles != nil {
+		w.quantiles.Add(record.Value)
+	}
+	w.Add(record)
+}
+
+// Aggregate reduces the records in fixed windows of interval nanoseconds,
+// aligned to multiples of the interval, in a single pass. Each window is
+// returned as a record timestamped with its start, empty windows are skipped.
+// A non positive interval aggregates all the records in a single window
+// starting at the first record.
+func (ts *TimeSeries) Aggregate(agg Aggregation, interval int64) ([]Record, error) {
+	return ts.AggregateRange(agg, interval, math.MinInt64, math.MaxInt64)
+}
+
+// AggregateRange is like Aggregate but only reduces the records between lo
+// and hi included. Blocks and chunks falling entirely in a window are merged
+// through their summaries, so only the chunks straddling a bound or a window
+// edge are decoded.
+func (ts *TimeSeries) AggregateRange(agg Aggregation, interval, lo, hi int64) ([]Record, error) {
+	return ts.AggregateRangeContext(context.Background(), agg, interval, lo, hi)
+}
+
+// AggregateRangeContext is like AggregateRange but gives up with the error of
+// ctx once it's done
+func (ts *TimeSeries) AggregateRangeContext(ctx context.Context, agg Aggregation,
+	interval, lo, hi int64) ([]Record, error) {
+	if _, ok := aggregationNames[agg]; !ok {
+		return nil, UnknownAggregationErr
+	}
+	return ts.aggregate(ctx, interval, lo, hi, false, func(w *window) float64 {
+		return w.Value(agg)
+	})
+}
+
+// Quantile returns the q-quantile of the records in windows of interval
+// nanoseconds, windows are the same of Aggregate. Quantiles are exact for
+// small windows and estimated for larger ones.
+func (ts *TimeSeries) Quantile(q float64, interval int64) ([]Record, error) {
+	return ts.QuantileContext(context.Background(), q, interval)
+}
+
+// QuantileContext is like Quantile but gives up with the error of ctx once
+// it's done
+func (ts *TimeSeries) QuantileContext(ctx context.Context, q float64, interval int64) ([]Record, error) {
+	if !(q >= 0 && q <= 1) {
+		return nil, InvalidQuantileErr
+	}
+	return ts.aggregate(ctx, interval, math.MinInt64, math.MaxInt64, true,
+		func(w *window) float64 {
+			return w.quantiles.Quantile(q)
+		})
+}
+
+func (ts *TimeSeries) aggregate(ctx context.Context, interval, lo, hi int64, quantiles bool,
+	value func(*window) float64) ([]Record, error) {
+	if ts.size == 0 {
+		return nil, EmptyTimeSeriesErr
+	}
+	windowStart := func(t int64) int64 {
+		if interval > 0 {
+			return floorDiv(t, interval) * interval
+		}
+		return t
+	}
+	result := make([]Record, 0)
+	w := &window{}
+	// Moves to the window of the timestamp t, emitting the current one if
+	// it's over
+	next := func(t int64) {
+		start := windowStart(t)
+		if w.Count == 0 {
+			w.reset(start, quantiles)
+		} else if interval > 0 && start != w.start {
+			result = append(result, Record{w.start, value(w)})
+			w.reset(start, quantiles)
+		}
+	}
+	// Sketches can't be merged from summaries, they need every value
+	summarized := func(minT, maxT int64) bool {
+		return !quantiles && minT >= lo && maxT <= hi &&
+			(interval <= 0 || windowStart(minT) == windowStart(maxT))
+	}
+	add := func(record Record) {
+		if record.Timestamp >= lo && record.Timestamp <= hi {
+			next(record.Timestamp)
+			w.add(record)
+		}
+	}
+	err := ts.spans(ctx, func(b *block, late []Record) error {
+		// Summaries don't account for late records not merged yet
+		if len(late) > 0 {
+			it := spanIterator(ctx, b, late)
+			for it.Next() {
+				add(it.At())
+			}
+			return it.Err()
+		}
+		if b.maxT() < lo || b.minT() > hi {
+			return nil
+		}
+		if summarized(b.minT(), b.maxT()) {
+			next(b.minT())
+			w.Merge(&b.summary)
+			return nil
+		}
+		for _, c := range b.chunks {
+			if c.count == 0 || c.maxT() < lo || c.minT > hi {
+				continue
+			}
+			if summarized(c.minT, c.maxT()) {
+				next(c.minT)
+				w.Merge(&c.summary)
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			it := c.iterator()
+			for it.Next() {
+				add(it.At())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if w.Count > 0 {
+		result = append(result, Record{w.start, value(w)})
+	}
+	return result, nil
+}
+
+// floorDiv divides rounding towards negative infinity
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
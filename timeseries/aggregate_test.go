@@ -0,0 +1,129 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"math"
+	"testing"
+)
+
+func newAggregateSeries() *TimeSeries {
+	ts := NewTimeSeries("test-ts", 0)
+	// Three windows of 60 seconds, the last one with a single record
+	values := map[int64]float64{
+		0: 2, 10: 4, 59: 4, 60: 4, 90: 5, 119: 7, 125: 9,
+	}
+	for _, s := range []int64{0, 10, 59, 60, 90, 119, 125} {
+		ts.AddRecord(&Record{s * 1e9, values[s]})
+	}
+	return ts
+}
+
+func TestTimeSeriesAggregate(t *testing.T) {
+	ts := newAggregateSeries()
+	cases := map[Aggregation][]float64{
+		AggAvg:      {10.0 / 3, 16.0 / 3, 9},
+		AggSum:      {10, 16, 9},
+		AggCount:    {3, 3, 1},
+		AggMin:      {2, 4, 9},
+		AggMax:      {4, 7, 9},
+		AggFirst:    {2, 4, 9},
+		AggLast:     {4, 7, 9},
+		AggVariance: {8.0 / 9, 14.0 / 9, 0},
+		AggStddev:   {math.Sqrt(8.0 / 9), math.Sqrt(14.0 / 9), 0},
+	}
+	for agg, expected := range cases {
+		records, err := ts.Aggregate(agg, 60e9)
+		if err != nil {
+			t.Fatalf("Failed to aggregate %v: %v", agg, err)
+		}
+		if len(records) != len(expected) {
+			t.Fatalf("Expected %v windows for %v got %v", len(expected), agg, records)
+		}
+		for i, r := range records {
+			if r.Timestamp != int64(i)*60e9 || math.Abs(r.Value-expected[i]) > 1e-9 {
+				t.Errorf("Wrong %v window %v, expected %v got %v", agg, i, expected[i], r)
+			}
+		}
+	}
+}
+
+func TestTimeSeriesAggregateSkipsEmptyWindows(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	ts.AddRecord(&Record{-1e9, 1})
+	ts.AddRecord(&Record{5e9, 2})
+	ts.AddRecord(&Record{35e9, 3})
+	records, _ := ts.Aggregate(AggCount, 10e9)
+	expected := []Record{{-10e9, 1}, {0, 1}, {30e9, 1}}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %v got %v", expected, records)
+	}
+	for i := range records {
+		if records[i] != expected[i] {
+			t.Errorf("Expected %v got %v", expected, records)
+		}
+	}
+}
+
+func TestTimeSeriesAggregateAll(t *testing.T) {
+	ts := newAggregateSeries()
+	records, err := ts.Aggregate(AggSum, 0)
+	if err != nil || len(records) != 1 || records[0] != (Record{0, 35}) {
+		t.Errorf("Failed to aggregate all records, got %v %v", records, err)
+	}
+	if _, err := NewTimeSeries("empty", 0).Aggregate(AggSum, 0); err != EmptyTimeSeriesErr {
+		t.Errorf("Expected EmptyTimeSeriesErr got %v", err)
+	}
+	if _, err := ts.Aggregate(AggNone, 0); err != UnknownAggregationErr {
+		t.Errorf("Expected UnknownAggregationErr got %v", err)
+	}
+}
+
+func TestParseAggregation(t *testing.T) {
+	for agg, name := range aggregationNames {
+		if parsed, err := ParseAggregation(name); err != nil || parsed != agg {
+			t.Errorf("Failed to parse aggregation %v", name)
+		}
+	}
+	if agg, err := ParseAggregation("stddev"); err != nil || agg != AggStddev {
+		t.Errorf("Failed to parse lower case aggregation")
+	}
+	if _, err := ParseAggregation("MEDIAN"); err != UnknownAggregationErr {
+		t.Errorf("Expected UnknownAggregationErr got %v", err)
+	}
+}
+
+func BenchmarkTimeSeriesAggregate(b *testing.B) {
+	ts := NewTimeSeries("test-ts", 0)
+	for i := 0; i < 100000; i++ {
+		ts.AddRecord(&Record{int64(i) * 1e9, float64(i % 100)})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ts.Aggregate(AggAvg, 60e9)
+	}
+}
@@ -0,0 +1,184 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"sort"
+	"time"
+)
+
+// Time span covered by each block of a TimeSeries, blocks are aligned to
+// multiples of it and chunks never cross their boundaries, so that ranges
+// and windows spanning whole blocks are answered from their summaries
+const blockSpan = int64(time.Hour)
+
+// block groups the chunks storing the records of a span of time, along with
+// the summary of all of them
+type block struct {
+	start   int64
+	chunks  []*chunk
+	summary Summary
+}
+
+// blockStart returns the start of the block containing the timestamp t
+func blockStart(t int64) int64 {
+	return floorDiv(t, blockSpan) * blockSpan
+}
+
+// newBlocksFrom partitions ordered records in blocks, each one with the
+// records of its span split in chunks of at most chunkSize records
+func newBlocksFrom(records []Record) []*block {
+	blocks := []*block{}
+	for len(records) > 0 {
+		b := &block{start: blockStart(records[0].Timestamp)}
+		n := sort.Search(len(records), func(i int) bool {
+			return records[i].Timestamp >= b.start+blockSpan
+		})
+		b.chunks = splitChunks(records[:n])
+		b.resummarize()
+		blocks = append(blocks, b)
+		records = records[n:]
+	}
+	return blocks
+}
+
+// splitChunks stores ordered records in chunks of at most chunkSize records
+func splitChunks(records []Record) []*chunk {
+	chunks := make([]*chunk, 0, len(records)/chunkSize+1)
+	for len(records) > chunkSize {
+		chunks = append(chunks, newChunkFrom(records[:chunkSize]))
+		records = records[chunkSize:]
+	}
+	return append(chunks, newChunkFrom(records))
+}
+
+func (b *block) count() int {
+	return b.summary.Count
+}
+
+func (b *block) minT() int64 {
+	return b.chunks[0].minT
+}
+
+func (b *block) maxT() int64 {
+	return b.chunks[len(b.chunks)-1].maxT()
+}
+
+// append adds a new record at the tail of the block, starting a new chunk
+// once the last one is full
+func (b *block) append(t int64, v float64) {
+	n := len(b.chunks)
+	if n == 0 || b.chunks[n-1].count >= chunkSize {
+		b.chunks = append(b.chunks, newChunk())
+		n++
+	}
+	b.chunks[n-1].append(t, v)
+	b.summary.Add(Record{t, v})
+}
+
+// resummarize rebuilds the summary of the block from the ones of its chunks,
+// after they're rewritten
+func (b *block) resummarize() {
+	b.summary = Summary{}
+	for _, c := range b.chunks {
+		b.summary.Merge(&c.summary)
+	}
+}
+
+// clone returns a copy of the block not sharing any chunk with the original
+func (b *block) clone() *block {
+	bb := &block{start: b.start, summary: b.summary}
+	bb.chunks = make([]*chunk, len(b.chunks))
+	for i, c := range b.chunks {
+		bb.chunks[i] = c.clone()
+	}
+	return bb
+}
+
+// slice returns a new block with the records between lo and hi included,
+// chunks entirely in range are copied without being decoded. Nil is returned
+// if no record falls in range.
+func (b *block) slice(lo, hi int64) *block {
+	s := &block{start: b.start}
+	for _, c := range b.chunks {
+		if c.maxT() < lo || c.minT > hi {
+			continue
+		}
+		if c.minT >= lo && c.maxT() <= hi {
+			s.chunks = append(s.chunks, c.clone())
+			continue
+		}
+		records := make([]Record, 0, c.count)
+		for _, r := range c.records() {
+			if r.Timestamp >= lo && r.Timestamp <= hi {
+				records = append(records, r)
+			}
+		}
+		if len(records) > 0 {
+			s.chunks = append(s.chunks, newChunkFrom(records))
+		}
+	}
+	if len(s.chunks) == 0 {
+		return nil
+	}
+	s.resummarize()
+	return s
+}
+
+// blockIndex returns the index of the block containing the timestamp t, or
+// the index where it would be inserted and false if there's none
+func (ts *TimeSeries) blockIndex(t int64) (int, bool) {
+	start := blockStart(t)
+	i := sort.Search(len(ts.blocks), func(i int) bool {
+		return ts.blocks[i].start >= start
+	})
+	return i, i < len(ts.blocks) && ts.blocks[i].start == start
+}
+
+// appendChunk adds a chunk following all the records of the TimeSeries,
+// chunks crossing the boundary of a block are decoded and split
+func (ts *TimeSeries) appendChunk(c *chunk) {
+	start := blockStart(c.minT)
+	if start != blockStart(c.maxT()) {
+		for _, b := range newBlocksFrom(c.records()) {
+			for _, c := range b.chunks {
+				ts.appendChunk(c)
+			}
+		}
+		return
+	}
+	if n := len(ts.blocks); n > 0 && ts.blocks[n-1].start == start {
+		ts.blocks[n-1].chunks = append(ts.blocks[n-1].chunks, c)
+		ts.blocks[n-1].summary.Merge(&c.summary)
+	} else {
+		ts.blocks = append(ts.blocks, &block{
+			start:   start,
+			chunks:  []*chunk{c},
+			summary: c.summary,
+		})
+	}
+}
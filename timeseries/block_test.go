@@ -0,0 +1,171 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"math"
+	"testing"
+)
+
+// checkBlocks fails if a chunk crosses the boundary of its block or the
+// summary of a block doesn't match its records
+func checkBlocks(t *testing.T, ts *TimeSeries) {
+	t.Helper()
+	for i, b := range ts.blocks {
+		if i > 0 && ts.blocks[i-1].start >= b.start {
+			t.Errorf("Blocks out of order at %v", b.start)
+		}
+		s := Summary{}
+		for _, c := range b.chunks {
+			if blockStart(c.minT) != b.start || blockStart(c.maxT()) != b.start {
+				t.Errorf("Chunk [%v, %v] out of block %v", c.minT, c.maxT(), b.start)
+			}
+			for _, r := range c.records() {
+				s.Add(r)
+			}
+		}
+		if s.Count != b.summary.Count || s.Sum != b.summary.Sum ||
+			s.First != b.summary.First || s.Last != b.summary.Last {
+			t.Errorf("Wrong summary of block %v, expected %v got %v", b.start, s, b.summary)
+		}
+	}
+}
+
+func newBlockSeries() *TimeSeries {
+	ts := NewTimeSeries("test-ts", 0)
+	// A record every 7 seconds for 5 hours, blocks end in partial chunks
+	for i := int64(0); i < 5*3600/7; i++ {
+		ts.AddRecord(&Record{i * 7e9, float64((i * 37) % 101)})
+	}
+	return ts
+}
+
+func TestTimeSeriesBlocks(t *testing.T) {
+	ts := newBlockSeries()
+	if len(ts.blocks) != 5 {
+		t.Errorf("Expected 5 blocks got %v", len(ts.blocks))
+	}
+	checkBlocks(t, ts)
+	bounds := [][2]int64{
+		{math.MinInt64, math.MaxInt64},
+		{blockSpan, 3*blockSpan - 1},
+		{blockSpan / 2, 4*blockSpan + 1},
+		{3 * blockSpan, 3 * blockSpan},
+	}
+	for _, b := range bounds {
+		s, expected := ts.Summarize(b[0], b[1]), naiveSummary(ts, b[0], b[1])
+		if s.Count != expected.Count || s.Sum != expected.Sum ||
+			s.First != expected.First || s.Last != expected.Last {
+			t.Errorf("Wrong summary of %v, expected %v got %v", b, expected, s)
+		}
+	}
+}
+
+func TestTimeSeriesAggregateBlocks(t *testing.T) {
+	ts := newBlockSeries()
+	for _, interval := range []int64{0, 600e9, 3600e9, 7200e9} {
+		records, err := ts.AggregateRange(AggSum, interval, 1800e9, 15000e9)
+		if err != nil {
+			t.Fatalf("Failed to aggregate range: %v", err)
+		}
+		tmp, _ := ts.Range(1800e9, 15000e9)
+		checkBlocks(t, tmp)
+		expected := []Record{}
+		for _, r := range tmp.Records() {
+			start := r.Timestamp
+			if interval > 0 {
+				start = floorDiv(start, interval) * interval
+			} else if len(expected) > 0 {
+				start = expected[0].Timestamp
+			}
+			if n := len(expected); n > 0 && expected[n-1].Timestamp == start {
+				expected[n-1].Value += r.Value
+			} else {
+				expected = append(expected, Record{start, r.Value})
+			}
+		}
+		if len(records) != len(expected) {
+			t.Fatalf("Expected %v windows every %v got %v", len(expected), interval, len(records))
+		}
+		for i := range records {
+			if records[i] != expected[i] {
+				t.Errorf("Wrong window %v every %v, expected %v got %v",
+					i, interval, expected[i], records[i])
+			}
+		}
+	}
+}
+
+func TestTimeSeriesBlocksRewrite(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	ts.AddRecord(&Record{0, 1})
+	ts.AddRecord(&Record{3 * blockSpan, 2})
+	// Late records in a span with no records start a new block
+	ts.AddRecord(&Record{blockSpan + 1, 3})
+	ts.AddRecord(&Record{1, 4})
+	ts.Flush()
+	if len(ts.blocks) != 3 {
+		t.Errorf("Expected 3 blocks got %v", len(ts.blocks))
+	}
+	checkBlocks(t, ts)
+	ts.DeleteRange(blockSpan, 2*blockSpan)
+	if len(ts.blocks) != 2 || ts.Len() != 3 {
+		t.Errorf("Expected 2 blocks and 3 records got %v %v", len(ts.blocks), ts.Len())
+	}
+	checkBlocks(t, ts)
+	if n := ts.expireBefore(1); n != 1 {
+		t.Errorf("Expected 1 record expired got %v", n)
+	}
+	checkBlocks(t, ts)
+}
+
+func TestTimeSeriesUnmarshalCrossingChunk(t *testing.T) {
+	// Chunks encoded before blocks may cross their boundaries
+	records := []Record{{0, 1}, {blockSpan - 1, 2}, {blockSpan, 3}, {3 * blockSpan, 4}}
+	c := newChunkFrom(records)
+	ts := NewTimeSeries("test-ts", 0)
+	ts.blocks = []*block{{start: 0, chunks: []*chunk{c}, summary: c.summary}}
+	ts.size = len(records)
+	b, err := ts.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to marshal TimeSeries: %v", err)
+	}
+	test := &TimeSeries{}
+	if err := test.UnmarshalBinary(b); err != nil {
+		t.Fatalf("Failed to unmarshal TimeSeries: %v", err)
+	}
+	if len(test.blocks) != 3 || test.Len() != len(records) {
+		t.Errorf("Expected 3 blocks and %v records got %v %v",
+			len(records), len(test.blocks), test.Len())
+	}
+	checkBlocks(t, test)
+	for i, r := range test.Records() {
+		if r != records[i] {
+			t.Errorf("Expected %v got %v", records[i], r)
+		}
+	}
+}
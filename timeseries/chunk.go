@@ -0,0 +1,441 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"context"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// Number of records stored in each chunk of a TimeSeries, once full a chunk
+// is sealed and a new one is started
+const chunkSize = 120
+
+// bstream is an append-only stream of bits, count tracks the bits still free
+// in the last byte
+type bstream struct {
+	stream []byte
+	count  uint8
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+	if bit {
+		b.stream[len(b.stream)-1] |= 1 << (b.count - 1)
+	}
+	b.count--
+}
+
+func (b *bstream) writeByte(byt byte) {
+	if b.count == 0 {
+		b.stream = append(b.stream, byt)
+		return
+	}
+	// Fill the free bits of the last byte with the most significant bits
+	// and carry the rest over a new byte
+	b.stream[len(b.stream)-1] |= byt >> (8 - b.count)
+	b.stream = append(b.stream, byt<<b.count)
+}
+
+func (b *bstream) writeBits(u uint64, nbits int) {
+	u <<= 64 - uint(nbits)
+	for nbits >= 8 {
+		b.writeByte(byte(u >> 56))
+		u <<= 8
+		nbits -= 8
+	}
+	for nbits > 0 {
+		b.writeBit((u >> 63) == 1)
+		u <<= 1
+		nbits--
+	}
+}
+
+// bstreamReader reads bits from a bstream, pos is the offset of the next bit
+// to be read
+type bstreamReader struct {
+	stream []byte
+	pos    int
+}
+
+func (r *bstreamReader) readBit() (bool, error) {
+	v, err := r.readBits(1)
+	return v == 1, err
+}
+
+func (r *bstreamReader) readBits(nbits int) (uint64, error) {
+	var u uint64
+	for nbits > 0 {
+		idx := r.pos >> 3
+		if idx >= len(r.stream) {
+			return 0, io.EOF
+		}
+		off := uint(r.pos & 7)
+		take := 8 - int(off)
+		if take > nbits {
+			take = nbits
+		}
+		b := r.stream[idx] << off >> uint(8-take)
+		u = u<<uint(take) | uint64(b)
+		r.pos += take
+		nbits -= take
+	}
+	return u, nil
+}
+
+// chunk stores a sequence of ordered records compressed as described in the
+// Facebook Gorilla paper: timestamps are encoded as delta-of-delta while
+// values are XOR'ed with the previous one, storing only the meaningful bits
+type chunk struct {
+	b     bstream
+	count int
+	minT  int64
+	// Appender state, it's the last record written plus the informations
+	// needed to encode the next one
+	t        int64
+	tDelta   int64
+	v        float64
+	leading  uint8
+	trailing uint8
+	// Statistics of the records of the chunk, aggregations over whole
+	// chunks don't need to decode them
+	summary Summary
+}
+
+func newChunk() *chunk {
+	return &chunk{leading: 0xff}
+}
+
+// newChunkFrom creates a new chunk with the given ordered records
+func newChunkFrom(records []Record) *chunk {
+	c := newChunk()
+	for _, r := range records {
+		c.append(r.Timestamp, r.Value)
+	}
+	return c
+}
+
+func (c *chunk) maxT() int64 {
+	return c.t
+}
+
+// size returns the number of bytes occupied by the compressed records
+func (c *chunk) size() int {
+	return len(c.b.stream)
+}
+
+// append adds a new record at the tail of the chunk, timestamps are expected
+// to be greater or equal to the last one written
+func (c *chunk) append(t int64, v float64) {
+	if c.count == 0 {
+		c.b.writeBits(uint64(t), 64)
+		c.b.writeBits(math.Float64bits(v), 64)
+		c.minT = t
+	} else {
+		delta := t - c.t
+		c.writeDod(delta - c.tDelta)
+		c.writeXOR(v)
+		c.tDelta = delta
+	}
+	c.t = t
+	c.v = v
+	c.count++
+	c.summary.Add(Record{t, v})
+}
+
+// Delta-of-delta buckets, nanosecond timestamps rarely arrive at perfectly
+// regular intervals so they're wider than the ones in the paper
+var dodBuckets = []struct {
+	prefix, prefixBits uint64
+	nbits              int
+}{
+	{0x02, 2, 16},
+	{0x06, 3, 24},
+	{0x0e, 4, 32},
+	{0x0f, 4, 64},
+}
+
+func fitsBits(x int64, nbits int) bool {
+	return nbits == 64 || (-(1<<uint(nbits-1)) <= x && x < 1<<uint(nbits-1))
+}
+
+func (c *chunk) writeDod(dod int64) {
+	if dod == 0 {
+		c.b.writeBit(false)
+		return
+	}
+	for _, bucket := range dodBuckets {
+		if fitsBits(dod, bucket.nbits) {
+			c.b.writeBits(bucket.prefix, int(bucket.prefixBits))
+			c.b.writeBits(uint64(dod), bucket.nbits)
+			return
+		}
+	}
+}
+
+func (c *chunk) writeXOR(v float64) {
+	delta := math.Float64bits(v) ^ math.Float64bits(c.v)
+	if delta == 0 {
+		c.b.writeBit(false)
+		return
+	}
+	c.b.writeBit(true)
+	leading := uint8(bits.LeadingZeros64(delta))
+	trailing := uint8(bits.TrailingZeros64(delta))
+	// Leading zeros are stored on 5 bits
+	if leading >= 32 {
+		leading = 31
+	}
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+		// Meaningful bits fall in the window of the previous value
+		c.b.writeBit(false)
+		c.b.writeBits(delta>>c.trailing, 64-int(c.leading)-int(c.trailing))
+		return
+	}
+	c.leading, c.trailing = leading, trailing
+	sigbits := 64 - leading - trailing
+	c.b.writeBit(true)
+	c.b.writeBits(uint64(leading), 5)
+	// 64 meaningful bits overflow 6 bits to 0, the reader handles that
+	c.b.writeBits(uint64(sigbits), 6)
+	c.b.writeBits(delta>>trailing, int(sigbits))
+}
+
+// clone returns a copy of the chunk not sharing the stream with the original
+func (c *chunk) clone() *chunk {
+	cc := *c
+	cc.b.stream = append([]byte(nil), c.b.stream...)
+	return &cc
+}
+
+// records decodes all the records stored in the chunk
+func (c *chunk) records() []Record {
+	records := make([]Record, 0, c.count)
+	it := c.iterator()
+	for it.Next() {
+		records = append(records, it.At())
+	}
+	return records
+}
+
+func (c *chunk) iterator() *chunkIterator {
+	return &chunkIterator{
+		br:    bstreamReader{stream: c.b.stream},
+		count: c.count,
+	}
+}
+
+// chunkIterator decodes the records of a chunk one by one
+type chunkIterator struct {
+	br       bstreamReader
+	count    int
+	read     int
+	t        int64
+	tDelta   int64
+	v        float64
+	leading  uint8
+	trailing uint8
+	err      error
+}
+
+func (it *chunkIterator) Next() bool {
+	if it.err != nil || it.read == it.count {
+		return false
+	}
+	if it.read == 0 {
+		t, err := it.br.readBits(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		v, err := it.br.readBits(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.t, it.v = int64(t), math.Float64frombits(v)
+		it.read++
+		return true
+	}
+	dod, err := it.readDod()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if err := it.readXOR(); err != nil {
+		it.err = err
+		return false
+	}
+	it.tDelta += dod
+	it.t += it.tDelta
+	it.read++
+	return true
+}
+
+func (it *chunkIterator) At() Record {
+	return Record{it.t, it.v}
+}
+
+func (it *chunkIterator) Err() error {
+	return it.err
+}
+
+func (it *chunkIterator) readDod() (int64, error) {
+	// Count the leading 1s of the prefix, up to the number of buckets
+	var ones int
+	for ; ones < len(dodBuckets); ones++ {
+		bit, err := it.br.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+	}
+	if ones == 0 {
+		return 0, nil
+	}
+	nbits := dodBuckets[ones-1].nbits
+	u, err := it.br.readBits(nbits)
+	if err != nil {
+		return 0, err
+	}
+	dod := int64(u)
+	// Sign extension for values narrower than 64 bits
+	if nbits < 64 && u >= 1<<uint(nbits-1) {
+		dod -= 1 << uint(nbits)
+	}
+	return dod, nil
+}
+
+func (it *chunkIterator) readXOR() error {
+	bit, err := it.br.readBit()
+	if err != nil || !bit {
+		return err
+	}
+	if bit, err = it.br.readBit(); err != nil {
+		return err
+	}
+	if bit {
+		leading, err := it.br.readBits(5)
+		if err != nil {
+			return err
+		}
+		sigbits, err := it.br.readBits(6)
+		if err != nil {
+			return err
+		}
+		if sigbits == 0 {
+			sigbits = 64
+		}
+		it.leading = uint8(leading)
+		it.trailing = uint8(64 - leading - sigbits)
+	}
+	sigbits := 64 - int(it.leading) - int(it.trailing)
+	u, err := it.br.readBits(sigbits)
+	if err != nil {
+		return err
+	}
+	it.v = math.Float64frombits(math.Float64bits(it.v) ^ (u << it.trailing))
+	return nil
+}
+
+// Iterator walks through all the records of a TimeSeries in timestamp order,
+// decoding one chunk at a time. Late records not merged yet are merged on the
+// fly, after the stored records with the same timestamp. Iterators bound to a
+// context stop with its error as soon as it's done, checked every chunk.
+type Iterator struct {
+	ctx    context.Context
+	blocks []*block
+	chunks []*chunk
+	cur    *chunkIterator
+	late   []Record
+	// The stored record reached by cur is still to be returned
+	pending bool
+	at      Record
+	err     error
+}
+
+func (it *Iterator) Next() bool {
+	if !it.pending {
+		if it.pending = it.nextStored(); it.err != nil {
+			return false
+		}
+	}
+	if len(it.late) > 0 && (!it.pending || it.late[0].Timestamp < it.cur.At().Timestamp) {
+		it.at = it.late[0]
+		it.late = it.late[1:]
+		return true
+	}
+	if !it.pending {
+		return false
+	}
+	it.at = it.cur.At()
+	it.pending = false
+	return true
+}
+
+// nextStored moves to the next record stored in the chunks
+func (it *Iterator) nextStored() bool {
+	for {
+		if it.cur != nil && it.cur.Next() {
+			return true
+		}
+		if it.cur != nil && it.cur.Err() != nil {
+			it.err = it.cur.Err()
+			return false
+		}
+		if len(it.chunks) == 0 {
+			if len(it.blocks) == 0 {
+				return false
+			}
+			it.chunks = it.blocks[0].chunks
+			it.blocks = it.blocks[1:]
+			continue
+		}
+		if it.ctx != nil {
+			if it.err = it.ctx.Err(); it.err != nil {
+				return false
+			}
+		}
+		it.cur = it.chunks[0].iterator()
+		it.chunks = it.chunks[1:]
+	}
+}
+
+func (it *Iterator) At() Record {
+	return it.at
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
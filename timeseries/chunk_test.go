@@ -0,0 +1,157 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestChunkAppendIterate(t *testing.T) {
+	records := []Record{
+		{1000, 2.5},
+		{2000, 2.5},
+		{3000, 2.75},
+		{4000, -12.1},
+		{4000, math.MaxFloat64},
+		{1 << 40, 0},
+		{1<<40 + 7, math.SmallestNonzeroFloat64},
+		{math.MaxInt64, math.Inf(1)},
+	}
+	c := newChunkFrom(records)
+	decoded := c.records()
+	if len(decoded) != len(records) {
+		t.Fatalf("Wrong number of records decoded, expected %v got %v",
+			len(records), len(decoded))
+	}
+	for i := range records {
+		if decoded[i] != records[i] {
+			t.Errorf("Wrong record decoded, expected %v got %v",
+				records[i], decoded[i])
+		}
+	}
+}
+
+func TestChunkRandomRecords(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	records := make([]Record, chunkSize)
+	var ts int64 = 1588000000000000000
+	for i := range records {
+		ts += rnd.Int63n(1e10)
+		records[i] = Record{ts, rnd.NormFloat64() * 1e3}
+	}
+	c := newChunkFrom(records)
+	it := c.iterator()
+	i := 0
+	for ; it.Next(); i++ {
+		if it.At() != records[i] {
+			t.Errorf("Wrong record decoded, expected %v got %v",
+				records[i], it.At())
+		}
+	}
+	if it.Err() != nil || i != len(records) {
+		t.Errorf("Failed to decode all records, got %v error %v", i, it.Err())
+	}
+}
+
+func TestTimeSeriesAddRecordOutOfOrder(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	n := chunkSize * 5
+	for _, i := range rand.New(rand.NewSource(7)).Perm(n) {
+		ts.AddRecord(&Record{int64(i), float64(i)})
+	}
+	if ts.Len() != n {
+		t.Errorf("Wrong number of records, expected %v got %v", n, ts.Len())
+	}
+	for i, r := range ts.Records() {
+		if r.Timestamp != int64(i) || r.Value != float64(i) {
+			t.Fatalf("Records out of order at %v, got %v", i, r)
+		}
+	}
+	for _, b := range ts.blocks {
+		for _, c := range b.chunks {
+			if c.count > chunkSize {
+				t.Errorf("Chunk exceeds max size with %v records", c.count)
+			}
+		}
+	}
+	if record, index := ts.Find(int64(n / 2)); record == nil || index != n/2 {
+		t.Errorf("Find failed, got %v at index %v", record, index)
+	}
+}
+
+func benchmarkRecords(n int) []Record {
+	rnd := rand.New(rand.NewSource(42))
+	records := make([]Record, n)
+	var ts int64 = 1588000000000000000
+	value := 50.0
+	for i := range records {
+		// One sample per second with some jitter, values move as a
+		// random walk with two decimals, as a typical gauge
+		ts += 1e9 + rnd.Int63n(1e6)
+		value += float64(rnd.Intn(200)-100) / 100
+		records[i] = Record{ts, value}
+	}
+	return records
+}
+
+func BenchmarkTimeSeriesAddRecord(b *testing.B) {
+	records := benchmarkRecords(b.N)
+	ts := NewTimeSeries("bench-ts", 0)
+	b.ResetTimer()
+	for i := range records {
+		ts.AddRecord(&records[i])
+	}
+}
+
+func BenchmarkTimeSeriesIterate(b *testing.B) {
+	ts := NewTimeSeries("bench-ts", 0)
+	for _, r := range benchmarkRecords(b.N) {
+		ts.AddRecord(&Record{r.Timestamp, r.Value})
+	}
+	b.ResetTimer()
+	it := ts.Iterator()
+	for it.Next() {
+	}
+}
+
+func BenchmarkTimeSeriesBytesPerPoint(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		ts := NewTimeSeries("bench-ts", 0)
+		for _, r := range benchmarkRecords(100000) {
+			ts.AddRecord(&Record{r.Timestamp, r.Value})
+		}
+		bytes := 0
+		for _, b := range ts.blocks {
+			for _, c := range b.chunks {
+				bytes += c.size()
+			}
+		}
+		b.ReportMetric(float64(bytes)/float64(ts.Len()), "bytes/point")
+	}
+}
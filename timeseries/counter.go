@@ -0,0 +1,182 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import "context"
+
+// counterWindow holds the changes between consecutive records, where the
+// latest record of each pair falls in the window. ref is the last record
+// before the window, or the first of the window if none precedes it, so no
+// change is lost between adjacent windows.
+type counterWindow struct {
+	start    int64
+	ref      Record
+	prev     Record
+	last     Record
+	pairs    int
+	delta    float64
+	increase float64
+}
+
+// Counter resets are detected as a value lower than the previous one, the
+// counter is assumed to have restarted from zero, so the increase is the
+// value itself
+func counterIncrease(prev, next float64) float64 {
+	if next < prev {
+		return next
+	}
+	return next - prev
+}
+
+func (ts *TimeSeries) counterWindows(ctx context.Context, interval int64) ([]*counterWindow, error) {
+	if ts.size == 0 {
+		return nil, EmptyTimeSeriesErr
+	}
+	windows := make([]*counterWindow, 0)
+	var (
+		w    *counterWindow
+		prev Record
+	)
+	it := ts.IteratorContext(ctx)
+	for i := 0; it.Next(); i++ {
+		record := it.At()
+		start := record.Timestamp
+		if interval > 0 {
+			start = floorDiv(record.Timestamp, interval) * interval
+		}
+		if w == nil || (interval > 0 && start != w.start) {
+			w = &counterWindow{start: start, ref: record}
+			if i > 0 {
+				w.ref = prev
+			}
+			windows = append(windows, w)
+		}
+		if i > 0 {
+			w.delta += record.Value - prev.Value
+			w.increase += counterIncrease(prev.Value, record.Value)
+			w.prev = prev
+			w.pairs++
+		}
+		w.last = record
+		prev = record
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return windows, nil
+}
+
+// counter maps each window with at least a pair of records to a value,
+// windows the function can't compute a value for are skipped
+func (ts *TimeSeries) counter(ctx context.Context, interval int64,
+	value func(*counterWindow) (float64, bool)) ([]Record, error) {
+	windows, err := ts.counterWindows(ctx, interval)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Record, 0, len(windows))
+	for _, w := range windows {
+		if w.pairs == 0 {
+			continue
+		}
+		if v, ok := value(w); ok {
+			result = append(result, Record{w.start, v})
+		}
+	}
+	return result, nil
+}
+
+// seconds returns the nanoseconds between two timestamps in seconds
+func seconds(from, to int64) float64 {
+	return float64(to-from) / 1e9
+}
+
+// Increase returns the increase of a counter in windows of interval
+// nanoseconds, aligned like Aggregate, accounting for counter resets.
+// A non positive interval returns the increase over all the records.
+func (ts *TimeSeries) Increase(interval int64) ([]Record, error) {
+	return ts.IncreaseContext(context.Background(), interval)
+}
+
+// IncreaseContext is like Increase but gives up with the error of ctx once
+// it's done
+func (ts *TimeSeries) IncreaseContext(ctx context.Context, interval int64) ([]Record, error) {
+	return ts.counter(ctx, interval, func(w *counterWindow) (float64, bool) {
+		return w.increase, true
+	})
+}
+
+// Rate returns the per-second average rate of increase of a counter in
+// windows of interval nanoseconds, accounting for counter resets. A non
+// positive interval returns the rate over the time spanned by all the
+// records.
+func (ts *TimeSeries) Rate(interval int64) ([]Record, error) {
+	return ts.RateContext(context.Background(), interval)
+}
+
+// RateContext is like Rate but gives up with the error of ctx once it's done
+func (ts *TimeSeries) RateContext(ctx context.Context, interval int64) ([]Record, error) {
+	return ts.counter(ctx, interval, func(w *counterWindow) (float64, bool) {
+		span := float64(interval) / 1e9
+		if interval <= 0 {
+			span = seconds(w.ref.Timestamp, w.last.Timestamp)
+		}
+		return w.increase / span, span > 0
+	})
+}
+
+// IRate returns the per-second instant rate of a counter, computed on the
+// last two records of each window of interval nanoseconds, accounting
+// for counter resets
+func (ts *TimeSeries) IRate(interval int64) ([]Record, error) {
+	return ts.IRateContext(context.Background(), interval)
+}
+
+// IRateContext is like IRate but gives up with the error of ctx once it's
+// done
+func (ts *TimeSeries) IRateContext(ctx context.Context, interval int64) ([]Record, error) {
+	return ts.counter(ctx, interval, func(w *counterWindow) (float64, bool) {
+		span := seconds(w.prev.Timestamp, w.last.Timestamp)
+		return counterIncrease(w.prev.Value, w.last.Value) / span, span > 0
+	})
+}
+
+// Derivative returns the per-second rate of change of a gauge in windows of
+// interval nanoseconds, decreases are not taken as resets, so it can be
+// negative
+func (ts *TimeSeries) Derivative(interval int64) ([]Record, error) {
+	return ts.DerivativeContext(context.Background(), interval)
+}
+
+// DerivativeContext is like Derivative but gives up with the error of ctx
+// once it's done
+func (ts *TimeSeries) DerivativeContext(ctx context.Context, interval int64) ([]Record, error) {
+	return ts.counter(ctx, interval, func(w *counterWindow) (float64, bool) {
+		span := seconds(w.ref.Timestamp, w.last.Timestamp)
+		return w.delta / span, span > 0
+	})
+}
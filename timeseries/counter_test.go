@@ -0,0 +1,103 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"math"
+	"testing"
+)
+
+func newCounterSeries() *TimeSeries {
+	ts := NewTimeSeries("requests", 0)
+	// The counter resets between 20s and 30s
+	values := []float64{0, 10, 20, 5, 15, 25, 35, 45}
+	for i, v := range values {
+		ts.AddRecord(&Record{int64(i) * 10e9, v})
+	}
+	return ts
+}
+
+func expectRecords(t *testing.T, name string, records []Record, err error, expected []Record) {
+	if err != nil {
+		t.Fatalf("Failed to compute %v: %v", name, err)
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("Wrong %v, expected %v got %v", name, expected, records)
+	}
+	for i := range records {
+		if records[i].Timestamp != expected[i].Timestamp ||
+			math.Abs(records[i].Value-expected[i].Value) > 1e-9 {
+			t.Errorf("Wrong %v, expected %v got %v", name, expected, records)
+			return
+		}
+	}
+}
+
+func TestTimeSeriesIncrease(t *testing.T) {
+	ts := newCounterSeries()
+	records, err := ts.Increase(30e9)
+	expectRecords(t, "increase", records, err, []Record{{0, 20}, {30e9, 25}, {60e9, 20}})
+	records, err = ts.Increase(0)
+	expectRecords(t, "increase", records, err, []Record{{0, 65}})
+}
+
+func TestTimeSeriesRate(t *testing.T) {
+	ts := newCounterSeries()
+	records, err := ts.Rate(30e9)
+	expectRecords(t, "rate", records, err, []Record{{0, 20.0 / 30}, {30e9, 25.0 / 30}, {60e9, 20.0 / 30}})
+	records, err = ts.Rate(0)
+	expectRecords(t, "rate", records, err, []Record{{0, 65.0 / 70}})
+}
+
+func TestTimeSeriesIRate(t *testing.T) {
+	ts := newCounterSeries()
+	records, err := ts.IRate(30e9)
+	expectRecords(t, "irate", records, err, []Record{{0, 1}, {30e9, 1}, {60e9, 1}})
+	// The last pair of records straddles a reset
+	ts.AddRecord(&Record{80e9, 3})
+	records, err = ts.IRate(0)
+	expectRecords(t, "irate", records, err, []Record{{0, 0.3}})
+}
+
+func TestTimeSeriesDerivative(t *testing.T) {
+	ts := newCounterSeries()
+	records, err := ts.Derivative(30e9)
+	expectRecords(t, "derivative", records, err, []Record{{0, 1}, {30e9, 5.0 / 30}, {60e9, 1}})
+	records, err = ts.Derivative(0)
+	expectRecords(t, "derivative", records, err, []Record{{0, 45.0 / 70}})
+}
+
+func TestTimeSeriesCounterSingleRecord(t *testing.T) {
+	ts := NewTimeSeries("requests", 0)
+	if _, err := ts.Rate(1e9); err != EmptyTimeSeriesErr {
+		t.Errorf("Expected EmptyTimeSeriesErr got %v", err)
+	}
+	ts.AddRecord(&Record{1e9, 4})
+	if records, err := ts.Rate(1e9); err != nil || len(records) != 0 {
+		t.Errorf("Expected no rate with a single record, got %v %v", records, err)
+	}
+}
@@ -0,0 +1,148 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+)
+
+// DuplicatePolicy tells how a record with the timestamp of one already stored
+// is handled
+type DuplicatePolicy byte
+
+const (
+	// DuplicateAllow stores both records, the new one after the other
+	DuplicateAllow DuplicatePolicy = iota
+	// DuplicateBlock rejects the new record
+	DuplicateBlock
+	// DuplicateFirst keeps the stored record
+	DuplicateFirst
+	// DuplicateLast replaces the stored value with the new one
+	DuplicateLast
+	// DuplicateSum adds the new value to the stored one
+	DuplicateSum
+	// DuplicateMin keeps the lowest value
+	DuplicateMin
+	// DuplicateMax keeps the highest value
+	DuplicateMax
+)
+
+var (
+	UnknownDuplicatePolicyErr = errors.New("unknown duplicate policy")
+	DuplicateErr              = errors.New("duplicate timestamp")
+)
+
+var duplicatePolicyNames = map[DuplicatePolicy]string{
+	DuplicateAllow: "ALLOW",
+	DuplicateBlock: "BLOCK",
+	DuplicateFirst: "FIRST",
+	DuplicateLast:  "LAST",
+	DuplicateSum:   "SUM",
+	DuplicateMin:   "MIN",
+	DuplicateMax:   "MAX",
+}
+
+// ParseDuplicatePolicy parses the name of a duplicate policy, case
+// insensitive
+func ParseDuplicatePolicy(str string) (DuplicatePolicy, error) {
+	str = strings.ToUpper(str)
+	for policy, name := range duplicatePolicyNames {
+		if name == str {
+			return policy, nil
+		}
+	}
+	return DuplicateAllow, UnknownDuplicatePolicyErr
+}
+
+func (p DuplicatePolicy) String() string {
+	return duplicatePolicyNames[p]
+}
+
+// merge returns the value resulting from a new value with the timestamp of a
+// stored one
+func (p DuplicatePolicy) merge(stored, value float64) float64 {
+	switch p {
+	case DuplicateLast:
+		return value
+	case DuplicateSum:
+		return stored + value
+	case DuplicateMin:
+		return math.Min(stored, value)
+	case DuplicateMax:
+		return math.Max(stored, value)
+	}
+	return stored
+}
+
+// mergeDuplicate applies the duplicate policy to a record with the timestamp
+// of a stored one, returning true if it's merged, false if there's no such
+// record or DuplicateErr if it's rejected
+func (ts *TimeSeries) mergeDuplicate(record *Record) (bool, error) {
+	i := sort.Search(len(ts.ooo), func(i int) bool {
+		return ts.ooo[i].Timestamp >= record.Timestamp
+	})
+	if i < len(ts.ooo) && ts.ooo[i].Timestamp == record.Timestamp {
+		if ts.Duplicates == DuplicateBlock {
+			return false, DuplicateErr
+		}
+		ts.ooo[i].Value = ts.Duplicates.merge(ts.ooo[i].Value, record.Value)
+		return true, nil
+	}
+	n, ok := ts.blockIndex(record.Timestamp)
+	if !ok {
+		return false, nil
+	}
+	b := ts.blocks[n]
+	j := sort.Search(len(b.chunks), func(j int) bool {
+		return b.chunks[j].maxT() >= record.Timestamp
+	})
+	if j == len(b.chunks) || b.chunks[j].minT > record.Timestamp {
+		return false, nil
+	}
+	records := b.chunks[j].records()
+	k := sort.Search(len(records), func(k int) bool {
+		return records[k].Timestamp >= record.Timestamp
+	})
+	if k == len(records) || records[k].Timestamp != record.Timestamp {
+		return false, nil
+	}
+	if ts.Duplicates == DuplicateBlock {
+		return false, DuplicateErr
+	}
+	// Chunks can't be updated in place, rewrite it only if the value
+	// actually changes
+	value := ts.Duplicates.merge(records[k].Value, record.Value)
+	if value != records[k].Value {
+		records[k].Value = value
+		b.chunks[j] = newChunkFrom(records)
+		b.resummarize()
+	}
+	return true, nil
+}
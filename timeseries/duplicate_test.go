@@ -0,0 +1,91 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"testing"
+)
+
+func TestTimeSeriesDuplicatePolicy(t *testing.T) {
+	for _, c := range []struct {
+		policy DuplicatePolicy
+		value  float64
+	}{
+		{DuplicateFirst, 2},
+		{DuplicateLast, 5},
+		{DuplicateSum, 7},
+		{DuplicateMin, 2},
+		{DuplicateMax, 5},
+	} {
+		ts := NewTimeSeries("test-ts", 0)
+		ts.Duplicates = c.policy
+		// Duplicate both a record stored in a sealed chunk and a late one
+		// waiting in the out-of-order buffer
+		for i := 0; i < chunkSize+2; i++ {
+			ts.AddRecord(&Record{int64(i) * 10, 2})
+		}
+		ts.AddRecord(&Record{5, 2})
+		for _, timestamp := range []int64{10, 5} {
+			merged, err := ts.AddRecord(&Record{timestamp, 5})
+			if !merged || err != nil {
+				t.Errorf("%v: expected record to be merged, got %v %v", c.policy, merged, err)
+			}
+		}
+		if ts.Len() != chunkSize+3 {
+			t.Errorf("%v: expected %v records got %v", c.policy, chunkSize+3, ts.Len())
+		}
+		records := ts.Records()
+		if records[1].Value != c.value || records[2].Value != c.value {
+			t.Errorf("%v: expected value %v got %v and %v",
+				c.policy, c.value, records[1].Value, records[2].Value)
+		}
+	}
+}
+
+func TestTimeSeriesDuplicateBlock(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	ts.Duplicates = DuplicateBlock
+	ts.AddRecord(&Record{10, 1})
+	if _, err := ts.AddRecord(&Record{10, 2}); err != DuplicateErr {
+		t.Errorf("Expected DuplicateErr got %v", err)
+	}
+	if ts.Len() != 1 || ts.Records()[0].Value != 1 {
+		t.Errorf("Expected the stored record to be kept, got %v", ts.Records())
+	}
+	if _, err := ts.AddRecord(&Record{11, 2}); err != nil {
+		t.Errorf("Failed to add record: %v", err)
+	}
+}
+
+func TestParseDuplicatePolicy(t *testing.T) {
+	if policy, err := ParseDuplicatePolicy("last"); err != nil || policy != DuplicateLast {
+		t.Errorf("Expected LAST got %v %v", policy, err)
+	}
+	if _, err := ParseDuplicatePolicy("newest"); err != UnknownDuplicatePolicyErr {
+		t.Errorf("Expected UnknownDuplicatePolicyErr got %v", err)
+	}
+}
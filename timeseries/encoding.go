@@ -0,0 +1,248 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// Clone returns a deep copy of the TimeSeries, sharing nothing with the
+// original one
+func (ts *TimeSeries) Clone() *TimeSeries {
+	clone := *ts
+	clone.Labels = append(Labels(nil), ts.Labels...)
+	clone.ooo = append([]Record(nil), ts.ooo...)
+	clone.blocks = make([]*block, len(ts.blocks))
+	for i, b := range ts.blocks {
+		clone.blocks[i] = b.clone()
+	}
+	return &clone
+}
+
+// MarshalBinary encodes the TimeSeries with its records, chunks are dumped as
+// they are, without being decoded, and partitioned again in blocks once
+// decoded. Labels and then the duplicate policy follow
+// the chunks, so that series encoded before their introduction can still be
+// decoded. The retention is stored in milliseconds, as by Millis, and in
+// nanoseconds at the end.
+func (ts *TimeSeries) MarshalBinary() ([]byte, error) {
+	// Late records are merged in a copy, encoding doesn't modify the
+	// TimeSeries
+	if len(ts.ooo) > 0 {
+		merged := ts.Clone()
+		merged.Flush()
+		return merged.MarshalBinary()
+	}
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(ts.Name))); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, []byte(ts.Name)); err != nil {
+		return nil, err
+	}
+	chunks := 0
+	for _, b := range ts.blocks {
+		chunks += len(b.chunks)
+	}
+	data := []interface{}{
+		Millis(ts.Retention),
+		ts.ctime.UnixNano(),
+		uint32(chunks),
+	}
+	for _, v := range data {
+		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range ts.blocks {
+		for _, c := range b.chunks {
+			data := []interface{}{
+				uint32(c.count),
+				c.minT,
+				c.t,
+				c.tDelta,
+				c.v,
+				c.leading,
+				c.trailing,
+				c.b.count,
+				uint32(len(c.b.stream)),
+				c.b.stream,
+			}
+			for _, v := range data {
+				if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(ts.Labels))); err != nil {
+		return nil, err
+	}
+	for _, l := range ts.Labels {
+		for _, str := range []string{l.Name, l.Value} {
+			if err := binary.Write(buf, binary.BigEndian, uint16(len(str))); err != nil {
+				return nil, err
+			}
+			if err := binary.Write(buf, binary.BigEndian, []byte(str)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := binary.Write(buf, binary.BigEndian, ts.Duplicates); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, ts.Retention); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Millis converts a length in nanoseconds to milliseconds, the unit older
+// servers and clients understand. Encodings keep carrying the milliseconds,
+// followed by the nanoseconds when they aren't exact, since older peers only
+// read the milliseconds. Lengths are rounded up so that a positive length
+// never becomes 0, non positive lengths have special meanings and are kept
+// as they are.
+func Millis(ns int64) int64 {
+	if ns <= 0 {
+		return ns
+	}
+	return (ns-1)/1e6 + 1
+}
+
+// Nanos converts a length in milliseconds sent by older peers to nanoseconds,
+// non positive lengths are kept as they are
+func Nanos(ms int64) int64 {
+	if ms <= 0 {
+		return ms
+	}
+	return ms * 1e6
+}
+
+// WholeMillis tells if a length in nanoseconds is carried exactly by its
+// milliseconds
+func WholeMillis(ns int64) bool {
+	return Nanos(Millis(ns)) == ns
+}
+
+func (ts *TimeSeries) UnmarshalBinary(buf []byte) error {
+	reader := bytes.NewReader(buf)
+	var nameLen uint16 = 0
+	if err := binary.Read(reader, binary.BigEndian, &nameLen); err != nil {
+		return err
+	}
+	name := make([]byte, nameLen)
+	if err := binary.Read(reader, binary.BigEndian, &name); err != nil {
+		return err
+	}
+	var (
+		ctime  int64
+		chunks uint32
+	)
+	for _, v := range []interface{}{&ts.Retention, &ctime, &chunks} {
+		if err := binary.Read(reader, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	// Series encoded before nanoseconds retentions only carry milliseconds
+	ts.Retention = Nanos(ts.Retention)
+	ts.Name = string(name)
+	ts.ctime = time.Unix(0, ctime)
+	ts.clock = systemClock{}
+	ts.blocks = []*block{}
+	ts.ooo = nil
+	ts.size = 0
+	for i := 0; i < int(chunks); i++ {
+		var count, streamLen uint32
+		c := &chunk{}
+		data := []interface{}{
+			&count,
+			&c.minT,
+			&c.t,
+			&c.tDelta,
+			&c.v,
+			&c.leading,
+			&c.trailing,
+			&c.b.count,
+			&streamLen,
+		}
+		for _, v := range data {
+			if err := binary.Read(reader, binary.BigEndian, v); err != nil {
+				return err
+			}
+		}
+		c.count = int(count)
+		c.b.stream = make([]byte, streamLen)
+		if err := binary.Read(reader, binary.BigEndian, &c.b.stream); err != nil {
+			return err
+		}
+		// Summaries aren't stored, rebuild them decoding the chunk once
+		for _, r := range c.records() {
+			c.summary.Add(r)
+		}
+		// Chunks encoded before the introduction of blocks may
+		// cross their boundaries
+		ts.appendChunk(c)
+		ts.size += c.count
+	}
+	ts.Labels = nil
+	ts.Duplicates = DuplicateAllow
+	if reader.Len() == 0 {
+		return nil
+	}
+	var labels uint16
+	if err := binary.Read(reader, binary.BigEndian, &labels); err != nil {
+		return err
+	}
+	for i := 0; i < int(labels); i++ {
+		var str [2]string
+		for j := range str {
+			var strLen uint16
+			if err := binary.Read(reader, binary.BigEndian, &strLen); err != nil {
+				return err
+			}
+			b := make([]byte, strLen)
+			if err := binary.Read(reader, binary.BigEndian, &b); err != nil {
+				return err
+			}
+			str[j] = string(b)
+		}
+		ts.Labels = append(ts.Labels, Label{str[0], str[1]})
+	}
+	if reader.Len() == 0 {
+		return nil
+	}
+	if err := binary.Read(reader, binary.BigEndian, &ts.Duplicates); err != nil {
+		return err
+	}
+	if reader.Len() == 0 {
+		return nil
+	}
+	return binary.Read(reader, binary.BigEndian, &ts.Retention)
+}
@@ -0,0 +1,94 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTimeSeriesMarshalBinary(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 3e9)
+	ts.Labels = NewLabels(map[string]string{"host": "a", "region": "eu-west"})
+	ts.Duplicates = DuplicateSum
+	for i := 0; i < chunkSize*3/2; i++ {
+		ts.AddRecord(&Record{int64(i) * 1e9, float64(i) / 3})
+	}
+	b, err := ts.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to marshal TimeSeries: %v", err)
+	}
+	test := &TimeSeries{}
+	if err := test.UnmarshalBinary(b); err != nil {
+		t.Fatalf("Failed to unmarshal TimeSeries: %v", err)
+	}
+	if test.Name != ts.Name || test.Retention != ts.Retention ||
+		!test.ctime.Equal(ts.ctime) || test.Len() != ts.Len() {
+		t.Errorf("Failed to unmarshal TimeSeries, expected %v got %v", ts, test)
+	}
+	if !reflect.DeepEqual(test.Labels, ts.Labels) {
+		t.Errorf("Failed to unmarshal labels, expected %v got %v", ts.Labels, test.Labels)
+	}
+	if test.Duplicates != DuplicateSum {
+		t.Errorf("Failed to unmarshal duplicate policy, got %v", test.Duplicates)
+	}
+	// Decoded chunks must keep accepting new records
+	test.AddRecord(&Record{1e12, 2.4})
+	records := test.Records()
+	for i, r := range records[:len(records)-1] {
+		if r.Timestamp != int64(i)*1e9 || r.Value != float64(i)/3 {
+			t.Fatalf("Wrong record unmarshaled at %v, got %v", i, r)
+		}
+	}
+	if last, _ := test.Last(); last.Timestamp != 1e12 {
+		t.Errorf("Failed to add record to unmarshaled TimeSeries")
+	}
+}
+
+func TestTimeSeriesMarshalBinaryRetention(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 1500e3)
+	b, _ := ts.MarshalBinary()
+	test := &TimeSeries{}
+	if err := test.UnmarshalBinary(b); err != nil || test.Retention != 1500e3 {
+		t.Errorf("Expected a retention of 1500us got %v (%v)", test.Retention, err)
+	}
+	// Series encoded before nanoseconds retentions carry milliseconds,
+	// rounded up here
+	if err := test.UnmarshalBinary(b[:len(b)-8]); err != nil || test.Retention != 2e6 {
+		t.Errorf("Expected a retention of 2ms got %v (%v)", test.Retention, err)
+	}
+}
+
+func TestTimeSeriesClone(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	ts.AddRecord(&Record{1, 2.4})
+	clone := ts.Clone()
+	ts.AddRecord(&Record{2, 2.4})
+	if clone.Len() != 1 || len(clone.Records()) != 1 {
+		t.Errorf("Clone shares records with the original TimeSeries")
+	}
+}
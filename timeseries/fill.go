@@ -0,0 +1,152 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// FillPolicy tells how the empty windows of a windowed query are filled
+type FillPolicy byte
+
+const (
+	// FillNone leaves empty windows out
+	FillNone FillPolicy = iota
+	// FillNull fills empty windows with NaN
+	FillNull
+	// FillPrevious repeats the value of the previous window
+	FillPrevious
+	// FillLinear interpolates the values of the surrounding windows
+	FillLinear
+	// FillValue fills empty windows with a constant
+	FillValue
+)
+
+// maxFillWindows bounds the windows a fill can generate
+const maxFillWindows = 1 << 20
+
+var (
+	UnknownFillErr    = errors.New("unknown fill policy")
+	TooManyWindowsErr = errors.New("too many windows to fill")
+)
+
+// ParseFill parses a fill policy, NONE, NULL, PREVIOUS, LINEAR or a number
+// to fill with, returning the policy and its constant if any
+func ParseFill(str string) (FillPolicy, float64, error) {
+	switch strings.ToUpper(str) {
+	case "NONE":
+		return FillNone, 0, nil
+	case "NULL":
+		return FillNull, 0, nil
+	case "PREVIOUS":
+		return FillPrevious, 0, nil
+	case "LINEAR":
+		return FillLinear, 0, nil
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return FillNone, 0, UnknownFillErr
+	}
+	return FillValue, value, nil
+}
+
+// FillWindows fills the missing windows of interval nanoseconds in the
+// result of a windowed query, records must be sorted and timestamped with
+// the start of their windows. Windows are filled from the one including from
+// to the one including to, a zero bound stands for the first or the last
+// record. Windows that can't be filled, e.g. before the first record with
+// FillPrevious, are filled with NaN.
+func FillWindows(records []Record, interval, from, to int64,
+	policy FillPolicy, value float64) ([]Record, error) {
+	if policy == FillNone || interval <= 0 {
+		return records, nil
+	}
+	if len(records) > 0 {
+		if from == 0 {
+			from = records[0].Timestamp
+		}
+		if to == 0 {
+			to = records[len(records)-1].Timestamp
+		}
+	}
+	if from == 0 || to == 0 || from > to {
+		return records, nil
+	}
+	start := floorDiv(from, interval) * interval
+	end := floorDiv(to, interval) * interval
+	if (end-start)/interval >= maxFillWindows {
+		return nil, TooManyWindowsErr
+	}
+	result := make([]Record, 0, (end-start)/interval+1)
+	missing := make([]bool, 0, cap(result))
+	i := 0
+	for t := start; t <= end; t += interval {
+		for i < len(records) && records[i].Timestamp < t {
+			i++
+		}
+		if i < len(records) && records[i].Timestamp == t {
+			result = append(result, records[i])
+			missing = append(missing, false)
+			continue
+		}
+		result = append(result, Record{t, math.NaN()})
+		missing = append(missing, true)
+	}
+	switch policy {
+	case FillValue:
+		for i := range result {
+			if missing[i] {
+				result[i].Value = value
+			}
+		}
+	case FillPrevious:
+		for i := 1; i < len(result); i++ {
+			if missing[i] {
+				result[i].Value = result[i-1].Value
+			}
+		}
+	case FillLinear:
+		prev := -1
+		for i := range result {
+			if missing[i] {
+				continue
+			}
+			if prev >= 0 && i-prev > 1 {
+				a, b := result[prev], result[i]
+				slope := (b.Value - a.Value) / float64(b.Timestamp-a.Timestamp)
+				for j := prev + 1; j < i; j++ {
+					result[j].Value = a.Value + slope*float64(result[j].Timestamp-a.Timestamp)
+				}
+			}
+			prev = i
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,96 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseFill(t *testing.T) {
+	cases := map[string]FillPolicy{
+		"none": FillNone, "NULL": FillNull, "previous": FillPrevious,
+		"Linear": FillLinear, "-1.5": FillValue,
+	}
+	for str, expected := range cases {
+		if policy, _, err := ParseFill(str); err != nil || policy != expected {
+			t.Errorf("Failed to parse fill %v, got %v", str, policy)
+		}
+	}
+	if _, value, _ := ParseFill("-1.5"); value != -1.5 {
+		t.Errorf("Failed to parse constant fill, got %v", value)
+	}
+	if _, _, err := ParseFill("zero"); err != UnknownFillErr {
+		t.Errorf("Expected UnknownFillErr got %v", err)
+	}
+}
+
+func sameValue(a, b float64) bool {
+	return a == b || (math.IsNaN(a) && math.IsNaN(b))
+}
+
+func TestFillWindows(t *testing.T) {
+	// Windows of 10 seconds, from 10s to 60s with 20s, 30s and 50s empty
+	records := []Record{{10e9, 1}, {40e9, 4}, {60e9, 8}}
+	nan := math.NaN()
+	cases := []struct {
+		policy   FillPolicy
+		value    float64
+		from, to int64
+		expected []float64
+	}{
+		{FillNull, 0, 0, 0, []float64{1, nan, nan, 4, nan, 8}},
+		{FillValue, 0, 0, 0, []float64{1, 0, 0, 4, 0, 8}},
+		{FillPrevious, 0, 0, 0, []float64{1, 1, 1, 4, 4, 8}},
+		{FillLinear, 0, 0, 0, []float64{1, 2, 3, 4, 6, 8}},
+		// Bounds of the query extend the windows
+		{FillPrevious, 0, 5e9, 75e9, []float64{nan, 1, 1, 1, 4, 4, 8, 8}},
+		{FillLinear, 0, 5e9, 75e9, []float64{nan, 1, 2, 3, 4, 6, 8, nan}},
+	}
+	for _, c := range cases {
+		filled, err := FillWindows(records, 10e9, c.from, c.to, c.policy, c.value)
+		if err != nil {
+			t.Fatalf("Failed to fill windows: %v", err)
+		}
+		if len(filled) != len(c.expected) {
+			t.Fatalf("Expected %v windows got %v", len(c.expected), filled)
+		}
+		start := filled[0].Timestamp
+		for i, r := range filled {
+			if r.Timestamp != start+int64(i)*10e9 || !sameValue(r.Value, c.expected[i]) {
+				t.Errorf("Wrong fill %v, expected %v got %v", c.policy, c.expected, filled)
+				break
+			}
+		}
+	}
+	if filled, _ := FillWindows(records, 10e9, 0, 0, FillNone, 0); len(filled) != 3 {
+		t.Errorf("Expected FillNone to leave records untouched")
+	}
+	if _, err := FillWindows(records, 1e6, 1, 1e18, FillNull, 0); err != TooManyWindowsErr {
+		t.Errorf("Expected TooManyWindowsErr got %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"sort"
+	"sync"
+)
+
+// nameLabel indexes the names of the series along with their labels
+const nameLabel = "__name__"
+
+// Index is an inverted index from names and labels to the series carrying
+// them, it's safe for concurrent use
+type Index struct {
+	mu       sync.RWMutex
+	series   map[string]*TimeSeries
+	postings map[Label]map[string]struct{}
+}
+
+func NewIndex() *Index {
+	return &Index{
+		series:   make(map[string]*TimeSeries),
+		postings: make(map[Label]map[string]struct{}),
+	}
+}
+
+// indexLabels returns the labels of a TimeSeries including its name
+func indexLabels(ts *TimeSeries) Labels {
+	return append(Labels{{nameLabel, ts.Name}}, ts.Labels...)
+}
+
+// Add indexes a TimeSeries, replacing any series with the same key
+func (idx *Index) Add(ts *TimeSeries) {
+	key := ts.Key()
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.series[key] = ts
+	for _, l := range indexLabels(ts) {
+		if idx.postings[l] == nil {
+			idx.postings[l] = make(map[string]struct{})
+		}
+		idx.postings[l][key] = struct{}{}
+	}
+}
+
+// Remove drops a series from the index
+func (idx *Index) Remove(key string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	ts, ok := idx.series[key]
+	if !ok {
+		return
+	}
+	delete(idx.series, key)
+	for _, l := range indexLabels(ts) {
+		delete(idx.postings[l], key)
+		if len(idx.postings[l]) == 0 {
+			delete(idx.postings, l)
+		}
+	}
+}
+
+// Select returns the series matched by a selector sorted by key, candidates
+// are narrowed through the postings of the name and of the equality matchers
+// before checking every matcher
+func (idx *Index) Select(s *Selector) []*TimeSeries {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var candidates map[string]struct{} = nil
+	intersect := func(keys map[string]struct{}) {
+		if candidates == nil {
+			candidates = make(map[string]struct{}, len(keys))
+			for k := range keys {
+				candidates[k] = struct{}{}
+			}
+			return
+		}
+		for k := range candidates {
+			if _, ok := keys[k]; !ok {
+				delete(candidates, k)
+			}
+		}
+	}
+	if s.Name != "" {
+		intersect(idx.postings[Label{nameLabel, s.Name}])
+	}
+	for _, m := range s.Matchers {
+		if m.Type == MatchEqual && m.Value != "" {
+			intersect(idx.postings[Label{m.Name, m.Value}])
+		}
+	}
+	result := []*TimeSeries{}
+	if candidates == nil {
+		for _, ts := range idx.series {
+			if s.Matches(ts) {
+				result = append(result, ts)
+			}
+		}
+	} else {
+		for k := range candidates {
+			if ts := idx.series[k]; s.Matches(ts) {
+				result = append(result, ts)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key() < result[j].Key()
+	})
+	return result
+}
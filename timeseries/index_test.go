@@ -0,0 +1,99 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import "testing"
+
+func newLabeledSeries(name string, labels map[string]string) *TimeSeries {
+	ts := NewTimeSeries(name, 0)
+	ts.Labels = NewLabels(labels)
+	return ts
+}
+
+func selectKeys(idx *Index, selector string) []string {
+	s, err := ParseSelector(selector)
+	if err != nil {
+		panic(err)
+	}
+	keys := []string{}
+	for _, ts := range idx.Select(s) {
+		keys = append(keys, ts.Key())
+	}
+	return keys
+}
+
+func TestIndexSelect(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(newLabeledSeries("cpu", map[string]string{"host": "a", "region": "eu-west"}))
+	idx.Add(newLabeledSeries("cpu", map[string]string{"host": "b", "region": "eu-south"}))
+	idx.Add(newLabeledSeries("cpu", map[string]string{"host": "c", "region": "us-east"}))
+	idx.Add(newLabeledSeries("mem", map[string]string{"host": "a", "region": "eu-west"}))
+	idx.Add(NewTimeSeries("cpu", 0))
+	cases := map[string][]string{
+		`cpu{region=~"eu-.*"}`: {
+			`cpu{host="a",region="eu-west"}`,
+			`cpu{host="b",region="eu-south"}`,
+		},
+		`{host="a"}`: {
+			`cpu{host="a",region="eu-west"}`,
+			`mem{host="a",region="eu-west"}`,
+		},
+		`cpu{host!~"a|b"}`: {
+			`cpu`,
+			`cpu{host="c",region="us-east"}`,
+		},
+		`cpu{host="a",region="us-east"}`: {},
+		`disk`:                           {},
+	}
+	for sel, expected := range cases {
+		keys := selectKeys(idx, sel)
+		if len(keys) != len(expected) {
+			t.Errorf("Expected %v for %q got %v", expected, sel, keys)
+			continue
+		}
+		for i := range keys {
+			if keys[i] != expected[i] {
+				t.Errorf("Expected %v for %q got %v", expected, sel, keys)
+			}
+		}
+	}
+}
+
+func TestIndexRemove(t *testing.T) {
+	idx := NewIndex()
+	ts := newLabeledSeries("cpu", map[string]string{"host": "a"})
+	idx.Add(ts)
+	idx.Add(newLabeledSeries("cpu", map[string]string{"host": "b"}))
+	idx.Remove(ts.Key())
+	if keys := selectKeys(idx, `cpu`); len(keys) != 1 || keys[0] != `cpu{host="b"}` {
+		t.Errorf("Failed to remove series from the index, got %v", keys)
+	}
+	if len(idx.postings[Label{"host", "a"}]) != 0 {
+		t.Errorf("Failed to remove postings of removed series")
+	}
+	idx.Remove("missing")
+}
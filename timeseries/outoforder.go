@@ -0,0 +1,171 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+)
+
+// Number of late records buffered before merging them into the chunks
+const outOfOrderBufferSize = chunkSize
+
+var (
+	OutOfOrderErr = errors.New("record older than the out-of-order window")
+)
+
+// bufferRecord adds a late record to the out-of-order buffer, after the
+// buffered records with the same timestamp. Once full the buffer is merged
+// right away, otherwise it's left to periodic calls to Flush, reads merge it
+// on the fly.
+func (ts *TimeSeries) bufferRecord(record *Record) {
+	i := sort.Search(len(ts.ooo), func(i int) bool {
+		return ts.ooo[i].Timestamp > record.Timestamp
+	})
+	ts.ooo = append(ts.ooo, Record{})
+	copy(ts.ooo[i+1:], ts.ooo[i:])
+	ts.ooo[i] = *record
+	if len(ts.ooo) >= outOfOrderBufferSize {
+		ts.Flush()
+	}
+}
+
+// Pending returns the number of late records waiting to be merged into the
+// chunks
+func (ts *TimeSeries) Pending() int {
+	return len(ts.ooo)
+}
+
+// spans calls f for each span of time holding records in order, with its
+// block and the late records pending in it. Spans with late records only
+// come with a nil block. It stops at the first error returned by f, or as
+// soon as ctx is done, returning the error.
+func (ts *TimeSeries) spans(ctx context.Context, f func(b *block, late []Record) error) error {
+	late := ts.ooo
+	// lateOnly consumes the late records preceding the timestamp t
+	lateOnly := func(t int64) error {
+		for len(late) > 0 && late[0].Timestamp < t {
+			end := blockStart(late[0].Timestamp) + blockSpan
+			i := sort.Search(len(late), func(i int) bool {
+				return late[i].Timestamp >= end
+			})
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := f(nil, late[:i]); err != nil {
+				return err
+			}
+			late = late[i:]
+		}
+		return nil
+	}
+	for _, b := range ts.blocks {
+		if err := lateOnly(b.start); err != nil {
+			return err
+		}
+		i := sort.Search(len(late), func(i int) bool {
+			return late[i].Timestamp >= b.start+blockSpan
+		})
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := f(b, late[:i]); err != nil {
+			return err
+		}
+		late = late[i:]
+	}
+	return lateOnly(math.MaxInt64)
+}
+
+// Flush merges the buffered late records into the blocks of their spans,
+// each chunk covering some of them is decoded and rewritten once, split in
+// more chunks if it grows beyond the maximum size. Late records falling in
+// spans with no records yet start new blocks.
+func (ts *TimeSeries) Flush() {
+	if len(ts.ooo) == 0 {
+		return
+	}
+	blocks := make([]*block, 0, len(ts.blocks)+1)
+	ts.spans(context.Background(), func(b *block, late []Record) error {
+		if b == nil {
+			blocks = append(blocks, newBlocksFrom(late)...)
+			return nil
+		}
+		if len(late) > 0 {
+			b.merge(late)
+		}
+		blocks = append(blocks, b)
+		return nil
+	})
+	ts.blocks = blocks
+	ts.ooo = nil
+}
+
+// merge adds ordered late records falling in the span of the block to its
+// chunks
+func (b *block) merge(late []Record) {
+	chunks := make([]*chunk, 0, len(b.chunks)+len(late)/chunkSize+1)
+	for i, c := range b.chunks {
+		// Late records with the same timestamp of the end of a chunk go
+		// to the next one, after the records already there, the last
+		// chunk takes all the records left
+		j := len(late)
+		if i < len(b.chunks)-1 {
+			j = sort.Search(len(late), func(j int) bool {
+				return late[j].Timestamp >= c.maxT()
+			})
+		}
+		if j == 0 {
+			chunks = append(chunks, c)
+			continue
+		}
+		chunks = append(chunks, splitChunks(mergeRecords(c.records(), late[:j]))...)
+		late = late[j:]
+	}
+	b.chunks = chunks
+	b.resummarize()
+}
+
+// mergeRecords merges two sorted slices of records, records of a come first
+// on equal timestamps
+func mergeRecords(a, b []Record) []Record {
+	merged := make([]Record, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].Timestamp <= b[j].Timestamp {
+			merged = append(merged, a[i])
+			i++
+		} else {
+			merged = append(merged, b[j])
+			j++
+		}
+	}
+	merged = append(merged, a[i:]...)
+	return append(merged, b[j:]...)
+}
@@ -0,0 +1,193 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestTimeSeriesOutOfOrderBuffer(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	const n = 1000
+	for i := 0; i < n; i += 2 {
+		ts.AddRecord(&Record{int64(i), float64(i)})
+	}
+	// Backfill the odd timestamps, newest first
+	for i := n - 1; i > 0; i -= 2 {
+		if _, err := ts.AddRecord(&Record{int64(i), float64(i)}); err != nil {
+			t.Fatalf("Failed to add late record: %v", err)
+		}
+	}
+	if ts.Len() != n {
+		t.Errorf("Expected %v records got %v", n, ts.Len())
+	}
+	// Reads merge the pending late records on the fly, leaving them to
+	// Flush
+	pending := ts.Pending()
+	if pending == 0 {
+		t.Fatalf("Expected pending late records")
+	}
+	for _, flush := range []bool{false, true} {
+		expected := pending
+		if flush {
+			ts.Flush()
+			expected = 0
+		}
+		records := ts.Records()
+		if len(records) != n {
+			t.Fatalf("Failed to merge late records, got %v records", len(records))
+		}
+		for i, r := range records {
+			if r.Timestamp != int64(i) || r.Value != float64(i) {
+				t.Fatalf("Expected record %v got %v", i, r)
+			}
+		}
+		if ts.Pending() != expected {
+			t.Errorf("Unexpected %v pending late records", ts.Pending())
+		}
+	}
+	for _, b := range ts.blocks {
+		for _, c := range b.chunks {
+			if c.count > chunkSize {
+				t.Errorf("Expected chunks of at most %v records got %v", chunkSize, c.count)
+			}
+		}
+	}
+}
+
+func TestTimeSeriesOutOfOrderSameTimestamp(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	ts.AddRecord(&Record{1, 1})
+	ts.AddRecord(&Record{2, 2})
+	ts.AddRecord(&Record{1, 3})
+	ts.AddRecord(&Record{1, 4})
+	expected := []Record{{1, 1}, {1, 3}, {1, 4}, {2, 2}}
+	records := ts.Records()
+	for i := range expected {
+		if records[i] != expected[i] {
+			t.Fatalf("Expected %v got %v", expected, records)
+		}
+	}
+}
+
+func TestTimeSeriesOutOfOrderWindow(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	ts.OutOfOrderWindow = 1e9
+	ts.AddRecord(&Record{10e9, 1})
+	if _, err := ts.AddRecord(&Record{9e9, 2}); err != nil {
+		t.Errorf("Failed to add record within the window: %v", err)
+	}
+	if _, err := ts.AddRecord(&Record{9e9 - 1, 3}); err != OutOfOrderErr {
+		t.Errorf("Expected OutOfOrderErr got %v", err)
+	}
+	if ts.Len() != 2 {
+		t.Errorf("Expected 2 records got %v", ts.Len())
+	}
+}
+
+func TestTimeSeriesExpireOutOfOrder(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	for i := 0; i < 10; i++ {
+		ts.AddRecord(&Record{int64(i) * 10, 1})
+	}
+	ts.AddRecord(&Record{5, 1})
+	ts.AddRecord(&Record{55, 1})
+	if n := ts.expireBefore(50); n != 6 || ts.Len() != 6 {
+		t.Errorf("Expected 6 records expired and 6 left, got %v %v", n, ts.Len())
+	}
+	if first, _ := ts.First(); first.Timestamp != 50 {
+		t.Errorf("Expected first record at 50 got %v", first)
+	}
+}
+
+func TestTimeSeriesReadsPendingLate(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	for i := int64(0); i < 300; i++ {
+		ts.AddRecord(&Record{i * 60e9, float64(i % 7)})
+	}
+	// Late records in a span with no records, on the end of a chunk and
+	// in the middle of the series
+	late := []Record{{-blockSpan, 1}, {119 * 60e9, 2}, {120*60e9 + 1, 3}, {5000e9, 4}}
+	for i := range late {
+		ts.AddRecord(&late[i])
+	}
+	merged := ts.Clone()
+	merged.Flush()
+	if ts.Pending() != len(late) || merged.Pending() != 0 {
+		t.Fatalf("Expected %v late records pending got %v", len(late), ts.Pending())
+	}
+	if !reflect.DeepEqual(ts.Records(), merged.Records()) {
+		t.Errorf("Records differ from the merged ones")
+	}
+	first, _ := ts.First()
+	if *first != late[0] {
+		t.Errorf("Expected first record %v got %v", late[0], first)
+	}
+	for _, timestamp := range []int64{late[1].Timestamp, late[2].Timestamp, 200 * 60e9} {
+		r1, i1 := ts.Find(timestamp)
+		r2, i2 := merged.Find(timestamp)
+		if r1 == nil || r2 == nil || *r1 != *r2 || i1 != i2 {
+			t.Errorf("Find %v expected %v at %v got %v at %v", timestamp, r2, i2, r1, i1)
+		}
+	}
+	for _, b := range [][2]int64{{math.MinInt64, math.MaxInt64}, {0, 150 * 60e9}} {
+		s1, s2 := ts.Summarize(b[0], b[1]), merged.Summarize(b[0], b[1])
+		if s1.Count != s2.Count || s1.Sum != s2.Sum || s1.Min != s2.Min ||
+			s1.Max != s2.Max || s1.First != s2.First || s1.Last != s2.Last ||
+			math.Abs(s1.Value(AggVariance)-s2.Value(AggVariance)) > 1e-9 {
+			t.Errorf("Summary of %v expected %v got %v", b, s2, s1)
+		}
+		r1, _ := ts.AggregateRange(AggAvg, 3600e9, b[0], b[1])
+		r2, _ := merged.AggregateRange(AggAvg, 3600e9, b[0], b[1])
+		if !reflect.DeepEqual(r1, r2) {
+			t.Errorf("Aggregation of %v expected %v got %v", b, r2, r1)
+		}
+		t1, _ := ts.Range(b[0], b[1])
+		t2, _ := merged.Range(b[0], b[1])
+		if t1.Len() != t2.Len() || !reflect.DeepEqual(t1.Records(), t2.Records()) {
+			t.Errorf("Range of %v differs from the merged one", b)
+		}
+	}
+	if _, err := ts.MarshalBinary(); err != nil {
+		t.Fatalf("Failed to marshal TimeSeries: %v", err)
+	}
+	if ts.Pending() != len(late) {
+		t.Errorf("Reads merged the late records, %v pending", ts.Pending())
+	}
+}
+
+func BenchmarkTimeSeriesBackfill(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		ts := NewTimeSeries("test-ts", 0)
+		for j := 10000; j > 0; j-- {
+			ts.AddRecord(&Record{int64(j) * 1e9, float64(j)})
+		}
+		ts.Flush()
+	}
+}
@@ -0,0 +1,209 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// exactQuantileLimit is the number of values a QuantileSketch keeps as
+	// they are, beyond it values are summarized by a DDSketch
+	exactQuantileLimit = 1024
+	// sketchAccuracy is the relative accuracy of the quantiles estimated
+	// by a DDSketch
+	sketchAccuracy = 0.01
+	// minSketchValue is the smallest magnitude told apart from zero
+	minSketchValue = 1e-9
+)
+
+var (
+	InvalidQuantileErr = errors.New("quantile must be between 0 and 1")
+)
+
+// ParseQuantile parses a percentile in the Pnn form, e.g. P99 or P99.9,
+// returning the corresponding quantile
+func ParseQuantile(name string) (float64, error) {
+	if len(name) < 2 || strings.ToUpper(name[:1]) != "P" {
+		return 0, InvalidQuantileErr
+	}
+	p, err := strconv.ParseFloat(name[1:], 64)
+	if err != nil || p < 0 || p > 100 {
+		return 0, InvalidQuantileErr
+	}
+	return p / 100, nil
+}
+
+// QuantileSketch estimates the quantiles of a stream of values, they're
+// exact as long as the values are few, otherwise they're estimated by a
+// DDSketch with a relative error bounded by sketchAccuracy
+type QuantileSketch struct {
+	values []float64
+	sorted bool
+	sketch *ddsketch
+}
+
+func NewQuantileSketch() *QuantileSketch {
+	return &QuantileSketch{}
+}
+
+// Add adds a value to the sketch, NaN values are ignored
+func (s *QuantileSketch) Add(value float64) {
+	if math.IsNaN(value) {
+		return
+	}
+	if s.sketch != nil {
+		s.sketch.add(value)
+		return
+	}
+	s.values = append(s.values, value)
+	s.sorted = false
+	if len(s.values) > exactQuantileLimit {
+		s.sketch = newDDSketch(sketchAccuracy)
+		for _, v := range s.values {
+			s.sketch.add(v)
+		}
+		s.values = nil
+	}
+}
+
+// Count returns the number of values added to the sketch
+func (s *QuantileSketch) Count() int {
+	if s.sketch != nil {
+		return s.sketch.count
+	}
+	return len(s.values)
+}
+
+// Quantile returns the q-quantile of the values, NaN if there are none.
+// Exact quantiles are linearly interpolated between the closest ranks.
+func (s *QuantileSketch) Quantile(q float64) float64 {
+	if s.Count() == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+	if s.sketch != nil {
+		return s.sketch.quantile(q)
+	}
+	if !s.sorted {
+		sort.Float64s(s.values)
+		s.sorted = true
+	}
+	rank := q * float64(len(s.values)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return s.values[lo] + (s.values[hi]-s.values[lo])*(rank-float64(lo))
+}
+
+// ddsketch maps values to logarithmic buckets, so that every value in a
+// bucket is within a relative distance from the bucket value, see
+// https://arxiv.org/abs/1908.10693
+type ddsketch struct {
+	gamma    float64
+	logGamma float64
+	positive map[int]int
+	negative map[int]int
+	zeros    int
+	count    int
+	min, max float64
+}
+
+func newDDSketch(accuracy float64) *ddsketch {
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &ddsketch{
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		positive: make(map[int]int),
+		negative: make(map[int]int),
+		min:      math.Inf(1),
+		max:      math.Inf(-1),
+	}
+}
+
+func (d *ddsketch) index(value float64) int {
+	return int(math.Ceil(math.Log(value) / d.logGamma))
+}
+
+func (d *ddsketch) value(index int) float64 {
+	return 2 * math.Pow(d.gamma, float64(index)) / (d.gamma + 1)
+}
+
+func (d *ddsketch) add(value float64) {
+	switch {
+	case value > minSketchValue:
+		d.positive[d.index(value)]++
+	case value < -minSketchValue:
+		d.negative[d.index(-value)]++
+	default:
+		d.zeros++
+	}
+	d.count++
+	d.min = math.Min(d.min, value)
+	d.max = math.Max(d.max, value)
+}
+
+func (d *ddsketch) quantile(q float64) float64 {
+	rank := q * float64(d.count-1)
+	// Negative buckets come first, from the largest magnitude
+	negative := sortedKeys(d.negative)
+	sort.Sort(sort.Reverse(sort.IntSlice(negative)))
+	var cumulative float64 = 0
+	estimate := d.max
+	found := false
+	for _, i := range negative {
+		if cumulative += float64(d.negative[i]); cumulative > rank {
+			estimate, found = -d.value(i), true
+			break
+		}
+	}
+	if !found {
+		if cumulative += float64(d.zeros); cumulative > rank {
+			estimate, found = 0, true
+		}
+	}
+	if !found {
+		for _, i := range sortedKeys(d.positive) {
+			if cumulative += float64(d.positive[i]); cumulative > rank {
+				estimate = d.value(i)
+				break
+			}
+		}
+	}
+	return math.Max(d.min, math.Min(d.max, estimate))
+}
+
+func sortedKeys(m map[int]int) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
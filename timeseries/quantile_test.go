@@ -0,0 +1,120 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestParseQuantile(t *testing.T) {
+	cases := map[string]float64{"P99": 0.99, "p50": 0.5, "P99.9": 0.999, "P0": 0, "P100": 1}
+	for name, expected := range cases {
+		if q, err := ParseQuantile(name); err != nil || math.Abs(q-expected) > 1e-12 {
+			t.Errorf("Failed to parse %v, expected %v got %v", name, expected, q)
+		}
+	}
+	for _, name := range []string{"P", "P101", "Q99", "P-1", "PX"} {
+		if _, err := ParseQuantile(name); err != InvalidQuantileErr {
+			t.Errorf("Expected %v to be an invalid quantile", name)
+		}
+	}
+}
+
+func TestQuantileSketchExact(t *testing.T) {
+	s := NewQuantileSketch()
+	if !math.IsNaN(s.Quantile(0.5)) {
+		t.Errorf("Expected NaN quantile of an empty sketch")
+	}
+	for _, v := range []float64{5, 1, 4, 2, 3, math.NaN()} {
+		s.Add(v)
+	}
+	cases := map[float64]float64{0: 1, 0.5: 3, 1: 5, 0.25: 2, 0.9: 4.6}
+	for q, expected := range cases {
+		if v := s.Quantile(q); math.Abs(v-expected) > 1e-9 {
+			t.Errorf("Wrong %v quantile, expected %v got %v", q, expected, v)
+		}
+	}
+	if s.Count() != 5 {
+		t.Errorf("Expected NaN to be ignored, got %v values", s.Count())
+	}
+}
+
+func TestQuantileSketchEstimated(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	s := NewQuantileSketch()
+	values := make([]float64, 100000)
+	for i := range values {
+		// Latencies spanning a few orders of magnitude, some negative
+		values[i] = math.Exp(r.NormFloat64()*2) - 0.1
+		s.Add(values[i])
+	}
+	if s.sketch == nil {
+		t.Fatalf("Expected large windows to be summarized")
+	}
+	sort.Float64s(values)
+	for _, q := range []float64{0, 0.01, 0.25, 0.5, 0.9, 0.95, 0.99, 0.999, 1} {
+		exact := values[int(q*float64(len(values)-1))]
+		estimate := s.Quantile(q)
+		if math.Abs(estimate-exact) > sketchAccuracy*math.Abs(exact)+1e-9 {
+			t.Errorf("Quantile %v out of bounds, expected %v got %v", q, exact, estimate)
+		}
+	}
+}
+
+func TestTimeSeriesQuantile(t *testing.T) {
+	ts := NewTimeSeries("latency", 0)
+	for i := int64(0); i < 200; i++ {
+		ts.AddRecord(&Record{i * 1e9, float64(i % 100)})
+	}
+	records, err := ts.Quantile(0.99, 100e9)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Failed to compute windowed quantiles: %v %v", records, err)
+	}
+	for i, r := range records {
+		if r.Timestamp != int64(i)*100e9 || math.Abs(r.Value-98.01) > 1e-9 {
+			t.Errorf("Wrong P99 of window %v, got %v", i, r)
+		}
+	}
+	if _, err := ts.Quantile(1.5, 1e9); err != InvalidQuantileErr {
+		t.Errorf("Expected InvalidQuantileErr got %v", err)
+	}
+	if _, err := ts.Aggregate(AggQuantile, 1e9); err != UnknownAggregationErr {
+		t.Errorf("Expected quantiles to be computed only through Quantile")
+	}
+}
+
+func BenchmarkQuantileSketch(b *testing.B) {
+	r := rand.New(rand.NewSource(42))
+	s := NewQuantileSketch()
+	for i := 0; i < b.N; i++ {
+		s.Add(r.ExpFloat64())
+	}
+	s.Quantile(0.99)
+}
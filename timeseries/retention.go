@@ -0,0 +1,113 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"sort"
+	"time"
+)
+
+// Clock is the source of the current time used by a TimeSeries to generate
+// timestamps and to evaluate its retention window
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SetClock replace the clock of the TimeSeries, mainly useful to simulate the
+// passing of time
+func (ts *TimeSeries) SetClock(clock Clock) {
+	ts.clock = clock
+}
+
+// Expire evicts all the records older than the retention window of the
+// TimeSeries, according to its clock, and returns the number of records
+// removed
+func (ts *TimeSeries) Expire() int {
+	if ts.Retention <= 0 {
+		return 0
+	}
+	return ts.expireBefore(ts.clock.Now().UnixNano() - ts.Retention)
+}
+
+// expireOnWrite evicts the records that fell out of the retention window
+// relative to the most recent record of the TimeSeries, this way a write
+// never evicts records only because they were ingested with old timestamps
+func (ts *TimeSeries) expireOnWrite() int {
+	last, err := ts.Last()
+	if ts.Retention <= 0 || err != nil {
+		return 0
+	}
+	return ts.expireBefore(last.Timestamp - ts.Retention)
+}
+
+func (ts *TimeSeries) expireBefore(cutoff int64) int {
+	// Whole blocks and chunks out of the window are simply dropped
+	n := sort.Search(len(ts.blocks), func(i int) bool {
+		return ts.blocks[i].maxT() >= cutoff
+	})
+	evicted := 0
+	for i := 0; i < n; i++ {
+		evicted += ts.blocks[i].count()
+		ts.blocks[i] = nil
+	}
+	ts.blocks = ts.blocks[n:]
+	if len(ts.blocks) > 0 && ts.blocks[0].minT() < cutoff {
+		b := ts.blocks[0]
+		m := sort.Search(len(b.chunks), func(i int) bool {
+			return b.chunks[i].maxT() >= cutoff
+		})
+		for _, c := range b.chunks[:m] {
+			evicted += c.count
+		}
+		b.chunks = append([]*chunk(nil), b.chunks[m:]...)
+		// The first chunk left may still straddle the cutoff, in that
+		// case it gets rewritten without the expired records
+		if b.chunks[0].minT < cutoff {
+			records := b.chunks[0].records()
+			j := sort.Search(len(records), func(j int) bool {
+				return records[j].Timestamp >= cutoff
+			})
+			b.chunks[0] = newChunkFrom(records[j:])
+			evicted += j
+		}
+		b.resummarize()
+	}
+	// Buffered late records are dropped without being merged
+	j := sort.Search(len(ts.ooo), func(j int) bool {
+		return ts.ooo[j].Timestamp >= cutoff
+	})
+	ts.ooo = ts.ooo[j:]
+	evicted += j
+	ts.size -= evicted
+	return evicted
+}
@@ -0,0 +1,106 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestTimeSeriesExpire(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	ts := NewTimeSeries("test-ts", 3e9)
+	ts.SetClock(clock)
+	ts.AddPoint(98.2)
+	clock.Advance(time.Second)
+	ts.AddPoint(106.2)
+	clock.Advance(time.Second)
+	ts.AddPoint(97.5)
+	clock.Advance(1500 * time.Millisecond)
+	if n := ts.Expire(); n != 1 {
+		t.Errorf("Expire evicted the wrong number of records, expected %v got %v", 1, n)
+	}
+	first, _ := ts.First()
+	if ts.Len() != 2 || first.Value != 106.2 {
+		t.Errorf("Expire evicted the wrong records")
+	}
+	clock.Advance(time.Hour)
+	if n := ts.Expire(); n != 2 || ts.Len() != 0 {
+		t.Errorf("Expire evicted the wrong number of records, expected %v got %v", 2, n)
+	}
+}
+
+func TestTimeSeriesExpireOnWrite(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	ts := NewTimeSeries("test-ts", 3e9)
+	ts.SetClock(clock)
+	ts.AddPoint(98.2)
+	ts.AddPoint(106.2)
+	clock.Advance(5 * time.Second)
+	ts.AddPoint(97.5)
+	if ts.Len() != 1 {
+		t.Errorf("Expected expired records to be evicted on write, got %v records", ts.Len())
+	}
+	// A record already out of the retention window is dropped right away
+	ts.AddRecord(&Record{Timestamp: time.Unix(1000, 0).UnixNano(), Value: 2.4})
+	if ts.Len() != 1 {
+		t.Errorf("Expected stale record to be evicted on write, got %v records", ts.Len())
+	}
+}
+
+func TestTimeSeriesExpireOnWriteOldTimestamps(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 3e9)
+	ts.AddRecord(&Record{Timestamp: 1e9, Value: 2.4})
+	ts.AddRecord(&Record{Timestamp: 3e9, Value: 2.4})
+	ts.AddRecord(&Record{Timestamp: 5e9, Value: 2.4})
+	if ts.Len() != 2 {
+		t.Errorf("Expected write eviction relative to the last record, got %v records", ts.Len())
+	}
+}
+
+func TestTimeSeriesExpireNoRetention(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	ts := NewTimeSeries("test-ts", 0)
+	ts.SetClock(clock)
+	ts.AddPoint(98.2)
+	clock.Advance(24 * time.Hour)
+	if n := ts.Expire(); n != 0 || ts.Len() != 1 {
+		t.Errorf("Expected no eviction on TimeSeries without retention")
+	}
+}
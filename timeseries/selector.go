@@ -0,0 +1,254 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Matcher types of a selector
+const (
+	MatchEqual = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+var (
+	InvalidSelectorErr  = errors.New("invalid selector")
+	InvalidSeriesKeyErr = errors.New("invalid series key")
+)
+
+// Matcher matches the value of a label, a missing label matches as an empty
+// value
+type Matcher struct {
+	Type  int
+	Name  string
+	Value string
+	re    *regexp.Regexp
+}
+
+func NewMatcher(matchType int, name, value string) (*Matcher, error) {
+	m := &Matcher{Type: matchType, Name: name, Value: value}
+	if matchType == MatchRegexp || matchType == MatchNotRegexp {
+		// Regular expressions must match the whole value
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+func (m *Matcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+// Selector selects series by name and labels, in the form
+//
+//	name{label="value",label!="value",label=~"regexp",label!~"regexp"}
+//
+// where either the name or the label matchers can be omitted
+type Selector struct {
+	Name     string
+	Matchers []*Matcher
+}
+
+// Matches returns true if the TimeSeries is selected
+func (s *Selector) Matches(ts *TimeSeries) bool {
+	if s.Name != "" && s.Name != ts.Name {
+		return false
+	}
+	for _, m := range s.Matchers {
+		if !m.Matches(ts.Labels.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSelector parses a selector string
+func ParseSelector(str string) (*Selector, error) {
+	s := &Selector{}
+	i := strings.IndexByte(str, '{')
+	if i < 0 {
+		s.Name = strings.TrimSpace(str)
+		if !validName(s.Name) {
+			return nil, InvalidSelectorErr
+		}
+		return s, nil
+	}
+	s.Name = strings.TrimSpace(str[:i])
+	if s.Name != "" && !validName(s.Name) {
+		return nil, InvalidSelectorErr
+	}
+	sc := &scanner{str: str, pos: i + 1}
+	for {
+		sc.skipSpaces()
+		if sc.consume("}") {
+			break
+		}
+		if len(s.Matchers) > 0 && !sc.consume(",") {
+			return nil, InvalidSelectorErr
+		}
+		sc.skipSpaces()
+		name := sc.labelName()
+		if name == "" {
+			return nil, InvalidSelectorErr
+		}
+		sc.skipSpaces()
+		var matchType int
+		switch {
+		case sc.consume("=~"):
+			matchType = MatchRegexp
+		case sc.consume("!~"):
+			matchType = MatchNotRegexp
+		case sc.consume("!="):
+			matchType = MatchNotEqual
+		case sc.consume("="):
+			matchType = MatchEqual
+		default:
+			return nil, InvalidSelectorErr
+		}
+		sc.skipSpaces()
+		value, err := sc.quoted()
+		if err != nil {
+			return nil, err
+		}
+		m, err := NewMatcher(matchType, name, value)
+		if err != nil {
+			return nil, err
+		}
+		s.Matchers = append(s.Matchers, m)
+	}
+	sc.skipSpaces()
+	if sc.pos != len(str) || (s.Name == "" && len(s.Matchers) == 0) {
+		return nil, InvalidSelectorErr
+	}
+	return s, nil
+}
+
+// ParseSeriesKey parses the key of a single series, a selector with a name
+// and equality matchers only, returning its name and labels
+func ParseSeriesKey(str string) (string, Labels, error) {
+	s, err := ParseSelector(str)
+	if err != nil || s.Name == "" {
+		return "", nil, InvalidSeriesKeyErr
+	}
+	labels := make(Labels, 0, len(s.Matchers))
+	for _, m := range s.Matchers {
+		if m.Type != MatchEqual || m.Value == "" {
+			return "", nil, InvalidSeriesKeyErr
+		}
+		labels = append(labels, Label{m.Name, m.Value})
+	}
+	sort.Sort(labels)
+	for i := 1; i < len(labels); i++ {
+		if labels[i].Name == labels[i-1].Name {
+			return "", nil, InvalidSeriesKeyErr
+		}
+	}
+	return s.Name, labels, nil
+}
+
+// validName checks that a series name can't be mistaken for a selector
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "{}\"=, \t\n")
+}
+
+type scanner struct {
+	str string
+	pos int
+}
+
+func (sc *scanner) skipSpaces() {
+	for sc.pos < len(sc.str) && strings.IndexByte(" \t\n", sc.str[sc.pos]) >= 0 {
+		sc.pos++
+	}
+}
+
+func (sc *scanner) consume(prefix string) bool {
+	if strings.HasPrefix(sc.str[sc.pos:], prefix) {
+		sc.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+// labelName scans a label name, [a-zA-Z_][a-zA-Z0-9_]*
+func (sc *scanner) labelName() string {
+	start := sc.pos
+	for sc.pos < len(sc.str) {
+		c := sc.str[sc.pos]
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9' && sc.pos > start) {
+			sc.pos++
+			continue
+		}
+		break
+	}
+	return sc.str[start:sc.pos]
+}
+
+// quoted scans a double quoted string, with Go escapes
+func (sc *scanner) quoted() (string, error) {
+	if !sc.consume("\"") {
+		return "", InvalidSelectorErr
+	}
+	start := sc.pos - 1
+	for sc.pos < len(sc.str) {
+		switch sc.str[sc.pos] {
+		case '\\':
+			sc.pos += 2
+			continue
+		case '"':
+			sc.pos++
+			value, err := strconv.Unquote(sc.str[start:sc.pos])
+			if err != nil {
+				return "", InvalidSelectorErr
+			}
+			return value, nil
+		}
+		sc.pos++
+	}
+	return "", InvalidSelectorErr
+}
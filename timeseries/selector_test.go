@@ -0,0 +1,131 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeriesKey(t *testing.T) {
+	labels := NewLabels(map[string]string{"region": "eu", "host": "a\"b"})
+	if key := SeriesKey("cpu", labels); key != `cpu{host="a\"b",region="eu"}` {
+		t.Errorf("Failed to build series key, got %v", key)
+	}
+	if key := SeriesKey("cpu", nil); key != "cpu" {
+		t.Errorf("Failed to build series key without labels, got %v", key)
+	}
+}
+
+func TestParseSeriesKey(t *testing.T) {
+	name, labels, err := ParseSeriesKey(`cpu{ region="eu", host="a\"b" }`)
+	if err != nil {
+		t.Fatalf("Failed to parse series key: %v", err)
+	}
+	expected := Labels{{"host", "a\"b"}, {"region", "eu"}}
+	if name != "cpu" || !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Failed to parse series key, got %v %v", name, labels)
+	}
+	if SeriesKey(name, labels) != `cpu{host="a\"b",region="eu"}` {
+		t.Errorf("Series key is not canonical")
+	}
+	invalid := []string{
+		`{host="a"}`,
+		`cpu{host=~"a"}`,
+		`cpu{host="a",host="b"}`,
+		`cpu{host=""}`,
+		``,
+	}
+	for _, key := range invalid {
+		if _, _, err := ParseSeriesKey(key); err == nil {
+			t.Errorf("Expected %q to be an invalid series key", key)
+		}
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	s, err := ParseSelector(`cpu{host="a",region=~"eu-.*", dc!="x",rack!~"r1|r2"}`)
+	if err != nil {
+		t.Fatalf("Failed to parse selector: %v", err)
+	}
+	if s.Name != "cpu" || len(s.Matchers) != 4 {
+		t.Fatalf("Failed to parse selector, got %v", s)
+	}
+	types := []int{MatchEqual, MatchRegexp, MatchNotEqual, MatchNotRegexp}
+	for i, m := range s.Matchers {
+		if m.Type != types[i] {
+			t.Errorf("Expected matcher type %v got %v", types[i], m.Type)
+		}
+	}
+	if s, err := ParseSelector(`{host="a"}`); err != nil || s.Name != "" {
+		t.Errorf("Failed to parse selector without name: %v", err)
+	}
+	invalid := []string{
+		`cpu{host="a"`,
+		`cpu{host=a}`,
+		`cpu{host="a"}x`,
+		`cpu{host~"a"}`,
+		`cpu{1host="a"}`,
+		`cpu{host=~"("}`,
+		`cpu{host="a" region="b"}`,
+		`{}`,
+		`cpu x`,
+	}
+	for _, sel := range invalid {
+		if _, err := ParseSelector(sel); err == nil {
+			t.Errorf("Expected %q to be an invalid selector", sel)
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	ts := NewTimeSeries("cpu", 0)
+	ts.Labels = NewLabels(map[string]string{"host": "a", "region": "eu-west"})
+	cases := map[string]bool{
+		`cpu`:                        true,
+		`mem`:                        false,
+		`cpu{host="a"}`:              true,
+		`cpu{host="b"}`:              false,
+		`{region=~"eu-.*"}`:          true,
+		`{region=~"eu"}`:             false,
+		`cpu{host!="a"}`:             false,
+		`cpu{dc=""}`:                 true,
+		`cpu{region!~"us-.*"}`:       true,
+		`cpu{host="a",region="eu"}`:  false,
+		`cpu{host="a",dc!~".+"}`:     true,
+		`cpu{host=~"a|b",dc!="dc1"}`: true,
+	}
+	for sel, expected := range cases {
+		s, err := ParseSelector(sel)
+		if err != nil {
+			t.Fatalf("Failed to parse selector %q: %v", sel, err)
+		}
+		if s.Matches(ts) != expected {
+			t.Errorf("Expected %q to match %v", sel, expected)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"context"
+	"math"
+)
+
+// Summary holds precomputed statistics of a set of records, summaries of
+// adjacent sets can be merged without decoding their records. Variance is
+// kept with the Welford's online algorithm and merged with the Chan's
+// parallel one, to avoid cancellation errors.
+type Summary struct {
+	Count       int
+	Sum         float64
+	Min, Max    Record
+	First, Last Record
+	mean, m2    float64
+}
+
+// Add adds a record to the summary, records must be added in order of time
+func (s *Summary) Add(r Record) {
+	if s.Count == 0 {
+		s.Min, s.Max, s.First = r, r, r
+	}
+	s.Count++
+	s.Sum += r.Value
+	if r.Value < s.Min.Value {
+		s.Min = r
+	}
+	if r.Value > s.Max.Value {
+		s.Max = r
+	}
+	s.Last = r
+	delta := r.Value - s.mean
+	s.mean += delta / float64(s.Count)
+	s.m2 += delta * (r.Value - s.mean)
+}
+
+// Merge adds the records summarized by o, which must follow the ones
+// already summarized
+func (s *Summary) Merge(o *Summary) {
+	if o.Count == 0 {
+		return
+	}
+	if s.Count == 0 {
+		*s = *o
+		return
+	}
+	n := float64(s.Count + o.Count)
+	delta := o.mean - s.mean
+	s.m2 += o.m2 + delta*delta*float64(s.Count)*float64(o.Count)/n
+	s.mean += delta * float64(o.Count) / n
+	s.Count += o.Count
+	s.Sum += o.Sum
+	if o.Min.Value < s.Min.Value {
+		s.Min = o.Min
+	}
+	if o.Max.Value > s.Max.Value {
+		s.Max = o.Max
+	}
+	s.Last = o.Last
+}
+
+// Value returns the value of an aggregation of the summarized records
+func (s *Summary) Value(agg Aggregation) float64 {
+	switch agg {
+	case AggAvg:
+		return s.Sum / float64(s.Count)
+	case AggSum:
+		return s.Sum
+	case AggCount:
+		return float64(s.Count)
+	case AggMin:
+		return s.Min.Value
+	case AggMax:
+		return s.Max.Value
+	case AggFirst:
+		return s.First.Value
+	case AggLast:
+		return s.Last.Value
+	case AggStddev:
+		return math.Sqrt(s.m2 / float64(s.Count))
+	case AggVariance:
+		return s.m2 / float64(s.Count)
+	}
+	return math.NaN()
+}
+
+// Summarize returns the summary of the records between lo and hi included.
+// Blocks and chunks are summarized as they are written, so a range is
+// answered from the summaries of the blocks it covers and of the chunks of
+// the two blocks at its edges, only the chunks straddling the bounds are
+// decoded. Spans with late records not merged yet are decoded merging them.
+func (ts *TimeSeries) Summarize(lo, hi int64) Summary {
+	s, _ := ts.SummarizeContext(context.Background(), lo, hi)
+	return s
+}
+
+// SummarizeContext is like Summarize but gives up with the error of ctx once
+// it's done
+func (ts *TimeSeries) SummarizeContext(ctx context.Context, lo, hi int64) (Summary, error) {
+	s := Summary{}
+	err := ts.spans(ctx, func(b *block, late []Record) error {
+		if len(late) > 0 {
+			it := spanIterator(ctx, b, late)
+			for it.Next() {
+				if r := it.At(); r.Timestamp >= lo && r.Timestamp <= hi {
+					s.Add(r)
+				}
+			}
+			return it.Err()
+		}
+		if b.maxT() < lo || b.minT() > hi {
+			return nil
+		}
+		if b.minT() >= lo && b.maxT() <= hi {
+			s.Merge(&b.summary)
+			return nil
+		}
+		for _, c := range b.chunks {
+			if c.maxT() < lo || c.minT > hi {
+				continue
+			}
+			if c.minT >= lo && c.maxT() <= hi {
+				s.Merge(&c.summary)
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			it := c.iterator()
+			for it.Next() {
+				if r := it.At(); r.Timestamp >= lo && r.Timestamp <= hi {
+					s.Add(r)
+				}
+			}
+		}
+		return nil
+	})
+	return s, err
+}
@@ -0,0 +1,150 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package timeseries
+
+import (
+	"math"
+	"testing"
+)
+
+// naiveSummary summarizes the decoded records between lo and hi one by one
+func naiveSummary(ts *TimeSeries, lo, hi int64) Summary {
+	s := Summary{}
+	for _, r := range ts.Records() {
+		if r.Timestamp >= lo && r.Timestamp <= hi {
+			s.Add(r)
+		}
+	}
+	return s
+}
+
+func newSummarySeries() *TimeSeries {
+	ts := NewTimeSeries("test-ts", 0)
+	for i := 0; i < 1000; i++ {
+		ts.AddRecord(&Record{int64(i) * 1e9, float64((i * 37) % 101)})
+	}
+	return ts
+}
+
+func TestTimeSeriesSummarize(t *testing.T) {
+	ts := newSummarySeries()
+	bounds := [][2]int64{
+		{math.MinInt64, math.MaxInt64},
+		{0, 119e9},
+		{50e9, 700e9},
+		{121e9, 121e9},
+		{2000e9, 3000e9},
+	}
+	for _, b := range bounds {
+		s, expected := ts.Summarize(b[0], b[1]), naiveSummary(ts, b[0], b[1])
+		if s.Count != expected.Count || s.Sum != expected.Sum ||
+			s.Min != expected.Min || s.Max != expected.Max ||
+			s.First != expected.First || s.Last != expected.Last {
+			t.Errorf("Wrong summary of %v, expected %v got %v", b, expected, s)
+		}
+		if s.Count > 0 && math.Abs(s.Value(AggVariance)-expected.Value(AggVariance)) > 1e-9 {
+			t.Errorf("Wrong variance of %v, expected %v got %v",
+				b, expected.Value(AggVariance), s.Value(AggVariance))
+		}
+	}
+}
+
+func TestTimeSeriesMinMaxKeepEarliest(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	for i := 0; i < 3*chunkSize; i++ {
+		ts.AddRecord(&Record{int64(i), float64(i % 2)})
+	}
+	min, _ := ts.Min()
+	max, _ := ts.Max()
+	if *min != (Record{0, 0}) || *max != (Record{1, 1}) {
+		t.Errorf("Expected the earliest min and max, got %v %v", min, max)
+	}
+}
+
+func TestTimeSeriesSummaryAfterRewrite(t *testing.T) {
+	ts := newSummarySeries()
+	// Late records and decoding both rebuild the summaries
+	ts.AddRecord(&Record{10e9 + 1, -5})
+	ts.AddRecord(&Record{500e9 + 1, 500})
+	b, err := ts.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to marshal timeseries: %v", err)
+	}
+	decoded := &TimeSeries{}
+	if err := decoded.UnmarshalBinary(b); err != nil {
+		t.Fatalf("Failed to unmarshal timeseries: %v", err)
+	}
+	for _, s := range []*TimeSeries{ts, decoded} {
+		min, _ := s.Min()
+		max, _ := s.Max()
+		avg, _ := s.Average()
+		expected := naiveSummary(ts, math.MinInt64, math.MaxInt64)
+		if *min != expected.Min || *max != expected.Max ||
+			math.Abs(avg-expected.Value(AggAvg)) > 1e-9 {
+			t.Errorf("Wrong summary after rewrite, got %v %v %v", min, max, avg)
+		}
+	}
+}
+
+func TestTimeSeriesAggregateRange(t *testing.T) {
+	ts := newSummarySeries()
+	for _, interval := range []int64{0, 7e9, 60e9, 120e9, 500e9} {
+		for _, agg := range []Aggregation{AggAvg, AggCount, AggMin, AggLast, AggStddev} {
+			records, err := ts.AggregateRange(agg, interval, 95e9, 845e9)
+			if err != nil {
+				t.Fatalf("Failed to aggregate range: %v", err)
+			}
+			tmp, _ := ts.Range(95e9, 845e9)
+			expected, _ := tmp.Aggregate(agg, interval)
+			if len(records) != len(expected) {
+				t.Fatalf("Expected %v windows got %v", len(expected), len(records))
+			}
+			for i := range records {
+				if records[i].Timestamp != expected[i].Timestamp ||
+					math.Abs(records[i].Value-expected[i].Value) > 1e-9 {
+					t.Errorf("Wrong %v window %v every %v, expected %v got %v",
+						agg, i, interval, expected[i], records[i])
+				}
+			}
+		}
+	}
+	records, err := ts.AggregateRange(AggSum, 0, 2000e9, 3000e9)
+	if err != nil || len(records) != 0 {
+		t.Errorf("Expected no windows out of the series, got %v %v", records, err)
+	}
+}
+
+func BenchmarkTimeSeriesAggregateRange(b *testing.B) {
+	ts := NewTimeSeries("test-ts", 0)
+	for i := 0; i < 100000; i++ {
+		ts.AddRecord(&Record{int64(i) * 1e9, float64(i % 100)})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ts.AggregateRange(AggAvg, 3600e9, 1000e9, 90000e9)
+	}
+}
@@ -27,10 +27,13 @@
 package timeseries
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"time"
+	"unsafe"
 )
 
 var (
@@ -45,16 +48,26 @@ type Record struct {
 }
 
 // TimeSeries represents a time series, essentially an append-only log of point
-// values in time
+// values in time, identified by its name and labels. Retention is the maximum
+// age in nanoseconds of the records kept, 0 means that records never expire.
+// Records are stored in compressed chunks of at most chunkSize records,
+// grouped in blocks of a fixed span of time and ordered by timestamp, only
+// the last chunk accepts new records. Late records are collected in a
+// sorted buffer and merged into the older chunks in batches, those older than
+// OutOfOrderWindow nanoseconds with respect to the most recent record are
+// rejected, 0 means that any late record is accepted. Records with the
+// timestamp of a stored one are handled according to Duplicates.
 type TimeSeries struct {
-	Name      string
-	Retention int64
-	ctime     time.Time
-	Records   []*Record
-}
-
-func newRecord(value float64) *Record {
-	return &Record{time.Now().UnixNano(), value}
+	Name             string
+	Labels           Labels
+	Retention        int64
+	OutOfOrderWindow int64
+	Duplicates       DuplicatePolicy
+	ctime            time.Time
+	clock            Clock
+	blocks           []*block
+	ooo              []Record
+	size             int
 }
 
 // NewTestSeries create a new TimeSeries by accepting a name and a retention value
@@ -63,177 +76,367 @@ func NewTimeSeries(name string, retention int64) *TimeSeries {
 		Name:      name,
 		Retention: retention,
 		ctime:     time.Now(),
-		Records:   []*Record{},
+		clock:     systemClock{},
+		blocks:    []*block{},
 	}
 }
 
 func (ts *TimeSeries) Len() int {
-	return len(ts.Records)
+	return ts.size
+}
+
+// Created returns the creation time of the TimeSeries
+func (ts *TimeSeries) Created() time.Time {
+	return ts.ctime
+}
+
+// SetCreated sets the creation time of the TimeSeries, restoring it once
+// recreated
+func (ts *TimeSeries) SetCreated(t time.Time) {
+	ts.ctime = t
+}
+
+// MemoryUsage estimates the bytes taken by the records of the TimeSeries,
+// compressed in chunks or waiting in the out-of-order buffer
+func (ts *TimeSeries) MemoryUsage() int {
+	usage := len(ts.ooo) * int(unsafe.Sizeof(Record{}))
+	for _, b := range ts.blocks {
+		usage += int(unsafe.Sizeof(*b))
+		for _, c := range b.chunks {
+			usage += int(unsafe.Sizeof(*c)) + cap(c.b.stream)
+		}
+	}
+	return usage
+}
+
+// Iterator returns an Iterator over all the records of the TimeSeries, it's
+// invalidated by any write to the TimeSeries. Reads never modify the
+// TimeSeries, late records not merged yet are merged on the fly.
+func (ts *TimeSeries) Iterator() *Iterator {
+	return &Iterator{blocks: ts.blocks, late: ts.ooo}
+}
+
+// IteratorContext is like Iterator but the Iterator stops with the error of
+// ctx once it's done
+func (ts *TimeSeries) IteratorContext(ctx context.Context) *Iterator {
+	return &Iterator{ctx: ctx, blocks: ts.blocks, late: ts.ooo}
+}
+
+// spanIterator returns an Iterator over the records of a span, merging its
+// late records on the fly
+func spanIterator(ctx context.Context, b *block, late []Record) *Iterator {
+	it := &Iterator{ctx: ctx, late: late}
+	if b != nil {
+		it.blocks = []*block{b}
+	}
+	return it
+}
+
+// Records decodes and returns all the records of the TimeSeries
+func (ts *TimeSeries) Records() []Record {
+	records := make([]Record, 0, ts.size)
+	it := ts.Iterator()
+	for it.Next() {
+		records = append(records, it.At())
+	}
+	return records
 }
 
 // AddPoint add a new point to an existing TimeSeries
 func (ts *TimeSeries) AddPoint(value float64) Record {
-	record := newRecord(value)
+	record := &Record{ts.clock.Now().UnixNano(), value}
 	ts.AddRecord(record)
 	return *record
 }
 
-func (ts *TimeSeries) AddRecord(record *Record) {
-	last, err := ts.Last()
-	if err != nil {
-		ts.Records = append(ts.Records, record)
+// AddRecord adds a record to the TimeSeries, returning true if it's merged
+// with a record having the same timestamp. OutOfOrderErr is returned if it's
+// older than the out-of-order window allows and DuplicateErr if the duplicate
+// policy rejects it.
+func (ts *TimeSeries) AddRecord(record *Record) (bool, error) {
+	n := len(ts.blocks)
+	late := n > 0 && record.Timestamp < ts.blocks[n-1].maxT()
+	if late && ts.OutOfOrderWindow > 0 &&
+		ts.blocks[n-1].maxT()-record.Timestamp > ts.OutOfOrderWindow {
+		return false, OutOfOrderErr
+	}
+	if n > 0 && ts.Duplicates != DuplicateAllow {
+		if merged, err := ts.mergeDuplicate(record); merged || err != nil {
+			return merged, err
+		}
+	}
+	if late {
+		ts.bufferRecord(record)
 	} else {
-		first, _ := ts.First()
-		if record.Timestamp >= last.Timestamp {
-			ts.Records = append(ts.Records, record)
-		} else if record.Timestamp <= first.Timestamp {
-			ts.Records = append([]*Record{record}, ts.Records...)
-		} else {
-			// We need to binary search for the correct position of the
-			// new record
-			mid, left, right := 0, 0, ts.Len()-1
-			found := false
-			for left <= right {
-				mid = (left + right) / 2
-				if ts.Records[mid].Timestamp < record.Timestamp {
-					left = mid + 1
-				} else if ts.Records[mid].Timestamp > record.Timestamp {
-					right = mid - 1
-				} else {
-					found = true
-					break
-				}
-			}
-			if !found {
-				if ts.Records[left].Timestamp > record.Timestamp {
-					mid = left
-				} else {
-					mid = right
-				}
+		// Records in the span of a new block start a new chunk
+		start := blockStart(record.Timestamp)
+		if n == 0 || ts.blocks[n-1].start != start {
+			ts.blocks = append(ts.blocks, &block{start: start})
+			n++
+		}
+		ts.blocks[n-1].append(record.Timestamp, record.Value)
+	}
+	ts.size++
+	ts.expireOnWrite()
+	return false, nil
+}
+
+// AddRecords adds a batch of records, either all of them or none: if any
+// record would be rejected by the out-of-order window or by the duplicate
+// policy, OutOfOrderErr or DuplicateErr is returned and nothing is stored.
+// It returns the number of records merged with a record having the same
+// timestamp.
+func (ts *TimeSeries) AddRecords(records []Record) (int, error) {
+	if err := ts.checkRecords(records); err != nil {
+		return 0, err
+	}
+	merged := 0
+	for i := range records {
+		record := records[i]
+		if ok, _ := ts.AddRecord(&record); ok {
+			merged++
+		}
+	}
+	return merged, nil
+}
+
+// checkRecords tells if AddRecord would reject any record of a batch added
+// in order, the most recent timestamp moves forward as records are added
+func (ts *TimeSeries) checkRecords(records []Record) error {
+	n := len(ts.blocks)
+	var latest int64
+	if n > 0 {
+		latest = ts.blocks[n-1].maxT()
+	}
+	seen := make(map[int64]bool)
+	for i, record := range records {
+		stored := n > 0 || i > 0
+		if stored && ts.OutOfOrderWindow > 0 &&
+			latest-record.Timestamp > ts.OutOfOrderWindow {
+			return OutOfOrderErr
+		}
+		if ts.Duplicates == DuplicateBlock {
+			if r, _ := ts.Find(record.Timestamp); r != nil || seen[record.Timestamp] {
+				return DuplicateErr
 			}
-			ts.Records = append(ts.Records, nil)
-			copy(ts.Records[mid+1:], ts.Records[mid:])
-			ts.Records[mid] = record
+			seen[record.Timestamp] = true
+		}
+		if !stored || record.Timestamp > latest {
+			latest = record.Timestamp
 		}
 	}
+	return nil
 }
 
+// Average, Max and Min are answered from the summaries of the blocks, without
+// decoding any record
 func (ts *TimeSeries) Average() (float64, error) {
-	if len(ts.Records) == 0 {
+	if ts.size == 0 {
 		return 0.0, EmptyTimeSeriesErr
 	}
-	var sum float64 = 0.0
-	for _, v := range ts.Records {
-		sum += v.Value
-	}
-	return sum / float64(len(ts.Records)), nil
+	summary := ts.Summarize(math.MinInt64, math.MaxInt64)
+	return summary.Value(AggAvg), nil
 }
 
 func (ts *TimeSeries) Max() (*Record, error) {
-	if len(ts.Records) == 0 {
+	if ts.size == 0 {
 		return nil, EmptyTimeSeriesErr
 	}
-	max := ts.Records[0]
-	for _, v := range ts.Records {
-		if v.Value > max.Value {
-			max = v
-		}
-	}
-	return max, nil
+	summary := ts.Summarize(math.MinInt64, math.MaxInt64)
+	return &summary.Max, nil
 }
 
 func (ts *TimeSeries) Min() (*Record, error) {
-	if len(ts.Records) == 0 {
+	if ts.size == 0 {
 		return nil, EmptyTimeSeriesErr
 	}
-	min := ts.Records[0]
-	for _, v := range ts.Records {
-		if v.Value < min.Value {
-			min = v
-		}
-	}
-	return min, nil
+	summary := ts.Summarize(math.MinInt64, math.MaxInt64)
+	return &summary.Min, nil
 }
 
 func (ts *TimeSeries) First() (*Record, error) {
-	if len(ts.Records) == 0 {
+	if ts.size == 0 {
 		return nil, EmptyTimeSeriesErr
 	}
-	return ts.Records[0], nil
+	it := ts.Iterator()
+	it.Next()
+	first := it.At()
+	return &first, nil
 }
 
 func (ts *TimeSeries) Last() (*Record, error) {
-	if len(ts.Records) == 0 {
+	if ts.size == 0 {
 		return nil, EmptyTimeSeriesErr
 	}
-	last := len(ts.Records) - 1
-	return ts.Records[last], nil
+	b := ts.blocks[len(ts.blocks)-1]
+	last := b.chunks[len(b.chunks)-1]
+	return &Record{last.t, last.v}, nil
 }
 
 func (ts *TimeSeries) Range(lo, hi int64) (*TimeSeries, error) {
-	if len(ts.Records) == 0 {
+	return ts.RangeContext(context.Background(), lo, hi)
+}
+
+// RangeContext is like Range but gives up with the error of ctx once it's
+// done
+func (ts *TimeSeries) RangeContext(ctx context.Context, lo, hi int64) (*TimeSeries, error) {
+	if ts.size == 0 {
 		return nil, EmptyTimeSeriesErr
 	}
-	result := make([]*Record, 0)
-	for _, record := range ts.Records {
-		if record.Timestamp >= lo && record.Timestamp <= hi {
-			result = append(result, record)
+	tempTs := NewTimeSeries(fmt.Sprintf("%s%s", "range-tmp-", ts.Name), 0)
+	err := ts.spans(ctx, func(b *block, late []Record) error {
+		// Spans with late records are decoded merging them
+		if len(late) > 0 {
+			records := make([]Record, 0, len(late))
+			it := spanIterator(ctx, b, late)
+			for it.Next() {
+				if r := it.At(); r.Timestamp >= lo && r.Timestamp <= hi {
+					records = append(records, r)
+				}
+			}
+			tempTs.blocks = append(tempTs.blocks, newBlocksFrom(records)...)
+			tempTs.size += len(records)
+			return it.Err()
+		}
+		if b.maxT() < lo || b.minT() > hi {
+			return nil
 		}
+		// Blocks entirely in range are copied without being decoded
+		if b.minT() >= lo && b.maxT() <= hi {
+			b = b.clone()
+		} else if b = b.slice(lo, hi); b == nil {
+			return nil
+		}
+		tempTs.blocks = append(tempTs.blocks, b)
+		tempTs.size += b.count()
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	tempTs := NewTimeSeries(fmt.Sprintf("%s%s", "range-tmp-", ts.Name), 0)
-	tempTs.Records = result
 	return tempTs, nil
 }
 
+// DeleteRange removes the records with timestamp between lo and hi, both
+// included, and returns the number of records removed
+func (ts *TimeSeries) DeleteRange(lo, hi int64) int {
+	ts.Flush()
+	removed := 0
+	blocks := ts.blocks[:0]
+	for _, b := range ts.blocks {
+		if b.maxT() < lo || b.minT() > hi {
+			blocks = append(blocks, b)
+			continue
+		}
+		// Blocks and chunks entirely in range are dropped, the chunks
+		// straddling a bound are rewritten without the records in range
+		if b.minT() >= lo && b.maxT() <= hi {
+			removed += b.count()
+			continue
+		}
+		chunks := make([]*chunk, 0, len(b.chunks))
+		for _, c := range b.chunks {
+			if c.maxT() < lo || c.minT > hi {
+				chunks = append(chunks, c)
+				continue
+			}
+			records := make([]Record, 0, c.count)
+			for _, record := range c.records() {
+				if record.Timestamp < lo || record.Timestamp > hi {
+					records = append(records, record)
+				}
+			}
+			removed += c.count - len(records)
+			if len(records) > 0 {
+				chunks = append(chunks, newChunkFrom(records))
+			}
+		}
+		b.chunks = chunks
+		b.resummarize()
+		blocks = append(blocks, b)
+	}
+	for i := len(blocks); i < len(ts.blocks); i++ {
+		ts.blocks[i] = nil
+	}
+	ts.blocks = blocks
+	ts.size -= removed
+	return removed
+}
+
+// Find returns the first record with the given timestamp along with its
+// position in the TimeSeries, nil and -1 if there's none
 func (ts *TimeSeries) Find(timestamp int64) (*Record, int) {
-	if first, err := ts.First(); err != nil || first.Timestamp > timestamp {
-		return nil, -1
+	record, index := ts.findStored(timestamp)
+	// Late records are merged after the stored ones with the same timestamp
+	late := sort.Search(len(ts.ooo), func(i int) bool {
+		return ts.ooo[i].Timestamp >= timestamp
+	})
+	if record != nil {
+		return record, index + late
+	}
+	if late < len(ts.ooo) && ts.ooo[late].Timestamp == timestamp {
+		record := ts.ooo[late]
+		return &record, index + late
+	}
+	return nil, -1
+}
+
+// findStored looks for the first record with the given timestamp stored in
+// the chunks, returning it with the number of stored records preceding it
+func (ts *TimeSeries) findStored(timestamp int64) (*Record, int) {
+	i, ok := ts.blockIndex(timestamp)
+	index := 0
+	for _, b := range ts.blocks[:i] {
+		index += b.count()
 	}
-	if last, err := ts.Last(); err != nil || last.Timestamp < timestamp {
-		return nil, -1
+	if !ok {
+		return nil, index
 	}
-	var mid, left, right int = 0, 0, len(ts.Records) - 1
-	for left < right {
-		mid = (left + right) / 2
-		if ts.Records[mid].Timestamp < timestamp {
-			left = mid
-		} else if ts.Records[mid].Timestamp > timestamp {
-			right = mid
-		} else {
-			return ts.Records[mid], mid
+	b := ts.blocks[i]
+	j := sort.Search(len(b.chunks), func(j int) bool {
+		return b.chunks[j].maxT() >= timestamp
+	})
+	for _, c := range b.chunks[:j] {
+		index += c.count
+	}
+	if j == len(b.chunks) {
+		return nil, index
+	}
+	it := b.chunks[j].iterator()
+	for it.Next() {
+		record := it.At()
+		if record.Timestamp > timestamp {
+			break
+		}
+		if record.Timestamp == timestamp {
+			return &record, index
 		}
+		index++
 	}
-	return nil, -1
+	return nil, index
 }
 
-func (ts *TimeSeries) AverageInterval(interval_ms int64) ([]Record, error) {
-	first, err := ts.First()
-	if err != nil {
-		return nil, err
+// AverageInterval returns the average of the records in windows of
+// interval nanoseconds, each one timestamped with its end, windows ending
+// after the last record are left out.
+//
+// Deprecated: use Aggregate with AggAvg.
+func (ts *TimeSeries) AverageInterval(interval int64) ([]Record, error) {
+	if interval <= 0 {
+		return nil, InvalidIntervalErr
 	}
-	last, err := ts.Last()
+	windows, err := ts.Aggregate(AggAvg, interval)
 	if err != nil {
 		return nil, err
 	}
-	interval := interval_ms * 1e6
-	firstTs := (first.Timestamp / interval) * interval
-	result := make([]Record, 0)
-	var current int64 = firstTs + interval
-	var sum float64 = 0.0
-	var total int = 0
-	for current < last.Timestamp {
-		sum = 0.0
-		total = 0
-		for _, r := range ts.Records {
-			if r.Timestamp > current-interval && r.Timestamp < current {
-				sum += r.Value
-				total += 1
-			}
-		}
-		if !math.IsNaN(sum / float64(total)) {
-			result = append(result, Record{current, sum / float64(total)})
+	last := ts.blocks[len(ts.blocks)-1].maxT()
+	result := make([]Record, 0, len(windows))
+	for _, w := range windows {
+		end := w.Timestamp + interval
+		if end >= last {
+			break
 		}
-		current += interval
+		result = append(result, Record{end, w.Value})
 	}
 	return result, nil
 }
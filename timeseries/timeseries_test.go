@@ -27,30 +27,46 @@
 package timeseries
 
 import (
+	"context"
 	"testing"
 	"time"
 )
 
 func TestTimeSeriesNew(t *testing.T) {
-	ts := NewTimeSeries("test-ts", 3000)
-	if ts == nil || ts.Name != "test-ts" || ts.Retention != 3000 {
+	ts := NewTimeSeries("test-ts", 3e9)
+	if ts == nil || ts.Name != "test-ts" || ts.Retention != 3e9 {
 		t.Errorf("Failed to create a new TimeSeries")
 	}
 }
 
+func TestTimeSeriesMemoryUsage(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	if ts.MemoryUsage() != 0 {
+		t.Errorf("Expected no memory used by an empty TimeSeries")
+	}
+	ts.AddRecord(&Record{10, 1})
+	usage := ts.MemoryUsage()
+	for i := 0; i < chunkSize*2; i++ {
+		ts.AddRecord(&Record{int64(i) + 20, 1})
+	}
+	if ts.MemoryUsage() <= usage {
+		t.Errorf("Expected memory usage to grow, got %v", ts.MemoryUsage())
+	}
+}
+
 func TestTimeSeriesAddPoint(t *testing.T) {
-	ts := NewTimeSeries("test-ts", 3000)
+	ts := NewTimeSeries("test-ts", 3e9)
 	record := ts.AddPoint(98.2)
-	if len(ts.Records) != 1 {
+	if ts.Len() != 1 {
 		t.Errorf("Failed to add new point to TimeSeries")
 	}
-	if ts.Records[0].Value != 98.2 || record.Value != 98.2 {
+	if ts.Records()[0].Value != 98.2 || record.Value != 98.2 {
 		t.Errorf("Failed to add new point to TimeSeries")
 	}
 }
 
 func TestTimeSeriesAddRecord(t *testing.T) {
-	ts := NewTimeSeries("test-ts", 3000)
+	ts := NewTimeSeries("test-ts", 3e9)
 	record0 := Record{0, 2.4}
 	record1 := Record{1, 2.4}
 	record2 := Record{4, 2.4}
@@ -62,13 +78,13 @@ func TestTimeSeriesAddRecord(t *testing.T) {
 	if ts.Len() != 4 {
 		t.Errorf("Failed to add new record to TimeSeries")
 	}
-	if ts.Records[2].Timestamp != 2 {
+	if ts.Records()[2].Timestamp != 2 {
 		t.Errorf("Failed to add new record to TimeSeries")
 	}
 }
 
 func TestTimeSeriesAverage(t *testing.T) {
-	ts := NewTimeSeries("test-ts", 3000)
+	ts := NewTimeSeries("test-ts", 3e9)
 	ts.AddPoint(98.2)
 	ts.AddPoint(106.2)
 	ts.AddPoint(98.22)
@@ -80,7 +96,7 @@ func TestTimeSeriesAverage(t *testing.T) {
 }
 
 func TestTimeSeriesMax(t *testing.T) {
-	ts := NewTimeSeries("test-ts", 3000)
+	ts := NewTimeSeries("test-ts", 3e9)
 	ts.AddPoint(98.2)
 	ts.AddPoint(106.2)
 	ts.AddPoint(98.22)
@@ -92,7 +108,7 @@ func TestTimeSeriesMax(t *testing.T) {
 }
 
 func TestTimeSeriesMin(t *testing.T) {
-	ts := NewTimeSeries("test-ts", 3000)
+	ts := NewTimeSeries("test-ts", 3e9)
 	ts.AddPoint(98.2)
 	ts.AddPoint(106.2)
 	ts.AddPoint(98.22)
@@ -104,7 +120,7 @@ func TestTimeSeriesMin(t *testing.T) {
 }
 
 func TestTimeSeriesFirst(t *testing.T) {
-	ts := NewTimeSeries("test-ts", 3000)
+	ts := NewTimeSeries("test-ts", 3e9)
 	ts.AddPoint(98.2)
 	ts.AddPoint(106.2)
 	ts.AddPoint(98.22)
@@ -117,7 +133,7 @@ func TestTimeSeriesFirst(t *testing.T) {
 }
 
 func TestTimeSeriesLast(t *testing.T) {
-	ts := NewTimeSeries("test-ts", 3000)
+	ts := NewTimeSeries("test-ts", 3e9)
 	ts.AddPoint(98.2)
 	ts.AddPoint(106.2)
 	ts.AddPoint(98.22)
@@ -129,7 +145,7 @@ func TestTimeSeriesLast(t *testing.T) {
 }
 
 func TestTimeSeriesRange(t *testing.T) {
-	ts := NewTimeSeries("test-ts", 3000)
+	ts := NewTimeSeries("test-ts", 3e9)
 	ts.AddPoint(98.2)
 	time.Sleep(200 * time.Millisecond)
 	start := ts.AddPoint(106.2)
@@ -139,13 +155,42 @@ func TestTimeSeriesRange(t *testing.T) {
 	end := ts.AddPoint(65.98)
 	ts.AddPoint(77.0)
 	resTs, _ := ts.Range(start.Timestamp, end.Timestamp)
-	if len(resTs.Records) != 4 {
-		t.Errorf("Wrong slice size returned, expected %v got %v", 4, len(resTs.Records))
+	if resTs.Len() != 4 {
+		t.Errorf("Wrong slice size returned, expected %v got %v", 4, resTs.Len())
+	}
+}
+
+func TestTimeSeriesDeleteRange(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	n := chunkSize * 3
+	for i := 0; i < n; i++ {
+		ts.AddRecord(&Record{int64(i), float64(i)})
+	}
+	// The range covers a whole chunk and part of the ones around it
+	lo, hi := int64(chunkSize/2), int64(chunkSize*2+chunkSize/2)
+	if removed := ts.DeleteRange(lo, hi); removed != int(hi-lo+1) {
+		t.Errorf("Expected %v records removed got %v", hi-lo+1, removed)
+	}
+	if ts.Len() != n-int(hi-lo+1) {
+		t.Errorf("Expected %v records left got %v", n-int(hi-lo+1), ts.Len())
+	}
+	for _, record := range ts.Records() {
+		if record.Timestamp >= lo && record.Timestamp <= hi {
+			t.Errorf("Found record %v in the deleted range", record)
+		}
+	}
+	if removed := ts.DeleteRange(lo, hi); removed != 0 {
+		t.Errorf("Expected no records removed got %v", removed)
+	}
+	// The last chunk keeps accepting new records
+	ts.AddRecord(&Record{int64(n), 1})
+	if last, _ := ts.Last(); last.Timestamp != int64(n) {
+		t.Errorf("Expected last record at %v got %v", n, last.Timestamp)
 	}
 }
 
 func TestTimeSeriesFind(t *testing.T) {
-	ts := NewTimeSeries("test-ts", 3000)
+	ts := NewTimeSeries("test-ts", 3e9)
 	ts.AddPoint(98.2)
 	time.Sleep(200 * time.Millisecond)
 	start := ts.AddPoint(106.2)
@@ -160,8 +205,42 @@ func TestTimeSeriesFind(t *testing.T) {
 	}
 }
 
+func TestTimeSeriesAddRecords(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	ts.OutOfOrderWindow = 500
+	// The last record moves the window forward, the one before it falls
+	// out of it, nothing is stored
+	batch := []Record{{1000, 1}, {1, 2}, {2000, 3}}
+	if _, err := ts.AddRecords(batch); err != OutOfOrderErr {
+		t.Errorf("Expected OutOfOrderErr got %v", err)
+	}
+	if _, err := ts.AddRecords([]Record{{1000, 1}, {2000, 2}, {1400, 3}}); err != OutOfOrderErr {
+		t.Errorf("Expected OutOfOrderErr got %v", err)
+	}
+	if ts.Len() != 0 {
+		t.Fatalf("Expected no records stored got %v", ts.Records())
+	}
+	ts.Duplicates = DuplicateBlock
+	if _, err := ts.AddRecords([]Record{{1000, 1}, {1200, 2}, {1000, 3}}); err != DuplicateErr {
+		t.Errorf("Expected DuplicateErr got %v", err)
+	}
+	if merged, err := ts.AddRecords([]Record{{1000, 1}, {1200, 2}, {1100, 3}}); err != nil || merged != 0 {
+		t.Errorf("Failed to add records: %v %v", merged, err)
+	}
+	if _, err := ts.AddRecords([]Record{{1300, 1}, {1100, 2}}); err != DuplicateErr {
+		t.Errorf("Expected DuplicateErr got %v", err)
+	}
+	ts.Duplicates = DuplicateSum
+	if merged, err := ts.AddRecords([]Record{{1300, 1}, {1100, 2}}); err != nil || merged != 1 {
+		t.Errorf("Expected a record merged got %v %v", merged, err)
+	}
+	if ts.Len() != 4 {
+		t.Errorf("Expected 4 records got %v", ts.Records())
+	}
+}
+
 func TestTimeSeriesAverageInterval(t *testing.T) {
-	ts := NewTimeSeries("test-ts", 3000)
+	ts := NewTimeSeries("test-ts", 3e9)
 	ts.AddPoint(98.2)
 	time.Sleep(200 * time.Millisecond)
 	ts.AddPoint(106.2)
@@ -170,9 +249,44 @@ func TestTimeSeriesAverageInterval(t *testing.T) {
 	time.Sleep(200 * time.Millisecond)
 	ts.AddPoint(65.98)
 	ts.AddPoint(77.0)
-	records, _ := ts.AverageInterval(200)
+	records, _ := ts.AverageInterval(200e6)
 	if len(records) != 2 {
 		t.Errorf("AverageInterval return the wrong points, expected %v got %v",
 			2, len(records))
 	}
 }
+
+func TestTimeSeriesContext(t *testing.T) {
+	ts := NewTimeSeries("test-ts", 0)
+	for i := int64(0); i < 10*chunkSize; i++ {
+		ts.AddRecord(&Record{i * 1e9, float64(i)})
+	}
+	// Iterators stop at the chunk following the cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	it := ts.IteratorContext(ctx)
+	n := 0
+	for it.Next() {
+		if n++; n == 1 {
+			cancel()
+		}
+	}
+	if n != chunkSize || it.Err() != context.Canceled {
+		t.Errorf("Expected %v records and context.Canceled got %v %v", chunkSize, n, it.Err())
+	}
+	if _, err := ts.RangeContext(ctx, 0, 100e9); err != context.Canceled {
+		t.Errorf("Expected Range to be canceled got %v", err)
+	}
+	if _, err := ts.SummarizeContext(ctx, 1, 100e9); err != context.Canceled {
+		t.Errorf("Expected Summarize to be canceled got %v", err)
+	}
+	if _, err := ts.AggregateRangeContext(ctx, AggAvg, 60e9, 0, 100e9); err != context.Canceled {
+		t.Errorf("Expected AggregateRange to be canceled got %v", err)
+	}
+	if _, err := ts.QuantileContext(ctx, 0.5, 0); err != context.Canceled {
+		t.Errorf("Expected Quantile to be canceled got %v", err)
+	}
+	if _, err := ts.RateContext(ctx, 0); err != context.Canceled {
+		t.Errorf("Expected Rate to be canceled got %v", err)
+	}
+}
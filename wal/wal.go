@@ -0,0 +1,356 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package wal implements a segmented write-ahead log, every entry is an opcode
+// followed by an opaque payload, checksummed to detect torn writes.
+//
+// Entries are appended to the current segment, once it grows beyond the
+// configured size a new segment is started. Segments preceding a checkpoint
+// can be removed as soon as their content is persisted elsewhere.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy defines how often the WAL is flushed to stable storage
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs every entry before Append returns
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in background every SyncInterval
+	SyncInterval
+	// SyncNever leaves the flushing of the written entries to the OS
+	SyncNever
+)
+
+const (
+	DefaultSegmentSize  = 64 << 20
+	DefaultSyncInterval = 1000 * time.Millisecond
+	segmentExt          = ".wal"
+	// crc32 + payload length + opcode
+	entryHeaderLen = 9
+)
+
+var (
+	CorruptedEntryErr    = errors.New("corrupted wal entry")
+	UnknownSyncPolicyErr = errors.New("unknown fsync policy, must be one of always, interval or never")
+)
+
+// Options configures a WAL, Dir is the only mandatory field, SegmentSize and
+// SyncInterval fall back to their default when not set
+type Options struct {
+	Dir          string
+	SegmentSize  int64
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+}
+
+// ParseSyncPolicy returns the SyncPolicy named by the string s
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return SyncAlways, UnknownSyncPolicyErr
+}
+
+// WAL is a write-ahead log safe for concurrent use
+type WAL struct {
+	mu      sync.Mutex
+	opts    Options
+	segment *os.File
+	index   uint64
+	size    int64
+	dirty   bool
+	done    chan struct{}
+}
+
+// Open opens the WAL stored in opts.Dir, creating it if it doesn't exist.
+// New entries are appended to the last segment found.
+func Open(opts Options) (*WAL, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{opts: opts, index: 1, done: make(chan struct{})}
+	if len(segments) > 0 {
+		w.index = segments[len(segments)-1]
+	}
+	if err := w.openSegment(w.index); err != nil {
+		return nil, err
+	}
+	if opts.SyncPolicy == SyncInterval {
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+func segmentName(dir string, index uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", index, segmentExt))
+}
+
+// listSegments returns the ordered indexes of the segments stored in dir
+func listSegments(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]uint64, 0, len(files))
+	for _, f := range files {
+		var index uint64
+		if f.IsDir() || filepath.Ext(f.Name()) != segmentExt {
+			continue
+		}
+		if _, err := fmt.Sscanf(f.Name(), "%020d", &index); err != nil {
+			continue
+		}
+		segments = append(segments, index)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	return segments, nil
+}
+
+func (w *WAL) openSegment(index uint64) error {
+	f, err := os.OpenFile(segmentName(w.opts.Dir, index),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.segment = f
+	w.index = index
+	w.size = info.Size()
+	return nil
+}
+
+// rotate seals the current segment and starts a new one, must be called
+// holding the lock
+func (w *WAL) rotate() error {
+	if err := w.segment.Sync(); err != nil {
+		return err
+	}
+	if err := w.segment.Close(); err != nil {
+		return err
+	}
+	w.dirty = false
+	return w.openSegment(w.index + 1)
+}
+
+// Append writes a new entry to the WAL, according to the SyncPolicy the
+// entry may or may not be on stable storage when Append returns
+func (w *WAL) Append(opcode byte, payload []byte) error {
+	entry := make([]byte, entryHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(entry[4:], uint32(len(payload)))
+	entry[8] = opcode
+	copy(entry[entryHeaderLen:], payload)
+	binary.BigEndian.PutUint32(entry, crc32.ChecksumIEEE(entry[8:]))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.segment.Write(entry); err != nil {
+		return err
+	}
+	w.size += int64(len(entry))
+	w.dirty = true
+	if w.opts.SyncPolicy == SyncAlways {
+		if err := w.segment.Sync(); err != nil {
+			return err
+		}
+		w.dirty = false
+	}
+	if w.size >= w.opts.SegmentSize {
+		return w.rotate()
+	}
+	return nil
+}
+
+// Sync flushes to stable storage all the entries written so far
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.segment.Sync()
+}
+
+func (w *WAL) syncLoop() {
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Sync()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Replay calls fn for every entry in the WAL, in the order they were
+// appended. It must be called before any Append, as a torn entry found at the
+// tail of the last segment, a consequence of a crash during a write, is
+// discarded by truncating the segment.
+func (w *WAL) Replay(fn func(opcode byte, payload []byte) error) error {
+	return w.ReplayFrom(0, fn)
+}
+
+// ReplayFrom works like Replay but skips the segments preceding index, whose
+// entries are already persisted elsewhere, e.g. by a snapshot
+func (w *WAL) ReplayFrom(index uint64, fn func(opcode byte, payload []byte) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	segments, err := listSegments(w.opts.Dir)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment < index {
+			continue
+		}
+		valid, err := replaySegment(segmentName(w.opts.Dir, segment), fn)
+		if err == CorruptedEntryErr && segment == w.index {
+			if err := w.segment.Truncate(valid); err != nil {
+				return err
+			}
+			w.size = valid
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySegment reads all the entries of a segment, returning the offset
+// following the last valid one
+func replaySegment(path string, fn func(byte, []byte) error) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var offset int64 = 0
+	header := make([]byte, entryHeaderLen)
+	for {
+		if _, err := io.ReadFull(f, header); err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, CorruptedEntryErr
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(f, payload); err != nil {
+			return offset, CorruptedEntryErr
+		}
+		crc := crc32.Update(crc32.ChecksumIEEE(header[8:]), crc32.IEEETable, payload)
+		if crc != binary.BigEndian.Uint32(header) {
+			return offset, CorruptedEntryErr
+		}
+		if err := fn(header[8], payload); err != nil {
+			return offset, err
+		}
+		offset += int64(entryHeaderLen + len(payload))
+	}
+}
+
+// Checkpoint seals the current segment and returns the index of the new one,
+// every entry appended before the call lives in a segment preceding it
+func (w *WAL) Checkpoint() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.rotate(); err != nil {
+		return 0, err
+	}
+	return w.index, nil
+}
+
+// Truncate removes all the segments preceding index, usually obtained from a
+// previous Checkpoint, once their entries are no longer needed
+func (w *WAL) Truncate(index uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	segments, err := listSegments(w.opts.Dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s >= index || s == w.index {
+			break
+		}
+		if err := os.Remove(segmentName(w.opts.Dir, s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes and closes the WAL
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.opts.SyncPolicy == SyncInterval {
+		close(w.done)
+	}
+	w.dirty = false
+	if err := w.segment.Sync(); err != nil {
+		return err
+	}
+	return w.segment.Close()
+}
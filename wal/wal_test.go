@@ -0,0 +1,180 @@
+// BSD 2-Clause License
+//
+// Copyright (c) 2020, Andrea Giacomo Baldan
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package wal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type entry struct {
+	opcode  byte
+	payload []byte
+}
+
+func openTestWAL(t *testing.T, opts Options) *WAL {
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	return w
+}
+
+func replayAll(t *testing.T, w *WAL) []entry {
+	entries := []entry{}
+	err := w.Replay(func(opcode byte, payload []byte) error {
+		entries = append(entries, entry{opcode, payload})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay WAL: %v", err)
+	}
+	return entries
+}
+
+func TestWALAppendReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "wal")
+	defer os.RemoveAll(dir)
+	w := openTestWAL(t, Options{Dir: dir})
+	expected := []entry{{0, []byte("create")}, {2, []byte("add")}, {1, []byte{}}}
+	for _, e := range expected {
+		if err := w.Append(e.opcode, e.payload); err != nil {
+			t.Fatalf("Failed to append to WAL: %v", err)
+		}
+	}
+	w.Close()
+	w = openTestWAL(t, Options{Dir: dir})
+	defer w.Close()
+	entries := replayAll(t, w)
+	if len(entries) != len(expected) {
+		t.Fatalf("Wrong number of entries replayed, expected %v got %v",
+			len(expected), len(entries))
+	}
+	for i, e := range entries {
+		if e.opcode != expected[i].opcode || !bytes.Equal(e.payload, expected[i].payload) {
+			t.Errorf("Wrong entry replayed, expected %v got %v", expected[i], e)
+		}
+	}
+}
+
+func TestWALSegmentRotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "wal")
+	defer os.RemoveAll(dir)
+	w := openTestWAL(t, Options{Dir: dir, SegmentSize: 64, SyncPolicy: SyncNever})
+	defer w.Close()
+	for i := 0; i < 20; i++ {
+		w.Append(2, bytes.Repeat([]byte{byte(i)}, 16))
+	}
+	segments, _ := listSegments(dir)
+	if len(segments) < 5 {
+		t.Errorf("Expected WAL to rotate segments, got %v segments", len(segments))
+	}
+	entries := replayAll(t, w)
+	if len(entries) != 20 {
+		t.Fatalf("Wrong number of entries replayed, expected %v got %v", 20, len(entries))
+	}
+	for i, e := range entries {
+		if e.payload[0] != byte(i) {
+			t.Errorf("Entries replayed out of order, expected %v got %v", i, e.payload[0])
+		}
+	}
+}
+
+func TestWALCheckpointTruncate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "wal")
+	defer os.RemoveAll(dir)
+	w := openTestWAL(t, Options{Dir: dir, SyncPolicy: SyncInterval})
+	defer w.Close()
+	w.Append(0, []byte("before"))
+	index, err := w.Checkpoint()
+	if err != nil {
+		t.Fatalf("Failed to checkpoint WAL: %v", err)
+	}
+	w.Append(0, []byte("after"))
+	if err := w.Truncate(index); err != nil {
+		t.Fatalf("Failed to truncate WAL: %v", err)
+	}
+	entries := replayAll(t, w)
+	if len(entries) != 1 || string(entries[0].payload) != "after" {
+		t.Errorf("Expected only entries after the checkpoint, got %v", entries)
+	}
+}
+
+func TestWALReplayFrom(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "wal")
+	defer os.RemoveAll(dir)
+	w := openTestWAL(t, Options{Dir: dir})
+	defer w.Close()
+	w.Append(0, []byte("before"))
+	index, _ := w.Checkpoint()
+	w.Append(0, []byte("after"))
+	entries := []entry{}
+	w.ReplayFrom(index, func(opcode byte, payload []byte) error {
+		entries = append(entries, entry{opcode, payload})
+		return nil
+	})
+	if len(entries) != 1 || string(entries[0].payload) != "after" {
+		t.Errorf("Expected only entries after the checkpoint, got %v", entries)
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "wal")
+	defer os.RemoveAll(dir)
+	w := openTestWAL(t, Options{Dir: dir})
+	w.Append(0, []byte("complete"))
+	w.Append(2, []byte("torn"))
+	w.Close()
+	// Simulate a crash in the middle of the last write
+	path := segmentName(dir, 1)
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-2)
+
+	w = openTestWAL(t, Options{Dir: dir})
+	entries := replayAll(t, w)
+	if len(entries) != 1 || string(entries[0].payload) != "complete" {
+		t.Errorf("Expected torn entry to be discarded, got %v", entries)
+	}
+	w.Append(2, []byte("new"))
+	w.Close()
+	w = openTestWAL(t, Options{Dir: dir})
+	defer w.Close()
+	if entries := replayAll(t, w); len(entries) != 2 {
+		t.Errorf("Expected WAL to be writable after a torn tail, got %v", entries)
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	if p, err := ParseSyncPolicy("INTERVAL"); err != nil || p != SyncInterval {
+		t.Errorf("Failed to parse fsync policy")
+	}
+	if _, err := ParseSyncPolicy("sometimes"); err != UnknownSyncPolicyErr {
+		t.Errorf("Expected error parsing unknown fsync policy")
+	}
+}